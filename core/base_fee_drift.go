@@ -0,0 +1,67 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/consensus/misc/eip1559"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// BaseFeeDrift describes a block replayed with a frozen base fee, along with the
+// base fee the fee market would have set for it.
+type BaseFeeDrift struct {
+	Number   uint64   // Number of the block
+	GasUsed  uint64   // Gas used by the block when replayed
+	GasLimit uint64   // Gas limit of the block
+	BaseFee  *big.Int // Base fee derived from the replayed gas usage of the preceding blocks
+}
+
+// ReplayBaseFeeDrift processes the consecutive blocks on top of statedb with the
+// base fee frozen at cfg.BaseFeeOverride, and reports for every block the base
+// fee the standard EIP-1559 formula would have resulted in given the gas usage
+// of the replayed blocks before it, starting from the base fee of the first one.
+// The standard formula is used even on chains with a fixed base fee, e.g. Parlia.
+//
+// The blocks are replayed on the same statedb without committing in between,
+// it holds the state after the last processed block on return.
+func (p *StateProcessor) ReplayBaseFeeDrift(blocks []*types.Block, statedb *state.StateDB, cfg ProcessConfig) ([]BaseFeeDrift, error) {
+	if cfg.BaseFeeOverride == nil {
+		return nil, errors.New("base fee override not set")
+	}
+	config := *p.config
+	config.Parlia = nil
+
+	drift := make([]BaseFeeDrift, 0, len(blocks))
+	for i, block := range blocks {
+		baseFee := block.BaseFee()
+		if i > 0 {
+			prev := drift[i-1]
+			baseFee = eip1559.CalcBaseFee(&config, &types.Header{
+				Number:   new(big.Int).SetUint64(prev.Number),
+				GasLimit: prev.GasLimit,
+				GasUsed:  prev.GasUsed,
+				BaseFee:  prev.BaseFee,
+			})
+		} else if baseFee == nil {
+			baseFee = cfg.BaseFeeOverride
+		}
+		var (
+			usedGas uint64
+			err     error
+		)
+		statedb, _, _, usedGas, err = p.ProcessWithConfig(block, statedb, cfg)
+		if err != nil {
+			return drift, fmt.Errorf("failed to replay block %d: %w", block.NumberU64(), err)
+		}
+		drift = append(drift, BaseFeeDrift{
+			Number:   block.NumberU64(),
+			GasUsed:  usedGas,
+			GasLimit: block.GasLimit(),
+			BaseFee:  new(big.Int).Set(baseFee),
+		})
+	}
+	return drift, nil
+}
@@ -105,7 +105,7 @@ func (b *BlockGen) SetParentBeaconRoot(root common.Hash) {
 		blockContext = NewEVMBlockContext(b.header, b.cm, &b.header.Coinbase)
 		vmenv        = vm.NewEVM(blockContext, vm.TxContext{}, b.statedb, b.cm.config, vm.Config{})
 	)
-	ProcessBeaconBlockRoot(root, vmenv, b.statedb)
+	ProcessBeaconBlockRootWithGas(root, BeaconRootGas(b.header), vmenv, b.statedb)
 }
 
 // addTx adds a transaction to the generated block. If no coinbase has
@@ -362,6 +362,13 @@ func GenerateChain(config *params.ChainConfig, parent *types.Block, engine conse
 		if !config.IsFeynman(b.header.Number, b.header.Time) {
 			systemcontracts.UpgradeBuildInSystemContract(config, b.header.Number, parent.Time(), b.header.Time, statedb)
 		}
+		if config.IsPrague(b.header.Number, b.header.Time) {
+			var (
+				blockContext = NewEVMBlockContext(b.header, cm, &b.header.Coinbase)
+				vmenv        = vm.NewEVM(blockContext, vm.TxContext{}, statedb, cm.config, vm.Config{})
+			)
+			ProcessParentBlockHash(b.header.ParentHash, vmenv, statedb)
+		}
 
 		// Execute any user modifications to the block
 		if gen != nil {
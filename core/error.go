@@ -42,6 +42,54 @@ var (
 
 	// ErrKnownBadBlock is return when the block is a known bad block
 	ErrKnownBadBlock = errors.New("already known bad block")
+
+	// ErrNonDeterministicProcessing is returned by the determinism self-check if
+	// processing the same block twice yields different results.
+	ErrNonDeterministicProcessing = errors.New("non-deterministic block processing")
+
+	// ErrStorageGrowthLimit is returned during block processing if the transactions
+	// populate more new storage slots than allowed.
+	ErrStorageGrowthLimit = errors.New("storage growth limit exceeded")
+
+	// ErrBundleReverted is returned by ProcessBundle if the execution of one of
+	// the transactions in a bundle failed.
+	ErrBundleReverted = errors.New("bundle transaction reverted")
+
+	// ErrFailureRateExceeded is returned during block processing if more of the
+	// transactions failed than the configured failure rate allows.
+	ErrFailureRateExceeded = errors.New("transaction failure rate exceeded")
+
+	// ErrReceiptBlockMismatch is returned when a receipt is paired with a block
+	// it does not belong to.
+	ErrReceiptBlockMismatch = errors.New("receipt does not belong to block")
+
+	// ErrLogContextMismatch is returned by strict block processing if a receipt
+	// log does not reference the processed block.
+	ErrLogContextMismatch = errors.New("log does not reference processed block")
+
+	// ErrInvalidPreAppliedTx is returned during block processing if the receipt of
+	// a pre-applied transaction can not be reused, as it does not follow
+	// the receipts before it or the transaction does not precede all executed ones.
+	ErrInvalidPreAppliedTx = errors.New("invalid pre-applied transaction")
+
+	// ErrTxAfterSystemTx is returned during block processing if a PoSA block after
+	// Cancun, or on any fork with ProcessConfig.StrictSystemTxOrder, has a normal
+	// transaction following a system transaction.
+	ErrTxAfterSystemTx = errors.New("normal tx after systemTx")
+
+	// ErrBlockGasExhausted is returned during block processing if a transaction
+	// can not be applied as the gas pool of the block is drained. It wraps the
+	// ErrGasLimitReached of the pool, so builders can stop packing transactions.
+	ErrBlockGasExhausted = errors.New("block gas exhausted")
+
+	// ErrMissingParent is returned during block processing if the parent of the
+	// block is not available in the chain, e.g. as the local chain is behind.
+	ErrMissingParent = errors.New("could not get parent block")
+
+	// ErrTargetNotAllowed is returned during block processing if a non-system
+	// transaction calls a contract, or creates one, not permitted by the
+	// configured allowlist.
+	ErrTargetNotAllowed = errors.New("transaction target not allowed")
 )
 
 // List of evm-call-message pre-checking errors. All state transition messages will
@@ -119,4 +167,12 @@ var (
 
 	// ErrBlobTxCreate is returned if a blob transaction has no explicit to field.
 	ErrBlobTxCreate = errors.New("blob transaction of type create")
+
+	// ErrGasPriceBelowMinimum is returned during block processing if the effective
+	// gas price of a non-system transaction is below the configured floor.
+	ErrGasPriceBelowMinimum = errors.New("gas price below minimum")
+
+	// ErrGasLimitBelowMinimum is returned during block processing if the gas limit
+	// of a non-system transaction is below the configured floor.
+	ErrGasLimitBelowMinimum = errors.New("gas limit below minimum")
 )
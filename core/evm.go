@@ -17,6 +17,7 @@
 package core
 
 import (
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -76,6 +77,20 @@ func NewEVMBlockContext(header *types.Header, chain ChainContext, author *common
 	}
 }
 
+// BlockContextFromReceipt recreates the block context the transaction of receipt
+// was executed with by the StateProcessor, for replaying it in isolation. The
+// receipt must have been derived for block.
+func BlockContextFromReceipt(receipt *types.Receipt, block *types.Block, chain ChainContext) (vm.BlockContext, error) {
+	if receipt.BlockHash != block.Hash() || receipt.BlockNumber == nil || receipt.BlockNumber.Cmp(block.Number()) != 0 {
+		return vm.BlockContext{}, fmt.Errorf("%w: receipt of block %v [%x], have block %v [%x]",
+			ErrReceiptBlockMismatch, receipt.BlockNumber, receipt.BlockHash, block.Number(), block.Hash())
+	}
+	if int(receipt.TransactionIndex) >= len(block.Transactions()) || block.Transactions()[receipt.TransactionIndex].Hash() != receipt.TxHash {
+		return vm.BlockContext{}, fmt.Errorf("%w: tx %x not at index %d", ErrReceiptBlockMismatch, receipt.TxHash, receipt.TransactionIndex)
+	}
+	return NewEVMBlockContext(block.Header(), chain, nil), nil
+}
+
 // NewEVMTxContext creates a new transaction context for a single transaction.
 func NewEVMTxContext(msg *Message) vm.TxContext {
 	ctx := vm.TxContext{
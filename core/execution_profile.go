@@ -0,0 +1,50 @@
+package core
+
+import (
+	"io"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/google/pprof/profile"
+)
+
+// WriteExecutionProfile writes the given opcode samples to w as a gzipped pprof
+// profile. Every sample is attributed to a stack made of the executed opcode on
+// top of the contracts of its call frames, so that standard tooling can render
+// contract-level flame graphs. The profile has two sample values: the number of
+// executions and the time spent in nanoseconds.
+func WriteExecutionProfile(w io.Writer, samples []vm.OpcodeSample) error {
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "executions", Unit: "count"},
+			{Type: "time", Unit: "nanoseconds"},
+		},
+	}
+	locations := make(map[string]*profile.Location)
+	location := func(name string) *profile.Location {
+		if loc, ok := locations[name]; ok {
+			return loc
+		}
+		fn := &profile.Function{ID: uint64(len(prof.Function) + 1), Name: name, SystemName: name}
+		loc := &profile.Location{ID: uint64(len(prof.Location) + 1), Line: []profile.Line{{Function: fn}}}
+		prof.Function = append(prof.Function, fn)
+		prof.Location = append(prof.Location, loc)
+		locations[name] = loc
+		return loc
+	}
+	for _, sample := range samples {
+		// Locations are ordered leaf first
+		stack := []*profile.Location{location(sample.Op.String())}
+		for i := len(sample.Stack) - 1; i >= 0; i-- {
+			stack = append(stack, location(sample.Stack[i].Hex()))
+		}
+		prof.Sample = append(prof.Sample, &profile.Sample{
+			Location: stack,
+			Value:    []int64{int64(sample.Count), sample.Time.Nanoseconds()},
+		})
+	}
+	sort.SliceStable(prof.Sample, func(i, j int) bool {
+		return prof.Sample[i].Value[1] > prof.Sample[j].Value[1]
+	})
+	return prof.Write(w)
+}
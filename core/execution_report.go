@@ -0,0 +1,63 @@
+package core
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// TxReport is the compact execution summary of a single transaction. A block's
+// report is the RLP encoding of the list of its TxReports in receipt order, i.e.
+// rlp([[gasUsed, status, logCount], ...]).
+type TxReport struct {
+	GasUsed  uint64
+	Status   uint64
+	LogCount uint64
+}
+
+// EncodeExecutionReport encodes the compact execution report of a block with the
+// given receipts.
+func EncodeExecutionReport(receipts types.Receipts) ([]byte, error) {
+	report := make([]TxReport, len(receipts))
+	for i, receipt := range receipts {
+		report[i] = TxReport{
+			GasUsed:  receipt.GasUsed,
+			Status:   receipt.Status,
+			LogCount: uint64(len(receipt.Logs)),
+		}
+	}
+	return rlp.EncodeToBytes(report)
+}
+
+// DecodeExecutionReport decodes a compact execution report produced by
+// EncodeExecutionReport.
+func DecodeExecutionReport(data []byte) ([]TxReport, error) {
+	var report []TxReport
+	if err := rlp.DecodeBytes(data, &report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ExecutionFingerprint returns a digest of the outcome of executing txs, in
+// execution order, into the given receipts using usedGas. It is the keccak256
+// hash of rlp([txHashes, receiptsRoot, logsBloom, usedGas]), allowing nodes to
+// cheaply compare their execution of a block without exchanging any state.
+func ExecutionFingerprint(txs types.Transactions, receipts types.Receipts, usedGas uint64) (common.Hash, error) {
+	hashes := make([]common.Hash, len(txs))
+	for i, tx := range txs {
+		hashes[i] = tx.Hash()
+	}
+	enc, err := rlp.EncodeToBytes([]interface{}{
+		hashes,
+		types.DeriveSha(receipts, trie.NewStackTrie(nil)),
+		types.CreateBloom(receipts),
+		usedGas,
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(enc), nil
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// WasmCodePrefix marks the code of contracts to be executed by the WASM executor
+// of the StateProcessor rather than the EVM. It is the magic number of WASM
+// modules, which starts with STOP and thus never executes meaningfully as EVM
+// bytecode.
+var WasmCodePrefix = []byte{0x00, 0x61, 0x73, 0x6d}
+
+// Executor applies messages to the state, like ApplyMessage does on the EVM.
+type Executor interface {
+	// Apply applies msg in the environment of evm, whose state and transaction
+	// context are set up for it, and returns the result like ApplyMessage. An
+	// error means the message is invalid and the block is rejected.
+	Apply(evm *vm.EVM, msg *Message, gp *GasPool) (*ExecutionResult, error)
+}
+
+// EVMExecutor is the default Executor, applying messages on the EVM.
+type EVMExecutor struct{}
+
+// Apply implements Executor.
+func (EVMExecutor) Apply(evm *vm.EVM, msg *Message, gp *GasPool) (*ExecutionResult, error) {
+	return ApplyMessage(evm, msg, gp)
+}
+
+// executor returns the Executor to apply msg with, which is WasmExecutor if set
+// and msg calls a contract with WASM code, and the EVM otherwise.
+func (p *StateProcessor) executor(msg *Message, statedb *state.StateDB) Executor {
+	if p.WasmExecutor != nil && msg.To != nil && bytes.HasPrefix(statedb.GetCode(*msg.To), WasmCodePrefix) {
+		return p.WasmExecutor
+	}
+	return EVMExecutor{}
+}
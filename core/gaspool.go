@@ -54,6 +54,18 @@ func (gp *GasPool) SetGas(gas uint64) {
 	*(*uint64)(gp) = gas
 }
 
+// Snapshot returns a checkpoint of the gas available in the pool, which can be
+// restored with Revert.
+func (gp *GasPool) Snapshot() uint64 {
+	return uint64(*gp)
+}
+
+// Revert restores the gas available in the pool to a checkpoint taken with
+// Snapshot.
+func (gp *GasPool) Revert(snapshot uint64) {
+	*(*uint64)(gp) = snapshot
+}
+
 func (gp *GasPool) String() string {
 	return fmt.Sprintf("%d", *gp)
 }
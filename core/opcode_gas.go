@@ -0,0 +1,118 @@
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// opcodeGasLogger is a vm.EVMLogger aggregating the gas consumed per opcode,
+// forwarding all events to an optional inner logger.
+//
+// The gas of an opcode is the drop of the gas available to its frame until the
+// next opcode, or the end of the frame. Call and create opcodes are accounted
+// the gas consumed by the code of their callees only once, on the opcodes of the
+// callees, while the gas of precompiles is left with the calling opcode.
+type opcodeGasLogger struct {
+	inner  vm.EVMLogger
+	gas    map[vm.OpCode]uint64
+	frames []opcodeGasFrame
+}
+
+// opcodeGasFrame tracks the opcode last executed in a call frame.
+type opcodeGasFrame struct {
+	start   uint64    // Gas available at the start of the frame
+	op      vm.OpCode // Opcode last executed, if any
+	gas     uint64    // Gas available before executing op
+	callees uint64    // Gas consumed by the code of the callees of op
+	ran     bool      // Whether the frame executed any opcode
+}
+
+func newOpcodeGasLogger(inner vm.EVMLogger) *opcodeGasLogger {
+	return &opcodeGasLogger{inner: inner, gas: make(map[vm.OpCode]uint64)}
+}
+
+func (l *opcodeGasLogger) enter(gas uint64) {
+	l.frames = append(l.frames, opcodeGasFrame{start: gas})
+}
+
+func (l *opcodeGasLogger) exit(gasUsed uint64) {
+	if len(l.frames) == 0 {
+		return
+	}
+	frame := l.frames[len(l.frames)-1]
+	l.frames = l.frames[:len(l.frames)-1]
+
+	if frame.ran {
+		l.gas[frame.op] += frame.gas - (frame.start - gasUsed) - frame.callees
+		if len(l.frames) > 0 {
+			l.frames[len(l.frames)-1].callees += gasUsed
+		}
+	}
+}
+
+func (l *opcodeGasLogger) CaptureTxStart(gasLimit uint64) {
+	if l.inner != nil {
+		l.inner.CaptureTxStart(gasLimit)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureTxEnd(restGas uint64) {
+	if l.inner != nil {
+		l.inner.CaptureTxEnd(restGas)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureSystemTxEnd(intrinsicGas uint64) {
+	if l.inner != nil {
+		l.inner.CaptureSystemTxEnd(intrinsicGas)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	l.enter(gas)
+	if l.inner != nil {
+		l.inner.CaptureStart(env, from, to, create, input, gas, value)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	l.exit(gasUsed)
+	if l.inner != nil {
+		l.inner.CaptureEnd(output, gasUsed, err)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	l.enter(gas)
+	if l.inner != nil {
+		l.inner.CaptureEnter(typ, from, to, input, gas, value)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureExit(output []byte, gasUsed uint64, err error) {
+	l.exit(gasUsed)
+	if l.inner != nil {
+		l.inner.CaptureExit(output, gasUsed, err)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if len(l.frames) > 0 {
+		frame := &l.frames[len(l.frames)-1]
+		if frame.ran {
+			l.gas[frame.op] += frame.gas - gas - frame.callees
+		}
+		frame.op, frame.gas, frame.callees, frame.ran = op, gas, 0, true
+	}
+	if l.inner != nil {
+		l.inner.CaptureState(pc, op, gas, cost, scope, rData, depth, err)
+	}
+}
+
+func (l *opcodeGasLogger) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+	if l.inner != nil {
+		l.inner.CaptureFault(pc, op, gas, cost, scope, depth, err)
+	}
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"context"
+	"math/big"
+	"runtime"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// ParallelStateProcessor is a Processor executing the normal transactions of a
+// block speculatively in parallel, if ProcessConfig.ParallelExecution is enabled.
+//
+// Every transaction is first applied on its own copy of the state the block
+// starts from, recording the accounts and storage slots it accesses. The results
+// are then committed in block order: a transaction not touching anything changed
+// by the ones before it has its writes transplanted onto the state, any other is
+// discarded and executed again serially. The receipts and state root are thus
+// identical to the ones of the StateProcessor.
+//
+// Features inspecting the execution of every transaction, such as tracing, are
+// not supported speculatively and fall back to serial processing.
+type ParallelStateProcessor struct {
+	*StateProcessor
+}
+
+// NewParallelStateProcessor initialises a new ParallelStateProcessor.
+func NewParallelStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consensus.Engine) *ParallelStateProcessor {
+	processor := NewStateProcessor(config, bc, engine)
+	processor.speculative = true
+	return &ParallelStateProcessor{processor}
+}
+
+// speculationSupported reports whether cfg can be honoured by speculative
+// execution, i.e. none of its options depends on observing transactions being
+// executed on the shared state.
+func speculationSupported(cfg ProcessConfig) bool {
+	return cfg.Tracer == nil && !cfg.EnablePreimageRecording && !cfg.AuditSystemReads && !cfg.TrackStorageWrites &&
+		!cfg.PhaseTimings && !cfg.TrackTransientStorage && !cfg.ExportSlotHeatmap && !cfg.TrackRevertedTransfers &&
+		!cfg.TrackSelfdestructValue && cfg.ProfileOutput == nil && cfg.MaxInternalCalls == 0 && cfg.MaxBlockRefund == 0 &&
+		cfg.OnColdAccess == nil && !cfg.TrackPrecompileGas && !cfg.DetectStakingActivity && !cfg.FlagRedundantStorageWrites &&
+		cfg.StateHealer == nil && !cfg.TrackMaxDepth
+}
+
+// speculativeTx is the outcome of executing a transaction on its own copy of the
+// state.
+type speculativeTx struct {
+	state   *state.StateDB
+	tracker *state.AccessTracker
+	receipt *types.Receipt
+	result  *ExecutionResult
+	err     error
+}
+
+// speculation holds the speculative results of the normal transactions of a
+// block, indexed by their position, along with the changes committed so far.
+type speculation struct {
+	txs        []*speculativeTx
+	written    *state.AccessTracker // Changes of all transactions applied so far
+	reexecuted []int                // Indices of transactions executed again serially
+	commitment StateCommitment      // Commitment computing the pre-Byzantium receipt roots, nil for the trie root
+}
+
+// speculate executes the normal transactions of block in parallel, each on its
+// own copy of statedb, which is finalised beforehand.
+func (p *StateProcessor) speculate(ctx context.Context, block *types.Block, statedb *state.StateDB, signer types.Signer, blockCtx vm.BlockContext, cfg ProcessConfig) *speculation {
+	var (
+		header      = block.Header()
+		blockNumber = block.Number()
+		blockHash   = block.Hash()
+		txs         = block.Transactions()
+		msgs        = make([]*Message, len(txs))
+		spec        = &speculation{
+			txs:        make([]*speculativeTx, len(txs)),
+			written:    state.NewAccessTracker(),
+			commitment: cfg.StateCommitment,
+		}
+	)
+	posa, isPoSA := p.engine.(consensus.PoSA)
+
+	// Copying the state is not thread safe, so prepare all copies upfront. System
+	// transactions and ones not convertible to messages are left to the serial
+	// path, which also reports any error.
+	statedb.Finalise(true)
+	for i, tx := range txs {
+		if isPoSA {
+			if isSystemTx, err := posa.IsSystemTransaction(tx, header); err != nil || isSystemTx {
+				continue
+			}
+		}
+		msg, err := p.txToMessage(tx, signer, header.BaseFee)
+		if err != nil {
+			continue
+		}
+		msgs[i] = msg
+		spec.txs[i] = &speculativeTx{state: statedb.Copy(), tracker: state.NewAccessTracker()}
+	}
+
+	var (
+		next    = make(chan int)
+		wg      sync.WaitGroup
+		workers = runtime.NumCPU()
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() != nil {
+					continue
+				}
+				var (
+					tx      = txs[i]
+					st      = spec.txs[i]
+					usedGas uint64
+					gp      = new(GasPool).AddGas(block.GasLimit())
+					evm     = vm.NewEVM(blockCtx, vm.TxContext{}, st.state, p.config, cfg.Config)
+				)
+				st.state.SetTxContext(tx.Hash(), i)
+				st.state.SetAccessTracker(st.tracker)
+				st.receipt, st.result, st.err = applyTransaction(msgs[i], p.config, gp, st.state, blockNumber, blockHash, tx, &usedGas, evm, EVMExecutor{}, cfg.StateCommitment, nil, nil)
+				st.state.SetAccessTracker(nil)
+
+				vm.EVMInterpreterPool.Put(evm.Interpreter())
+				vm.EvmPool.Put(evm)
+			}
+		}()
+	}
+	for i := range txs {
+		if spec.txs[i] != nil {
+			next <- i
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	return spec
+}
+
+// apply applies the transaction at index i of the block to statedb like
+// applyTransaction does, committing its speculative result if it is still valid
+// and executing it again otherwise.
+func (s *speculation) apply(i int, msg *Message, config *params.ChainConfig, gp *GasPool, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, tx *types.Transaction, usedGas *uint64, evm *vm.EVM, inspect func(), timings *TxPhaseTimings, receiptProcessors ...ReceiptProcessor) (*types.Receipt, *ExecutionResult, error) {
+	st := s.txs[i]
+	if st != nil && st.err == nil && st.result != nil && gp.Gas() >= msg.GasLimit && !st.tracker.DependsOn(s.written) {
+		statedb.ApplyTrackedWrites(st.state, st.tracker)
+		for _, log := range st.receipt.Logs {
+			statedb.AddLog(log)
+		}
+		if err := gp.SubGas(st.result.UsedGas); err != nil {
+			return nil, nil, err
+		}
+		*usedGas += st.result.UsedGas
+		s.written.MergeWrites(st.tracker)
+
+		receipt := newReceipt(msg, statedb, blockNumber, blockHash, tx, *usedGas, nil, st.result, evm, receiptProcessors...)
+		return receipt, st.result, nil
+	}
+	if st != nil {
+		s.reexecuted = append(s.reexecuted, i)
+	}
+	tracker := state.NewAccessTracker()
+	statedb.SetAccessTracker(tracker)
+	receipt, result, err := applyTransaction(msg, config, gp, statedb, blockNumber, blockHash, tx, usedGas, evm, EVMExecutor{}, s.commitment, inspect, timings, receiptProcessors...)
+	statedb.SetAccessTracker(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.written.MergeWrites(tracker)
+	return receipt, result, nil
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// ProcessRun is the outcome of processing a block under one configuration.
+type ProcessRun struct {
+	Root         common.Hash // State root after processing the block
+	ReceiptsRoot common.Hash
+	GasUsed      uint64
+	Receipts     types.Receipts
+	Logs         []*types.Log
+}
+
+// ProcessComparison is the difference between processing a block under two
+// configurations, A and B.
+type ProcessComparison struct {
+	A, B ProcessRun
+
+	// ReceiptDiffs and LogDiffs are the positions at which the consensus encodings
+	// of the receipts and logs of the two runs differ, including the ones only
+	// present in one of the runs.
+	ReceiptDiffs []int
+	LogDiffs     []int
+}
+
+// Equal reports whether both runs reached the same consensus outcome.
+func (c *ProcessComparison) Equal() bool {
+	return c.A.Root == c.B.Root && c.A.ReceiptsRoot == c.B.ReceiptsRoot && c.A.GasUsed == c.B.GasUsed &&
+		len(c.ReceiptDiffs) == 0 && len(c.LogDiffs) == 0
+}
+
+// CompareProcess processes block under both cfgA and cfgB, each on its own copy
+// of statedb, and returns the differences of the outcomes, e.g. to check that a
+// change does not alter consensus on historical blocks. The passed statedb is
+// not modified.
+func (p *StateProcessor) CompareProcess(block *types.Block, statedb *state.StateDB, cfgA, cfgB ProcessConfig) (*ProcessComparison, error) {
+	a, err := p.processRun(block, statedb.Copy(), cfgA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process with config A: %w", err)
+	}
+	b, err := p.processRun(block, statedb.Copy(), cfgB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process with config B: %w", err)
+	}
+	comparison := &ProcessComparison{A: a, B: b}
+	for i := 0; i < len(a.Receipts) || i < len(b.Receipts); i++ {
+		if i >= len(a.Receipts) || i >= len(b.Receipts) {
+			comparison.ReceiptDiffs = append(comparison.ReceiptDiffs, i)
+			continue
+		}
+		encA, err := a.Receipts[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		encB, err := b.Receipts[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(encA, encB) {
+			comparison.ReceiptDiffs = append(comparison.ReceiptDiffs, i)
+		}
+	}
+	for i := 0; i < len(a.Logs) || i < len(b.Logs); i++ {
+		if i >= len(a.Logs) || i >= len(b.Logs) {
+			comparison.LogDiffs = append(comparison.LogDiffs, i)
+			continue
+		}
+		encA, err := rlp.EncodeToBytes(a.Logs[i])
+		if err != nil {
+			return nil, err
+		}
+		encB, err := rlp.EncodeToBytes(b.Logs[i])
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(encA, encB) {
+			comparison.LogDiffs = append(comparison.LogDiffs, i)
+		}
+	}
+	return comparison, nil
+}
+
+func (p *StateProcessor) processRun(block *types.Block, statedb *state.StateDB, cfg ProcessConfig) (ProcessRun, error) {
+	statedb, receipts, logs, usedGas, err := p.ProcessWithConfig(block, statedb, cfg)
+	if err != nil {
+		return ProcessRun{}, err
+	}
+	return ProcessRun{
+		Root:         statedb.IntermediateRoot(p.config.IsEIP158(block.Number())),
+		ReceiptsRoot: types.DeriveSha(receipts, trie.NewStackTrie(nil)),
+		GasUsed:      usedGas,
+		Receipts:     receipts,
+		Logs:         logs,
+	}, nil
+}
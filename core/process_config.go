@@ -0,0 +1,127 @@
+package core
+
+import (
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// StateCommitment computes the commitment to a state, replacing the root hash of
+// the Merkle-Patricia trie, e.g. to experiment with alternative trie designs.
+type StateCommitment interface {
+	// Root returns the commitment to the finalised state of statedb.
+	Root(statedb vm.StateDB) common.Hash
+}
+
+// ProcessConfig are the configuration options of block processing. On top of the
+// ones of the EVM executing the transactions, it holds the policies and the
+// statistics the StateProcessor applies and gathers around their execution.
+type ProcessConfig struct {
+	vm.Config // Options of the EVM executing the transactions
+
+	StateCommitment StateCommitment // Computes the state roots in block processing instead of the Merkle-Patricia trie, breaking consensus (nil = trie root)
+	ProfileOutput   io.Writer       // Receives a pprof profile of the time spent per contract and opcode by the normal transactions of a processed block
+
+	MinGasPrice           *big.Int // Minimum effective gas price of non-system transactions in block processing (nil = no floor)
+	BaseFeeOverride       *big.Int // Replaces the base fee of processed blocks, breaking consensus (nil = header's base fee)
+	CaptureTxErrors       bool     // Collects the EVM error of every failed transaction into the block processing stats
+	EventSignatures       bool     // Counts the distinct event signatures (first log topics) emitted in the block
+	AuditSystemReads      bool     // Records the system contract storage slots read but not modified by normal transactions
+	PhaseTimings          bool     // Measures the wall-clock time of the individual phases of every normal transaction
+	GasGriefingRatio      uint64   // Flags normal transactions with a gas limit exceeding this multiple of the gas used (0 = disabled)
+	CompactReport         bool     // Produces an RLP encoded summary of the gas used, status and log count of every transaction
+	TrackStorageWrites    bool     // Identifies the normal transaction modifying the most storage slots in the block
+	FlagCallToEmptyCode   bool     // Flags normal transactions passing calldata to a target without code
+	ExportTrieDiff        bool     // Exports the RLP encoded state changes of the block, applicable without re-execution
+	SystemGasAccounting   bool     // Reports the gas of the system transactions applied during finalization and the resulting block total
+	CanonicalizeLogOutput bool     // Sorts the logs handed out alongside receipts by topic, leaving receipts and blooms untouched
+	RecordSenderNonces    bool     // Records the sender nonce of every normal transaction before and after its execution
+	StrictLogContext      bool     // Fails block processing if a receipt log does not carry the hash and number of the processed block
+	SuggestGasForFailures bool     // Re-simulates normal transactions failing out of gas to find the lowest gas limit they succeed with
+	ExecutionFingerprint  bool     // Computes a digest of the transactions, receipts, bloom and gas used of the block, see ExecutionFingerprint
+	TxDurations           bool     // Measures the time spent applying every transaction, system ones included, and finalizing the block
+	TrackAccountChurn     bool     // Counts the accounts created and destroyed by the block
+	ParallelExecution     bool     // Executes independent transactions speculatively in parallel, see ParallelStateProcessor
+	RecordInputHashes     bool     // Records the keccak256 hash of the input data of every normal transaction, to cluster identical calls
+	CaptureFinalStorage   bool     // Captures the values of the storage slots modified by the block after finalizing it
+	DetectStakingActivity bool     // Flags the transactions interacting with the validator set and staking system contracts
+	FlagPrecompileTargets bool     // Flags normal transactions sent directly to a precompiled contract
+	TopLevelCallGas       bool     // Records the gas consumed by the top-level call of every normal transaction, excluding intrinsic gas
+	OpcodeGas             bool     // Aggregates the gas consumed per opcode by the normal transactions of a block, wrapping Tracer
+	CountUniqueContracts  bool     // Counts the distinct contracts called directly by the normal transactions of the block
+	CountTxTypes          bool     // Counts the transactions of the block by their EIP-2718 type
+	TrackCoinbaseDelta    bool     // Measures the balance change of the coinbase from the first transaction until finalization
+	RecordGasCurve        bool     // Records the cumulative gas used after every transaction of the block
+
+	MaxNewSlotsPerBlock int     // Maximum number of storage slots normal transactions may newly populate in a block (0 = unlimited)
+	LogCountThreshold   int     // Flags normal transactions emitting more logs than this (0 = disabled)
+	MaxBlockRefund      uint64  // Caps the total gas refunded to the normal transactions of a block, breaking consensus (0 = unlimited)
+	MaxFailureRate      float64 // Aborts block processing once more than this fraction of the transactions failed, breaking consensus (0 = disabled)
+	MinTxGasLimit       uint64  // Minimum gas limit of non-system transactions in block processing (0 = no floor)
+
+	OnEffectiveGasPrice func(txIndex int, price *big.Int)                            // Invoked with the effective gas price of every applied normal transaction
+	DAOHandler          func(statedb vm.StateDB)                                     // Replaces the DAO hard-fork state transition (nil = default)
+	OnBeforeSystemTx    func(txIndex int, tx *types.Transaction, statedb vm.StateDB) // Invoked before every system transaction applied by the consensus engine, e.g. to inspect the validator set
+	StateHealer         func(hash common.Hash) ([]byte, error)                       // Retrieves trie nodes missing from the database, e.g. from a peer, see state.StateDB.SetNodeHealer
+
+	RandaoOverride *common.Hash // Replaces the PREVRANDAO value of processed blocks, making them post-merge to the EVM, breaking consensus (nil = header's)
+
+	AllowedTargets    map[common.Address]bool // Restricts the normal transactions to calls of the listed contracts and accounts without code, breaking consensus (nil = unrestricted)
+	AllowCreations    bool                    // Permits contract creation transactions if AllowedTargets is set
+	SkipDisallowedTxs bool                    // Skips the normal transactions violating AllowedTargets without a receipt instead of rejecting the block
+
+	// PreAppliedReceipts maps the hashes of transactions whose state changes are
+	// already contained in the processed state, e.g. persisted prior to a crash,
+	// to their receipts, which block processing reuses instead of executing them
+	// again. Only their gas and logs are accounted, their state changes are NOT
+	// applied. This is thus only sound if they are the leading normal transactions
+	// of the block, the processed state contains all their changes and the
+	// receipts were produced by executing them in this block, as apart from their
+	// cumulative gas used the receipts are taken as is.
+	PreAppliedReceipts map[common.Hash]*types.Receipt
+
+	DeterminismCheck    bool // Processes every block a second time on a copy of the state and fails on any difference
+	SkipZeroBeaconRoot  bool // Skips the EIP-4788 beacon root system call if the root is zero
+	SkipFinalize        bool // Skips finalizing processed blocks, leaving out system transactions and block rewards, e.g. for simulations
+	StrictSystemTxOrder bool // Rejects PoSA blocks with normal transactions after system ones on all forks, not only from Cancun on, e.g. on testnets
+}
+
+// outcomeConfig returns a copy of the config holding only the options which
+// influence the outcome of block processing, leaving out the hooks observing it,
+// tracers and the gathering of statistics. Callbacks changing the state, like
+// DAOHandler and StateHealer, are kept.
+func (c ProcessConfig) outcomeConfig() ProcessConfig {
+	return ProcessConfig{
+		Config: vm.Config{
+			NoBaseFee:           c.NoBaseFee,
+			NoRecursion:         c.NoRecursion,
+			ExtraEips:           c.ExtraEips,
+			OpcodeGasModel:      c.OpcodeGasModel,
+			OpcodeBehaviorFork:  c.OpcodeBehaviorFork,
+			MaxInternalCalls:    c.MaxInternalCalls,
+			ContractAddressFunc: c.ContractAddressFunc,
+		},
+		StateCommitment:       c.StateCommitment,
+		MinGasPrice:           c.MinGasPrice,
+		BaseFeeOverride:       c.BaseFeeOverride,
+		CanonicalizeLogOutput: c.CanonicalizeLogOutput,
+		StrictLogContext:      c.StrictLogContext,
+		MaxNewSlotsPerBlock:   c.MaxNewSlotsPerBlock,
+		MaxBlockRefund:        c.MaxBlockRefund,
+		MaxFailureRate:        c.MaxFailureRate,
+		MinTxGasLimit:         c.MinTxGasLimit,
+		StateHealer:           c.StateHealer,
+		RandaoOverride:        c.RandaoOverride,
+		AllowedTargets:        c.AllowedTargets,
+		AllowCreations:        c.AllowCreations,
+		SkipDisallowedTxs:     c.SkipDisallowedTxs,
+		PreAppliedReceipts:    c.PreAppliedReceipts,
+		SkipZeroBeaconRoot:    c.SkipZeroBeaconRoot,
+		SkipFinalize:          c.SkipFinalize,
+		StrictSystemTxOrder:   c.StrictSystemTxOrder,
+		DAOHandler:            c.DAOHandler,
+	}
+}
@@ -0,0 +1,469 @@
+package core
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/systemcontracts"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// ProcessStats contains non-consensus information gathered while processing a
+// block. Which fields get populated depends on the ProcessConfig the block was
+// processed with; none of them influence the outcome of the state transition.
+type ProcessStats struct {
+	// TxErrors maps the index of every normal transaction whose execution failed
+	// to the error returned by the EVM (e.g. vm.ErrOutOfGas). It is only set if
+	// ProcessConfig.CaptureTxErrors is enabled.
+	TxErrors map[int]error
+
+	// EventSignatures counts the logs emitted in the block by their event signature
+	// hash (the first topic). Anonymous logs without topics are not counted. It is
+	// only set if ProcessConfig.EventSignatures is enabled.
+	EventSignatures map[common.Hash]int
+
+	// SystemReads maps the index of every normal transaction that accessed the
+	// storage of a system contract without modifying it to the slots in question.
+	// It is only set if ProcessConfig.AuditSystemReads is enabled on a PoSA chain.
+	SystemReads map[int]types.AccessList
+
+	// PhaseTimings holds the time spent in the individual processing phases of
+	// every normal transaction, aligned with the receipts preceding the system
+	// transactions. It is only set if ProcessConfig.PhaseTimings is enabled.
+	PhaseTimings []TxPhaseTimings
+
+	// TxDurations holds the time spent applying every normal transaction, indexed
+	// by its position in the block. Transactions not executed, like the system
+	// ones, skipped or pre-applied transactions, have a zero duration. The
+	// conversion into a message, e.g. the sender recovery, is not included. It is
+	// only set if ProcessConfig.TxDurations is enabled.
+	TxDurations []time.Duration
+
+	// SystemTxDurations holds the time spent on every system transaction applied
+	// during finalization, in execution order. As the consensus engine applies
+	// them, each one is measured up to the start of the next one or the end of
+	// finalization. It is only set if ProcessConfig.TxDurations is enabled.
+	SystemTxDurations []time.Duration
+
+	// FinalizeDuration is the time spent finalizing the block, including the
+	// system transactions. It is only set if ProcessConfig.TxDurations is enabled.
+	FinalizeDuration time.Duration
+
+	// OverProvisioned lists the indices of the normal transactions whose gas limit
+	// exceeded ProcessConfig.GasGriefingRatio times the gas they actually used. It is
+	// only set if the ratio is configured.
+	OverProvisioned []int
+
+	// LogHeavyTxs maps the index of every normal transaction which emitted more
+	// logs than ProcessConfig.LogCountThreshold to its log count. It is only set if
+	// the threshold is configured.
+	LogHeavyTxs map[int]int
+
+	// EmptyCodeCalls lists the indices of the normal transactions which passed
+	// calldata to a target without code, e.g. an EOA or a self-destructed
+	// contract. It is only set if ProcessConfig.FlagCallToEmptyCode is enabled.
+	EmptyCodeCalls []int
+
+	// PrecompileTargets lists the indices of the normal transactions sent directly
+	// to a precompiled contract active in the block, which is rarely intended. It
+	// is only set if ProcessConfig.FlagPrecompileTargets is enabled.
+	PrecompileTargets []int
+
+	// DisallowedTxs lists the indices of the normal transactions skipped as their
+	// target is not permitted by ProcessConfig.AllowedTargets. It is only set if
+	// ProcessConfig.SkipDisallowedTxs is enabled.
+	DisallowedTxs []int
+
+	// LargestStorageWriter is the normal transaction which modified the most
+	// storage slots in the block, or nil if none did. It is only set if
+	// ProcessConfig.TrackStorageWrites is enabled.
+	LargestStorageWriter *StorageWriter
+
+	// CompactReport is the RLP encoded execution summary of all the transactions
+	// in the block, see EncodeExecutionReport. It is only set if
+	// ProcessConfig.CompactReport is enabled.
+	CompactReport []byte
+
+	// Fingerprint is the digest of the execution outcome of the block, including
+	// its system transactions, see ExecutionFingerprint. It is only set if
+	// ProcessConfig.ExecutionFingerprint is enabled.
+	Fingerprint common.Hash
+
+	// SenderNonces holds the sender and its nonce before and after execution of
+	// every normal transaction, aligned with the receipts preceding the system
+	// transactions. It is only set if ProcessConfig.RecordSenderNonces is enabled.
+	SenderNonces []SenderNonce
+
+	// TransientStorage maps the index of every normal transaction which executed
+	// EIP-1153 transient storage operations to their number per contract. It is
+	// only set if vm.Config.TrackTransientStorage is enabled.
+	TransientStorage map[int]map[common.Address]vm.TransientStorageUsage
+
+	// SlotHeatmap maps every storage slot accessed by the normal transactions of
+	// the block to its number of SLOAD and SSTORE operations, including the ones
+	// of reverted calls. It is only set if vm.Config.ExportSlotHeatmap is enabled.
+	SlotHeatmap map[vm.StorageSlot]int
+
+	// RedundantStorageWrites maps the index of every normal transaction issuing
+	// SSTOREs of the value a slot already holds, wasting gas, to the slots written,
+	// in execution order. It is only set if vm.Config.FlagRedundantStorageWrites
+	// is enabled.
+	RedundantStorageWrites map[int][]vm.StorageSlot
+
+	// SuggestedGas maps the index of every normal transaction which ran out of gas
+	// to the lowest gas limit it would have succeeded with, as found by executing
+	// it again on a copy of its pre-state. Transactions failing even with the block
+	// gas limit are left out. It is only set if ProcessConfig.SuggestGasForFailures is
+	// enabled.
+	SuggestedGas map[int]uint64
+
+	// InputHashes maps the index of every normal transaction to the keccak256 hash
+	// of its input data, allowing to cluster transactions with identical calldata.
+	// It is only set if ProcessConfig.RecordInputHashes is enabled.
+	InputHashes map[int]common.Hash
+
+	// PrecompileGas is the gas consumed by precompiled contracts in the normal
+	// transactions of the block, and ExecutionGas the remainder of the gas they
+	// used, including intrinsic gas and net of refunds. They are only set if
+	// vm.Config.TrackPrecompileGas is enabled.
+	PrecompileGas uint64
+	ExecutionGas  uint64
+
+	// TopLevelCallGas maps the index of every executed normal transaction to the
+	// gas consumed by its top-level call or contract creation before refunds,
+	// i.e. the gas used beyond the intrinsic gas. It is only set if
+	// ProcessConfig.TopLevelCallGas is enabled.
+	TopLevelCallGas map[int]uint64
+
+	// OpcodeGas is the gas consumed per opcode by the normal transactions of the
+	// block before refunds, with the gas of precompiles accounted to the calling
+	// opcode. In total, it is the gas used beyond the intrinsic gas. It is only
+	// set if ProcessConfig.OpcodeGas is enabled.
+	OpcodeGas map[vm.OpCode]uint64
+
+	// MaxDepth maps the index of every executed normal transaction to the deepest
+	// call depth at which it executed code, 1 being its top-level call and 0 no
+	// code executed at all. It is only set if vm.Config.TrackMaxDepth is enabled.
+	MaxDepth map[int]int
+
+	// RevertedTransfers maps the index of every normal transaction which had value
+	// transfers of calls or contract creations rolled back, including its own, to
+	// these transfers. It is only set if vm.Config.TrackRevertedTransfers is
+	// enabled.
+	RevertedTransfers map[int][]vm.ValueTransfer
+
+	// SelfdestructValue maps every beneficiary of a self-destruct executed by the
+	// normal transactions to the total value it received that way. Self-destructs
+	// in reverted calls and to the destructed contract itself are not counted.
+	// It is only set if vm.Config.TrackSelfdestructValue is enabled.
+	SelfdestructValue map[common.Address]*big.Int
+
+	// AccountsCreated and AccountsDestroyed are the number of accounts the block
+	// brought into existence and removed from the state, the latter either by a
+	// self-destruct or by being deleted as empty. They are only set if
+	// ProcessConfig.TrackAccountChurn is enabled.
+	AccountsCreated   int
+	AccountsDestroyed int
+
+	// FinalStorage maps every contract with storage modified by the block to the
+	// values of its changed slots after finalizing it, the last write winning.
+	// Slots written back to their original value are left out. It is only set if
+	// ProcessConfig.CaptureFinalStorage is enabled.
+	FinalStorage map[common.Address]map[common.Hash]common.Hash
+
+	// ReexecutedTxs are the indices of the transactions whose speculative result
+	// conflicted with an earlier transaction of the block, and which were hence
+	// executed again serially. It is only set if ProcessConfig.ParallelExecution is
+	// enabled on a ParallelStateProcessor.
+	ReexecutedTxs []int
+
+	// UniqueContracts is the number of distinct contracts called directly by the
+	// normal transactions of the block. Plain transfers to accounts without code
+	// and contract creations are not counted. It is only set if
+	// ProcessConfig.CountUniqueContracts is enabled.
+	UniqueContracts int
+
+	// TxTypes counts the transactions of the block, including the system ones, by
+	// their EIP-2718 type, e.g. types.LegacyTxType or types.BlobTxType. Types not
+	// present in the block are left out. It is only set if
+	// ProcessConfig.CountTxTypes is enabled.
+	TxTypes map[uint8]int
+
+	// SystemTxs are the transactions of the block the PoSA engine classified as
+	// system transactions, in block order. They are applied in Finalize rather than
+	// as normal transactions.
+	SystemTxs []*types.Transaction
+
+	// StakingTxs are the hashes of the transactions interacting with the validator
+	// set or staking contracts, normal ones first and in block order. Normal ones
+	// are detected by any access of a contract as recorded in their EIP-2930 access
+	// list, thus only since Berlin, system ones by their recipient. It is only set
+	// if ProcessConfig.DetectStakingActivity is enabled.
+	StakingTxs []common.Hash
+
+	// BlobGasUsed is the total blob gas used by the transactions of the block, to
+	// be validated against the one of the header.
+	BlobGasUsed uint64
+
+	// StateRoot is the commitment to the post-state of the block computed by
+	// ProcessConfig.StateCommitment. It is only set if a commitment is configured,
+	// the Merkle-Patricia root is left to block validation as usual.
+	StateRoot common.Hash
+
+	// TrieDiff is the RLP encoding of the state changes made by the block as a
+	// list of state.AccountDiff, see state.StateDB.ApplyTrieDiff. It is only
+	// set if ProcessConfig.ExportTrieDiff is enabled.
+	TrieDiff []byte
+
+	// SystemGasUsed is the gas consumed by the system transactions applied while
+	// finalizing the block, as reported by their receipts. It is only set if
+	// ProcessConfig.SystemGasAccounting is enabled.
+	SystemGasUsed uint64
+
+	// TotalGasUsed is the gas consumed by the normal transactions plus
+	// SystemGasUsed, regardless of whether the consensus engine accounts the
+	// latter in the block gas used. It is only set if
+	// ProcessConfig.SystemGasAccounting is enabled.
+	TotalGasUsed uint64
+
+	// CoinbaseDelta is the balance change of the block's coinbase between the
+	// start of transaction processing and the end of finalization, i.e. the tips
+	// and rewards earned. If the coinbase sent or received transactions in the
+	// block itself, their value and fees are included as well. It is only set if
+	// ProcessConfig.TrackCoinbaseDelta is enabled.
+	CoinbaseDelta *big.Int
+
+	// LogCount is the number of logs emitted by the block, including the ones of
+	// the system transactions.
+	LogCount int
+
+	// GasCurve is the cumulative gas used after every transaction of the block,
+	// including the system transactions, as in the receipts' CumulativeGasUsed.
+	// It is only set if ProcessConfig.RecordGasCurve is enabled.
+	GasCurve []uint64
+
+	// ForkBoundary reports whether any block or time based fork activates at
+	// exactly this block, i.e. is enabled for it but not for its parent. The
+	// merge transition is not considered, as it isn't tied to a block.
+	ForkBoundary bool
+
+	// ParentTime is the timestamp of the parent block, as used to decide on the
+	// time based upgrades of the built-in system contracts.
+	ParentTime uint64
+
+	// RefundRatio is the fraction of the gas used by the executed normal
+	// transactions before refunds which was refunded to their senders, capped by
+	// EIP-3529 at a fifth since London.
+	RefundRatio float64
+
+	// GasUtilization is the fraction of the block gas limit consumed by the block,
+	// including the gas used by system transactions applied during finalization.
+	GasUtilization float64
+}
+
+// TxPhaseTimings is the wall-clock time spent in the phases of processing a
+// single transaction.
+type TxPhaseTimings struct {
+	Sender    time.Duration // Conversion into a message, including the sender recovery if not cached
+	Execution time.Duration // EVM execution of the message
+	Finalise  time.Duration // Finalisation of the state changes (or intermediate root before Byzantium)
+	Receipt   time.Duration // Receipt creation and post-processing, e.g. bloom generation
+}
+
+// systemTxTimer measures the system transactions applied during finalization,
+// with every call to next ending the current measurement and starting a new one.
+type systemTxTimer struct {
+	start     time.Time
+	durations []time.Duration
+}
+
+func (t *systemTxTimer) next(common.Hash, int) {
+	t.stop()
+	t.start = time.Now()
+}
+
+func (t *systemTxTimer) stop() {
+	if !t.start.IsZero() {
+		t.durations = append(t.durations, time.Since(t.start))
+		t.start = time.Time{}
+	}
+}
+
+// StorageWriter describes the storage modifications of a transaction.
+type StorageWriter struct {
+	TxIndex   int                    // Index of the transaction in the block
+	Slots     int                    // Total number of storage slots modified
+	Contracts map[common.Address]int // Number of slots modified per contract
+}
+
+// SenderNonce is the nonce of a transaction sender around its execution.
+type SenderNonce struct {
+	Sender common.Address // Sender of the transaction
+	Before uint64         // Nonce of the sender prior to execution
+	After  uint64         // Nonce of the sender after execution
+}
+
+// newProcessStats creates the stats collector for a block processed with cfg.
+func newProcessStats(cfg ProcessConfig, txNum int) *ProcessStats {
+	stats := new(ProcessStats)
+	if cfg.CaptureTxErrors {
+		stats.TxErrors = make(map[int]error)
+	}
+	if cfg.EventSignatures {
+		stats.EventSignatures = make(map[common.Hash]int)
+	}
+	if cfg.AuditSystemReads {
+		stats.SystemReads = make(map[int]types.AccessList)
+	}
+	if cfg.PhaseTimings {
+		stats.PhaseTimings = make([]TxPhaseTimings, 0)
+	}
+	if cfg.LogCountThreshold > 0 {
+		stats.LogHeavyTxs = make(map[int]int)
+	}
+	if cfg.FlagCallToEmptyCode {
+		stats.EmptyCodeCalls = make([]int, 0)
+	}
+	if cfg.FlagPrecompileTargets {
+		stats.PrecompileTargets = make([]int, 0)
+	}
+	if cfg.SkipDisallowedTxs {
+		stats.DisallowedTxs = make([]int, 0)
+	}
+	if cfg.TxDurations {
+		stats.TxDurations = make([]time.Duration, txNum)
+		stats.SystemTxDurations = make([]time.Duration, 0)
+	}
+	if cfg.GasGriefingRatio > 0 {
+		stats.OverProvisioned = make([]int, 0)
+	}
+	if cfg.RecordSenderNonces {
+		stats.SenderNonces = make([]SenderNonce, 0)
+	}
+	if cfg.TrackRevertedTransfers {
+		stats.RevertedTransfers = make(map[int][]vm.ValueTransfer)
+	}
+	if cfg.TrackSelfdestructValue {
+		stats.SelfdestructValue = make(map[common.Address]*big.Int)
+	}
+	if cfg.TrackTransientStorage {
+		stats.TransientStorage = make(map[int]map[common.Address]vm.TransientStorageUsage)
+	}
+	if cfg.ExportSlotHeatmap {
+		stats.SlotHeatmap = make(map[vm.StorageSlot]int)
+	}
+	if cfg.FlagRedundantStorageWrites {
+		stats.RedundantStorageWrites = make(map[int][]vm.StorageSlot)
+	}
+	if cfg.RecordInputHashes {
+		stats.InputHashes = make(map[int]common.Hash)
+	}
+	if cfg.TopLevelCallGas {
+		stats.TopLevelCallGas = make(map[int]uint64)
+	}
+	if cfg.TrackMaxDepth {
+		stats.MaxDepth = make(map[int]int)
+	}
+	if cfg.DetectStakingActivity {
+		stats.StakingTxs = make([]common.Hash, 0)
+	}
+	if cfg.SuggestGasForFailures {
+		stats.SuggestedGas = make(map[int]uint64)
+	}
+	return stats
+}
+
+// trackStorageWrites records the storage writes of the transaction at index i if
+// it modified more slots than any transaction before it.
+func (s *ProcessStats) trackStorageWrites(i int, writes map[common.Address]int) {
+	var slots int
+	for _, n := range writes {
+		slots += n
+	}
+	if slots == 0 || (s.LargestStorageWriter != nil && s.LargestStorageWriter.Slots >= slots) {
+		return
+	}
+	s.LargestStorageWriter = &StorageWriter{TxIndex: i, Slots: slots, Contracts: writes}
+}
+
+// reconcileSystemGas records the gas used by the system transactions receipts
+// were produced for during finalization on top of the execution gas of the
+// normal transactions. The result is purely informational; the gas used that
+// is returned from processing and validated against the header is left as the
+// consensus engine accounted it.
+func (s *ProcessStats) reconcileSystemGas(executionGas uint64, receipts []*types.Receipt) {
+	for _, receipt := range receipts {
+		s.SystemGasUsed += receipt.GasUsed
+	}
+	s.TotalGasUsed = executionGas + s.SystemGasUsed
+}
+
+// isForkBoundary reports whether the rules in effect for header differ from the
+// ones of its parent.
+func isForkBoundary(config *params.ChainConfig, parent, header *types.Header) bool {
+	prev := config.Rules(parent.Number, false, parent.Time)
+	rules := config.Rules(header.Number, false, header.Time)
+	prev.ChainID = rules.ChainID
+	return prev != rules
+}
+
+// overProvisioned reports whether a transaction with the given gas limit used
+// less than 1/ratio of it.
+func overProvisioned(gasLimit, usedGas, ratio uint64) bool {
+	bound, overflow := math.SafeMul(usedGas, ratio)
+	return !overflow && gasLimit > bound
+}
+
+// stakingContracts are the system contracts managing the validator set and the
+// stakes, for ProcessConfig.DetectStakingActivity.
+var stakingContracts = map[common.Address]struct{}{
+	common.HexToAddress(systemcontracts.ValidatorContract): {},
+	common.HexToAddress(systemcontracts.StakingContract):   {},
+	common.HexToAddress(systemcontracts.StakeHubContract):  {},
+}
+
+// isStakingContract reports whether addr is one of the stakingContracts.
+func isStakingContract(addr common.Address) bool {
+	_, ok := stakingContracts[addr]
+	return ok
+}
+
+// accessesStakingContracts reports whether the access list of a transaction
+// contains any of the stakingContracts.
+func accessesStakingContracts(accessList types.AccessList) bool {
+	for _, tuple := range accessList {
+		if isStakingContract(tuple.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// systemReads inspects the access list of the transaction just executed on
+// statedb and returns the storage slots of system contracts which were accessed
+// but are left unchanged. It must be called before the state is finalised, as
+// the comparison relies on the committed values as of the transaction start.
+func systemReads(statedb *state.StateDB, posa consensus.PoSA) types.AccessList {
+	var reads types.AccessList
+	for _, tuple := range statedb.AccessList() {
+		if !posa.IsSystemContract(&tuple.Address) {
+			continue
+		}
+		var slots []common.Hash
+		for _, slot := range tuple.StorageKeys {
+			if statedb.GetState(tuple.Address, slot) == statedb.GetCommittedState(tuple.Address, slot) {
+				slots = append(slots, slot)
+			}
+		}
+		if len(slots) > 0 {
+			reads = append(reads, types.AccessTuple{Address: tuple.Address, StorageKeys: slots})
+		}
+	}
+	return reads
+}
@@ -11,9 +11,17 @@ type ReceiptProcessor interface {
 	Apply(receipt *types.Receipt)
 }
 
+// bloomGenerator is a ReceiptProcessor creating the blooms of the receipts of a
+// block, which is stopped once the block is processed.
+type bloomGenerator interface {
+	ReceiptProcessor
+	Close()
+	Cancel()
+}
+
 var (
-	_ ReceiptProcessor = (*ReceiptBloomGenerator)(nil)
-	_ ReceiptProcessor = (*AsyncReceiptBloomGenerator)(nil)
+	_ bloomGenerator = (*ReceiptBloomGenerator)(nil)
+	_ bloomGenerator = (*AsyncReceiptBloomGenerator)(nil)
 )
 
 func NewReceiptBloomGenerator() *ReceiptBloomGenerator {
@@ -27,9 +35,16 @@ func (p *ReceiptBloomGenerator) Apply(receipt *types.Receipt) {
 	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
 }
 
+// Close is a no-op, as the blooms are created synchronously.
+func (p *ReceiptBloomGenerator) Close() {}
+
+// Cancel is a no-op, as the blooms are created synchronously.
+func (p *ReceiptBloomGenerator) Cancel() {}
+
 func NewAsyncReceiptBloomGenerator(txNums int) *AsyncReceiptBloomGenerator {
 	generator := &AsyncReceiptBloomGenerator{
 		receipts: make(chan *types.Receipt, txNums),
+		quit:     make(chan struct{}),
 	}
 	generator.startWorker()
 	return generator
@@ -37,8 +52,12 @@ func NewAsyncReceiptBloomGenerator(txNums int) *AsyncReceiptBloomGenerator {
 
 type AsyncReceiptBloomGenerator struct {
 	receipts chan *types.Receipt
+	quit     chan struct{}
 	wg       sync.WaitGroup
 	isClosed bool
+
+	closeOnce  sync.Once // Guards closing receipts, as Cancel and Close may both be called
+	cancelOnce sync.Once // Guards closing quit, as Cancel may be called repeatedly
 }
 
 func (p *AsyncReceiptBloomGenerator) startWorker() {
@@ -46,6 +65,11 @@ func (p *AsyncReceiptBloomGenerator) startWorker() {
 	go func() {
 		defer p.wg.Done()
 		for receipt := range p.receipts {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
 			if receipt != nil && bytes.Equal(receipt.Bloom[:], types.EmptyBloom[:]) {
 				receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
 			}
@@ -59,8 +83,21 @@ func (p *AsyncReceiptBloomGenerator) Apply(receipt *types.Receipt) {
 	}
 }
 
+// Close stops the generator once the pending blooms are created. It is safe to
+// call it repeatedly and after Cancel.
 func (p *AsyncReceiptBloomGenerator) Close() {
-	close(p.receipts)
-	p.isClosed = true
+	p.closeOnce.Do(func() {
+		close(p.receipts)
+		p.isClosed = true
+	})
 	p.wg.Wait()
 }
+
+// Cancel stops the generator like Close, but aborts the generation of the blooms
+// still pending instead of waiting for them. It is meant for the error paths of
+// block processing, where the receipts are discarded anyway. It is safe to call
+// it repeatedly and after Close.
+func (p *AsyncReceiptBloomGenerator) Cancel() {
+	p.cancelOnce.Do(func() { close(p.quit) })
+	p.Close()
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestAsyncReceiptBloomGeneratorCancel(t *testing.T) {
+	// Queue up enough bloom work to keep the worker busy for a while
+	receipts := make([]*types.Receipt, 1000)
+	for i := range receipts {
+		logs := make([]*types.Log, 100)
+		for j := range logs {
+			logs[j] = &types.Log{Address: common.Address{byte(j)}, Topics: []common.Hash{{byte(i)}, {byte(j)}}}
+		}
+		receipts[i] = &types.Receipt{Logs: logs}
+	}
+	generator := NewAsyncReceiptBloomGenerator(len(receipts))
+	for _, receipt := range receipts {
+		generator.Apply(receipt)
+	}
+	done := make(chan struct{})
+	go func() {
+		generator.Cancel()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("bloom generator did not stop after cancellation")
+	}
+	// The worker must have given up on the tail of the queue
+	if last := receipts[len(receipts)-1]; !bytes.Equal(last.Bloom[:], types.EmptyBloom[:]) {
+		t.Error("pending bloom generated despite cancellation")
+	}
+	// Further receipts are ignored rather than blocking or panicking
+	generator.Apply(&types.Receipt{})
+}
+
+func TestAsyncReceiptBloomGeneratorStopTwice(t *testing.T) {
+	for _, stops := range [][]string{
+		{"cancel", "cancel"},
+		{"close", "cancel"},
+		{"cancel", "close"},
+		{"close", "close"},
+	} {
+		generator := NewAsyncReceiptBloomGenerator(1)
+		generator.Apply(&types.Receipt{})
+		for _, stop := range stops {
+			if stop == "cancel" {
+				generator.Cancel()
+			} else {
+				generator.Close()
+			}
+		}
+	}
+}
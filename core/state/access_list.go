@@ -17,7 +17,11 @@
 package state
 
 import (
+	"bytes"
+	"sort"
+
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 type accessList struct {
@@ -71,6 +75,27 @@ func (a *accessList) Copy() *accessList {
 	return cp
 }
 
+// Export returns the content of the access list, sorted by address and slot.
+func (al *accessList) Export() types.AccessList {
+	list := make(types.AccessList, 0, len(al.addresses))
+	for addr, idx := range al.addresses {
+		tuple := types.AccessTuple{Address: addr, StorageKeys: []common.Hash{}}
+		if idx >= 0 {
+			for slot := range al.slots[idx] {
+				tuple.StorageKeys = append(tuple.StorageKeys, slot)
+			}
+			sort.Slice(tuple.StorageKeys, func(i, j int) bool {
+				return bytes.Compare(tuple.StorageKeys[i][:], tuple.StorageKeys[j][:]) < 0
+			})
+		}
+		list = append(list, tuple)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].Address[:], list[j].Address[:]) < 0
+	})
+	return list
+}
+
 // AddAddress adds an address to the access list, and returns 'true' if the operation
 // caused a change (addr was not previously in the list).
 func (al *accessList) AddAddress(address common.Address) bool {
@@ -0,0 +1,195 @@
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// AccessTracker records the accounts and storage slots read and written through
+// a StateDB, so that the outcome of a transaction executed speculatively on one
+// state can be validated against, and transplanted onto, another one.
+//
+// Balance increments of accounts that are otherwise neither read nor written,
+// e.g. the fee recipient or the recipient of a plain transfer, are recorded as
+// amounts, as they commute with the changes of other transactions.
+type AccessTracker struct {
+	reads      map[common.Address]struct{}                 // Accounts with fields read
+	readSlots  map[common.Address]map[common.Hash]struct{} // Storage slots read
+	writes     map[common.Address]struct{}                 // Accounts with fields overwritten
+	writeSlots map[common.Address]map[common.Hash]struct{} // Storage slots written
+	code       map[common.Address]struct{}                 // Accounts with code deployed
+	resets     map[common.Address]struct{}                 // Accounts created or self-destructed, resetting their storage
+	adds       map[common.Address]*uint256.Int             // Total balance increments per account
+}
+
+// NewAccessTracker creates an empty access tracker.
+func NewAccessTracker() *AccessTracker {
+	return &AccessTracker{
+		reads:      make(map[common.Address]struct{}),
+		readSlots:  make(map[common.Address]map[common.Hash]struct{}),
+		writes:     make(map[common.Address]struct{}),
+		writeSlots: make(map[common.Address]map[common.Hash]struct{}),
+		code:       make(map[common.Address]struct{}),
+		resets:     make(map[common.Address]struct{}),
+		adds:       make(map[common.Address]*uint256.Int),
+	}
+}
+
+func (t *AccessTracker) readAccount(addr common.Address) {
+	t.reads[addr] = struct{}{}
+}
+
+func (t *AccessTracker) writeAccount(addr common.Address) {
+	t.writes[addr] = struct{}{}
+}
+
+func (t *AccessTracker) resetAccount(addr common.Address) {
+	t.resets[addr] = struct{}{}
+}
+
+func (t *AccessTracker) addBalance(addr common.Address, amount *uint256.Int) {
+	if sum, ok := t.adds[addr]; ok {
+		sum.Add(sum, amount)
+	} else {
+		t.adds[addr] = new(uint256.Int).Set(amount)
+	}
+}
+
+func (t *AccessTracker) readSlot(addr common.Address, slot common.Hash) {
+	addSlot(t.readSlots, addr, slot)
+}
+
+func (t *AccessTracker) writeSlot(addr common.Address, slot common.Hash) {
+	addSlot(t.writeSlots, addr, slot)
+}
+
+func addSlot(slots map[common.Address]map[common.Hash]struct{}, addr common.Address, slot common.Hash) {
+	if slots[addr] == nil {
+		slots[addr] = make(map[common.Hash]struct{})
+	}
+	slots[addr][slot] = struct{}{}
+}
+
+// blind reports whether the only access to addr was incrementing its balance.
+func (t *AccessTracker) blind(addr common.Address) bool {
+	_, read := t.reads[addr]
+	_, written := t.writes[addr]
+	_, reset := t.resets[addr]
+	return !read && !written && !reset
+}
+
+// modified reports whether addr was written or reset, or its balance increased.
+func (t *AccessTracker) modified(addr common.Address) bool {
+	_, written := t.writes[addr]
+	_, reset := t.resets[addr]
+	_, added := t.adds[addr]
+	return written || reset || added
+}
+
+// DependsOn reports whether the accesses recorded by t may observe or overwrite
+// any of the changes recorded by prior, i.e. whether applying the writes of t
+// after the ones of prior could differ from executing the two in sequence.
+func (t *AccessTracker) DependsOn(prior *AccessTracker) bool {
+	for _, accounts := range []map[common.Address]struct{}{t.reads, t.writes, t.resets} {
+		for addr := range accounts {
+			if prior.modified(addr) {
+				return true
+			}
+		}
+	}
+	for _, slots := range []map[common.Address]map[common.Hash]struct{}{t.readSlots, t.writeSlots} {
+		for addr, keys := range slots {
+			if _, reset := prior.resets[addr]; reset {
+				return true
+			}
+			for key := range keys {
+				if _, ok := prior.writeSlots[addr][key]; ok {
+					return true
+				}
+			}
+		}
+	}
+	// Balance increments of t commute with any change of prior
+	return false
+}
+
+// MergeWrites adds the changes recorded by other to the ones of t.
+func (t *AccessTracker) MergeWrites(other *AccessTracker) {
+	for addr := range other.writes {
+		t.writes[addr] = struct{}{}
+	}
+	for addr, keys := range other.writeSlots {
+		for key := range keys {
+			t.writeSlot(addr, key)
+		}
+	}
+	for addr := range other.code {
+		t.code[addr] = struct{}{}
+	}
+	for addr := range other.resets {
+		t.resets[addr] = struct{}{}
+	}
+	for addr, amount := range other.adds {
+		t.addBalance(addr, amount)
+	}
+}
+
+// SetAccessTracker attaches t to the state, recording all subsequent accesses
+// until it is detached again by passing nil. Trackers are not copied.
+func (s *StateDB) SetAccessTracker(t *AccessTracker) {
+	s.tracker = t
+}
+
+// ApplyTrackedWrites transplants the changes recorded by t while executing on
+// src, a finalised copy of the state, onto s and finalises them. Overwritten
+// accounts and slots take their values in src, while balance increments are
+// added to the current balance in s.
+func (s *StateDB) ApplyTrackedWrites(src *StateDB, t *AccessTracker) {
+	// Accounts read and incremented can not be treated as blind increments
+	absolute := make(map[common.Address]struct{}, len(t.writes)+len(t.resets))
+	for _, accounts := range []map[common.Address]struct{}{t.writes, t.resets} {
+		for addr := range accounts {
+			absolute[addr] = struct{}{}
+		}
+	}
+	for addr := range t.adds {
+		if !t.blind(addr) {
+			absolute[addr] = struct{}{}
+		}
+	}
+	// Wipe reset and deleted accounts first, so that recreated ones start out
+	// with empty storage.
+	for addr := range absolute {
+		if _, reset := t.resets[addr]; reset || src.getStateObject(addr) == nil {
+			s.SelfDestruct(addr)
+		}
+	}
+	s.Finalise(true)
+
+	for addr := range absolute {
+		obj := src.getStateObject(addr)
+		if obj == nil {
+			continue
+		}
+		s.SetNonce(addr, obj.Nonce())
+		s.SetBalance(addr, obj.Balance())
+		if _, ok := t.code[addr]; ok {
+			s.SetCode(addr, obj.Code())
+		}
+	}
+	for addr, keys := range t.writeSlots {
+		obj := src.getStateObject(addr)
+		if obj == nil {
+			continue
+		}
+		for key := range keys {
+			s.SetState(addr, key, obj.GetState(key))
+		}
+	}
+	for addr, amount := range t.adds {
+		if t.blind(addr) {
+			s.AddBalance(addr, amount)
+		}
+	}
+	s.Finalise(true)
+}
@@ -150,6 +150,9 @@ type (
 		account       *common.Address
 		key, prevalue common.Hash
 	}
+
+	// Changes to the recorded self-destruct transfers
+	addSelfdestructTransferChange struct{}
 )
 
 func (ch createObjectChange) revert(s *StateDB) {
@@ -267,6 +270,14 @@ func (ch addLogChange) dirtied() *common.Address {
 	return nil
 }
 
+func (ch addSelfdestructTransferChange) revert(s *StateDB) {
+	s.selfdestructTransfers = s.selfdestructTransfers[:len(s.selfdestructTransfers)-1]
+}
+
+func (ch addSelfdestructTransferChange) dirtied() *common.Address {
+	return nil
+}
+
 func (ch addPreimageChange) revert(s *StateDB) {
 	delete(s.preimages, ch.hash)
 }
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// NodeHealer retrieves the trie node with the given hash from outside the local
+// database, e.g. from a peer. It may be invoked concurrently.
+type NodeHealer func(hash common.Hash) ([]byte, error)
+
+// SetNodeHealer attaches healer to the state, which is then asked for any trie
+// node found missing while reading or updating the tries, e.g. in a pruned or
+// partially synced database. Healed nodes are stored in the disk database and
+// the failed access is retried. Passing nil detaches it again. Healers are not
+// copied.
+func (s *StateDB) SetNodeHealer(healer NodeHealer) {
+	s.healer = healer
+}
+
+// withHealing invokes access, retrying it as long as it fails on missing trie
+// nodes provided by the healer. Every node is requested at most once, so that a
+// node the database still can't resolve afterwards does not loop forever.
+func (s *StateDB) withHealing(access func() error) error {
+	err := access()
+	if err == nil || s.healer == nil {
+		return err
+	}
+	healed := make(map[common.Hash]struct{})
+	for {
+		var missing *trie.MissingNodeError
+		if !errors.As(err, &missing) {
+			return err
+		}
+		if _, ok := healed[missing.NodeHash]; ok {
+			return err
+		}
+		healed[missing.NodeHash] = struct{}{}
+
+		blob, herr := s.healer(missing.NodeHash)
+		if herr != nil {
+			log.Debug("Failed to heal trie node", "owner", missing.Owner, "path", missing.Path, "hash", missing.NodeHash, "err", herr)
+			return err
+		}
+		if crypto.Keccak256Hash(blob) != missing.NodeHash {
+			log.Debug("Healed trie node mismatch", "owner", missing.Owner, "path", missing.Path, "hash", missing.NodeHash)
+			return err
+		}
+		rawdb.WriteTrieNode(s.db.DiskDB(), missing.Owner, missing.Path, missing.NodeHash, blob, s.db.TrieDB().Scheme())
+
+		if err = access(); err == nil {
+			return nil
+		}
+	}
+}
@@ -158,7 +158,11 @@ func (s *stateObject) getTrie() (Trie, error) {
 		//	s.trie = s.db.prefetcher.trie(s.addrHash, s.data.Root)
 		// }
 		// if s.trie == nil {
-		tr, err := s.db.db.OpenStorageTrie(s.db.originalRoot, s.address, s.data.Root, s.db.trie)
+		var tr Trie
+		err := s.db.withHealing(func() (err error) {
+			tr, err = s.db.db.OpenStorageTrie(s.db.originalRoot, s.address, s.data.Root, s.db.trie)
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -250,7 +254,11 @@ func (s *stateObject) GetCommittedState(key common.Hash) common.Hash {
 			s.db.setError(err)
 			return common.Hash{}
 		}
-		val, err := tr.GetStorage(s.address, key.Bytes())
+		var val []byte
+		err = s.db.withHealing(func() (err error) {
+			val, err = tr.GetStorage(s.address, key.Bytes())
+			return err
+		})
 		if metrics.EnabledExpensive {
 			s.db.StorageReads += time.Since(start)
 		}
@@ -356,12 +364,12 @@ func (s *stateObject) updateTrie() (Trie, error) {
 		defer wg.Done()
 		for key, value := range dirtyStorage {
 			if len(value) == 0 {
-				if err := tr.DeleteStorage(s.address, key[:]); err != nil {
+				if err := s.db.withHealing(func() error { return tr.DeleteStorage(s.address, key[:]) }); err != nil {
 					s.db.setError(err)
 				}
 				s.db.StorageDeleted += 1
 			} else {
-				if err := tr.UpdateStorage(s.address, key[:], value); err != nil {
+				if err := s.db.withHealing(func() error { return tr.UpdateStorage(s.address, key[:], value) }); err != nil {
 					s.db.setError(err)
 				}
 				s.db.StorageUpdated += 1
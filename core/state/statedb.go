@@ -120,6 +120,18 @@ type StateDB struct {
 	logs    map[common.Hash][]*types.Log
 	logSize uint
 
+	// Value sent by self-destructs, if recorded by the VM.
+	selfdestructTransfers []SelfdestructTransfer
+
+	// Invoked on every SetTxContext, if set. Not copied.
+	txContextHook func(thash common.Hash, ti int)
+
+	// Records the state accesses, if set. Not copied.
+	tracker *AccessTracker
+
+	// Retrieves missing trie nodes, if set. Not copied.
+	healer NodeHealer
+
 	// Preimages occurred seen by VM in the scope of block.
 	preimages map[common.Hash][]byte
 
@@ -361,6 +373,27 @@ func (s *StateDB) AddLog(log *types.Log) {
 	s.logSize++
 }
 
+// SelfdestructTransfer is the value sent to the beneficiary of a self-destruct.
+type SelfdestructTransfer struct {
+	Beneficiary common.Address
+	Value       *uint256.Int
+}
+
+// AddSelfdestructTransfer records the value sent to beneficiary by a self-destruct.
+// The record is journaled, so it is discarded again if the enclosing call reverts.
+func (s *StateDB) AddSelfdestructTransfer(beneficiary common.Address, value *uint256.Int) {
+	s.journal.append(addSelfdestructTransferChange{})
+	s.selfdestructTransfers = append(s.selfdestructTransfers, SelfdestructTransfer{Beneficiary: beneficiary, Value: new(uint256.Int).Set(value)})
+}
+
+// TakeSelfdestructTransfers returns the self-destruct transfers recorded since
+// the last call and clears them. It should only be called on finalised state.
+func (s *StateDB) TakeSelfdestructTransfers() []SelfdestructTransfer {
+	transfers := s.selfdestructTransfers
+	s.selfdestructTransfers = nil
+	return transfers
+}
+
 // GetLogs returns the logs matching the specified transaction hash, and annotates
 // them with the given blockNumber and blockHash.
 func (s *StateDB) GetLogs(hash common.Hash, blockNumber uint64, blockHash common.Hash) []*types.Log {
@@ -414,18 +447,27 @@ func (s *StateDB) SubRefund(gas uint64) {
 // Exist reports whether the given account address exists in the state.
 // Notably this also returns true for self-destructed accounts.
 func (s *StateDB) Exist(addr common.Address) bool {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	return s.getStateObject(addr) != nil
 }
 
 // Empty returns whether the state object is either non-existent
 // or empty according to the EIP161 specification (balance = nonce = code = 0)
 func (s *StateDB) Empty(addr common.Address) bool {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	so := s.getStateObject(addr)
 	return so == nil || so.empty()
 }
 
 // GetBalance retrieves the balance from the given address or 0 if object not found
 func (s *StateDB) GetBalance(addr common.Address) *uint256.Int {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Balance()
@@ -435,6 +477,9 @@ func (s *StateDB) GetBalance(addr common.Address) *uint256.Int {
 
 // GetNonce retrieves the nonce from the given address or 0 if object not found
 func (s *StateDB) GetNonce(addr common.Address) uint64 {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Nonce()
@@ -446,6 +491,9 @@ func (s *StateDB) GetNonce(addr common.Address) uint64 {
 // GetStorageRoot retrieves the storage root from the given address or empty
 // if object not found.
 func (s *StateDB) GetStorageRoot(addr common.Address) common.Hash {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Root()
@@ -459,6 +507,9 @@ func (s *StateDB) TxIndex() int {
 }
 
 func (s *StateDB) GetCode(addr common.Address) []byte {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Code()
@@ -475,6 +526,9 @@ func (s *StateDB) GetRoot(addr common.Address) common.Hash {
 }
 
 func (s *StateDB) GetCodeSize(addr common.Address) int {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.CodeSize()
@@ -483,6 +537,9 @@ func (s *StateDB) GetCodeSize(addr common.Address) int {
 }
 
 func (s *StateDB) GetCodeHash(addr common.Address) common.Hash {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return common.BytesToHash(stateObject.CodeHash())
@@ -492,6 +549,9 @@ func (s *StateDB) GetCodeHash(addr common.Address) common.Hash {
 
 // GetState retrieves a value from the given account's storage trie.
 func (s *StateDB) GetState(addr common.Address, hash common.Hash) common.Hash {
+	if s.tracker != nil {
+		s.tracker.readSlot(addr, hash)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.GetState(hash)
@@ -501,6 +561,9 @@ func (s *StateDB) GetState(addr common.Address, hash common.Hash) common.Hash {
 
 // GetCommittedState retrieves a value from the given account's committed storage trie.
 func (s *StateDB) GetCommittedState(addr common.Address, hash common.Hash) common.Hash {
+	if s.tracker != nil {
+		s.tracker.readSlot(addr, hash)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.GetCommittedState(hash)
@@ -514,6 +577,9 @@ func (s *StateDB) Database() Database {
 }
 
 func (s *StateDB) HasSelfDestructed(addr common.Address) bool {
+	if s.tracker != nil {
+		s.tracker.readAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.selfDestructed
@@ -527,6 +593,9 @@ func (s *StateDB) HasSelfDestructed(addr common.Address) bool {
 
 // AddBalance adds amount to the account associated with addr.
 func (s *StateDB) AddBalance(addr common.Address, amount *uint256.Int) {
+	if s.tracker != nil {
+		s.tracker.addBalance(addr, amount)
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.AddBalance(amount)
@@ -535,6 +604,9 @@ func (s *StateDB) AddBalance(addr common.Address, amount *uint256.Int) {
 
 // SubBalance subtracts amount from the account associated with addr.
 func (s *StateDB) SubBalance(addr common.Address, amount *uint256.Int) {
+	if s.tracker != nil {
+		s.tracker.writeAccount(addr)
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SubBalance(amount)
@@ -542,6 +614,9 @@ func (s *StateDB) SubBalance(addr common.Address, amount *uint256.Int) {
 }
 
 func (s *StateDB) SetBalance(addr common.Address, amount *uint256.Int) {
+	if s.tracker != nil {
+		s.tracker.writeAccount(addr)
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetBalance(amount)
@@ -549,6 +624,9 @@ func (s *StateDB) SetBalance(addr common.Address, amount *uint256.Int) {
 }
 
 func (s *StateDB) SetNonce(addr common.Address, nonce uint64) {
+	if s.tracker != nil {
+		s.tracker.writeAccount(addr)
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetNonce(nonce)
@@ -556,6 +634,10 @@ func (s *StateDB) SetNonce(addr common.Address, nonce uint64) {
 }
 
 func (s *StateDB) SetCode(addr common.Address, code []byte) {
+	if s.tracker != nil {
+		s.tracker.writeAccount(addr)
+		s.tracker.code[addr] = struct{}{}
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetCode(crypto.Keccak256Hash(code), code)
@@ -563,6 +645,9 @@ func (s *StateDB) SetCode(addr common.Address, code []byte) {
 }
 
 func (s *StateDB) SetState(addr common.Address, key, value common.Hash) {
+	if s.tracker != nil {
+		s.tracker.writeSlot(addr, key)
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetState(key, value)
@@ -584,6 +669,9 @@ func (s *StateDB) SetStorage(addr common.Address, storage map[common.Hash]common
 	if _, ok := s.stateObjectsDestruct[addr]; !ok {
 		s.stateObjectsDestruct[addr] = nil
 	}
+	if s.tracker != nil {
+		s.tracker.resetAccount(addr)
+	}
 	stateObject := s.getOrNewStateObject(addr)
 	for k, v := range storage {
 		stateObject.SetState(k, v)
@@ -596,6 +684,9 @@ func (s *StateDB) SetStorage(addr common.Address, storage map[common.Hash]common
 // The account's state object is still available until the state is committed,
 // getStateObject will return a non-nil account after SelfDestruct.
 func (s *StateDB) SelfDestruct(addr common.Address) {
+	if s.tracker != nil {
+		s.tracker.resetAccount(addr)
+	}
 	stateObject := s.getStateObject(addr)
 	if stateObject == nil {
 		return
@@ -662,7 +753,7 @@ func (s *StateDB) updateStateObject(obj *stateObject) {
 	}
 	// Encode the account and update the account trie
 	addr := obj.Address()
-	if err := s.trie.UpdateAccount(addr, &obj.data); err != nil {
+	if err := s.withHealing(func() error { return s.trie.UpdateAccount(addr, &obj.data) }); err != nil {
 		s.setError(fmt.Errorf("updateStateObject (%x) error: %v", addr[:], err))
 	}
 	if obj.dirtyCode {
@@ -692,7 +783,7 @@ func (s *StateDB) deleteStateObject(obj *stateObject) {
 	}
 	// Delete the account from the trie
 	addr := obj.Address()
-	if err := s.trie.DeleteAccount(addr); err != nil {
+	if err := s.withHealing(func() error { return s.trie.DeleteAccount(addr) }); err != nil {
 		s.setError(fmt.Errorf("deleteStateObject (%x) error: %v", addr[:], err))
 	}
 }
@@ -746,7 +837,11 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 	// If snapshot unavailable or reading from it failed, load from the database
 	if data == nil {
 		if s.trie == nil {
-			tr, err := s.db.OpenTrie(s.originalRoot)
+			var tr Trie
+			err := s.withHealing(func() (err error) {
+				tr, err = s.db.OpenTrie(s.originalRoot)
+				return err
+			})
 			if err != nil {
 				s.setError(errors.New("failed to open trie tree"))
 				return nil
@@ -754,8 +849,10 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 			s.trie = tr
 		}
 		start := time.Now()
-		var err error
-		data, err = s.trie.GetAccount(addr)
+		err := s.withHealing(func() (err error) {
+			data, err = s.trie.GetAccount(addr)
+			return err
+		})
 		if metrics.EnabledExpensive {
 			s.AccountReads += time.Since(start)
 		}
@@ -839,6 +936,9 @@ func (s *StateDB) createObject(addr common.Address) (newobj, prev *stateObject)
 //
 // Carrying over the balance ensures that Ether doesn't disappear.
 func (s *StateDB) CreateAccount(addr common.Address) {
+	if s.tracker != nil {
+		s.tracker.resetAccount(addr)
+	}
 	newObj, prev := s.createObject(addr)
 	if prev != nil {
 		newObj.setBalance(prev.data.Balance)
@@ -893,6 +993,8 @@ func (s *StateDB) copyInternal(doPrefetch bool) *StateDB {
 		snaps: s.snaps,
 		snap:  s.snap,
 	}
+	state.selfdestructTransfers = append([]SelfdestructTransfer(nil), s.selfdestructTransfers...)
+
 	// Copy the dirty states, logs, and preimages
 	for addr := range s.journal.dirties {
 		// As documented [here](https://github.com/ethereum/go-ethereum/pull/16485#issuecomment-380438527),
@@ -1253,6 +1355,16 @@ func (s *StateDB) SetTxContext(thash common.Hash, ti int) {
 	s.thash = thash
 	s.txIndex = ti
 	s.accessList = nil // can't delete this line now, because StateDB.Prepare is not called before processsing a system transaction
+	if s.txContextHook != nil {
+		s.txContextHook(thash, ti)
+	}
+}
+
+// SetTxContextHook installs a hook invoked with the transaction hash and index
+// on every subsequent SetTxContext, e.g. to observe the system transactions
+// applied by a consensus engine. A nil hook removes the current one.
+func (s *StateDB) SetTxContextHook(hook func(thash common.Hash, ti int)) {
+	s.txContextHook = hook
 }
 
 func (s *StateDB) clearJournalAndRefund() {
@@ -1878,6 +1990,102 @@ func (s *StateDB) SlotInAccessList(addr common.Address, slot common.Hash) (addre
 	return s.accessList.Contains(addr, slot)
 }
 
+// StorageGrowth returns the number of storage slots that were empty at the start
+// of the block, but hold a value after the state changes finalised so far. Slots
+// that got set and cleared again within the block are not counted.
+func (s *StateDB) StorageGrowth() int {
+	var growth int
+	for addr := range s.stateObjectsDirty {
+		obj, exist := s.stateObjects[addr]
+		if !exist || obj.deleted {
+			continue
+		}
+		for key, value := range obj.pendingStorage {
+			if value == (common.Hash{}) {
+				continue
+			}
+			// Uncached origins belong to destructed accounts, the storage of which
+			// has been wiped already.
+			if origin, cached := obj.getOriginStorage(key); !cached || origin == (common.Hash{}) {
+				growth++
+			}
+		}
+	}
+	return growth
+}
+
+// AccountChurn returns the number of accounts that did not exist at the start of
+// the block but do after the state changes finalised so far, and the number of
+// accounts that existed but got self-destructed or deleted as empty since. An
+// account destroyed and recreated within the block is counted in neither.
+func (s *StateDB) AccountChurn() (created, destroyed int) {
+	for addr := range s.stateObjectsDirty {
+		obj, exist := s.stateObjects[addr]
+		var (
+			existed = (exist && obj.origin != nil) || s.stateObjectsDestruct[addr] != nil
+			exists  = exist && !obj.deleted
+		)
+		switch {
+		case exists && !existed:
+			created++
+		case existed && !exists:
+			destroyed++
+		}
+	}
+	return created, destroyed
+}
+
+// FinalStorage returns the current values of the storage slots modified by the
+// state changes finalised so far, keyed by contract. Slots written back to their
+// value at the start of the block and destroyed accounts are left out.
+func (s *StateDB) FinalStorage() map[common.Address]map[common.Hash]common.Hash {
+	storage := make(map[common.Address]map[common.Hash]common.Hash)
+	for addr := range s.stateObjectsDirty {
+		obj, exist := s.stateObjects[addr]
+		if !exist || obj.deleted {
+			continue
+		}
+		for key, value := range obj.pendingStorage {
+			if value == obj.originStorage[key] {
+				continue
+			}
+			if storage[addr] == nil {
+				storage[addr] = make(map[common.Hash]common.Hash)
+			}
+			storage[addr][key] = value
+		}
+	}
+	return storage
+}
+
+// TxStorageWrites returns the number of storage slots modified by the current
+// transaction, keyed by contract. Slots written with their previous value are
+// not counted. It must be called before the state is finalised.
+func (s *StateDB) TxStorageWrites() map[common.Address]int {
+	writes := make(map[common.Address]int)
+	for addr := range s.journal.dirties {
+		obj, exist := s.stateObjects[addr]
+		if !exist {
+			continue
+		}
+		for key, value := range obj.dirtyStorage {
+			if value != obj.GetCommittedState(key) {
+				writes[addr]++
+			}
+		}
+	}
+	return writes
+}
+
+// AccessList returns the content of the current access list, sorted by address
+// and slot.
+func (s *StateDB) AccessList() types.AccessList {
+	if s.accessList == nil {
+		return nil
+	}
+	return s.accessList.Export()
+}
+
 func (s *StateDB) GetStorage(address common.Address) *sync.Map {
 	return s.storagePool.getStorage(address)
 }
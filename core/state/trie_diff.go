@@ -0,0 +1,100 @@
+package state
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// AccountDiff is the change made to an account since the state was last
+// committed, in a form that can be applied to another copy of the same state
+// without re-executing the transactions that caused it.
+type AccountDiff struct {
+	Address    common.Address
+	Destructed bool // The account was deleted, wiping its storage, before any of the changes below
+	Deleted    bool // The account does not exist anymore, all other fields are empty
+	Nonce      uint64
+	Balance    *uint256.Int
+	Code       []byte        // Only set if the code was changed
+	Storage    []StorageDiff // Storage slots written, sorted by key
+}
+
+// StorageDiff is a storage slot written as part of an AccountDiff.
+type StorageDiff struct {
+	Key   common.Hash
+	Value common.Hash
+}
+
+// TrieDiff returns the changes made to the state since it was last committed,
+// sorted by address. All pending changes must have been finalised beforehand.
+func (s *StateDB) TrieDiff() []AccountDiff {
+	addrs := make([]common.Address, 0, len(s.stateObjectsDirty)+len(s.stateObjectsDestruct))
+	for addr := range s.stateObjectsDirty {
+		addrs = append(addrs, addr)
+	}
+	for addr := range s.stateObjectsDestruct {
+		if _, ok := s.stateObjectsDirty[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	diff := make([]AccountDiff, 0, len(addrs))
+	for _, addr := range addrs {
+		_, destructed := s.stateObjectsDestruct[addr]
+		obj, exist := s.stateObjects[addr]
+		if !exist || obj.deleted {
+			diff = append(diff, AccountDiff{Address: addr, Destructed: destructed, Deleted: true, Balance: new(uint256.Int)})
+			continue
+		}
+		account := AccountDiff{
+			Address:    addr,
+			Destructed: destructed,
+			Nonce:      obj.Nonce(),
+			Balance:    new(uint256.Int).Set(obj.Balance()),
+			Storage:    make([]StorageDiff, 0, len(obj.pendingStorage)),
+		}
+		if obj.dirtyCode {
+			account.Code = common.CopyBytes(obj.Code())
+		}
+		for key, value := range obj.pendingStorage {
+			account.Storage = append(account.Storage, StorageDiff{Key: key, Value: value})
+		}
+		sort.Slice(account.Storage, func(i, j int) bool {
+			return bytes.Compare(account.Storage[i].Key[:], account.Storage[j].Key[:]) < 0
+		})
+		diff = append(diff, account)
+	}
+	return diff
+}
+
+// ApplyTrieDiff applies the changes exported by TrieDiff from another copy of
+// the same state and finalises them.
+func (s *StateDB) ApplyTrieDiff(diff []AccountDiff) {
+	// Wipe destructed and deleted accounts first, so that recreated ones start
+	// out with empty storage.
+	for _, account := range diff {
+		if account.Destructed || account.Deleted {
+			s.SelfDestruct(account.Address)
+		}
+	}
+	s.Finalise(true)
+
+	for _, account := range diff {
+		if account.Deleted {
+			continue
+		}
+		s.SetNonce(account.Address, account.Nonce)
+		s.SetBalance(account.Address, account.Balance)
+		if len(account.Code) > 0 {
+			s.SetCode(account.Address, account.Code)
+		}
+		for _, slot := range account.Storage {
+			s.SetState(account.Address, slot.Key, slot.Value)
+		}
+	}
+	s.Finalise(true)
+}
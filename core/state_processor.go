@@ -17,9 +17,13 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
@@ -30,6 +34,9 @@ import (
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
 )
 
 // StateProcessor is a basic Processor, which takes care of transitioning
@@ -40,15 +47,119 @@ type StateProcessor struct {
 	config *params.ChainConfig // Chain configuration options
 	bc     *BlockChain         // Canonical block chain
 	engine consensus.Engine    // Consensus engine used for block rewards
+
+	daoActive   bool // Whether the chain supports the DAO hard-fork at all
+	speculative bool // Whether transactions may be executed speculatively, see ParallelStateProcessor
+
+	upgrades *systemcontracts.UpgradeSchedule // Blocks at which forks may upgrade the built-in system contracts
+
+	// TxToMessageFunc, if set, replaces TransactionToMessage in converting the
+	// transactions of processed blocks, e.g. to prototype new transaction types.
+	// It lives here rather than in vm.Config, as the vm can not refer to Message.
+	TxToMessageFunc func(tx *types.Transaction, signer types.Signer, baseFee *big.Int) (*Message, error)
+
+	// OnReceipt, if set, is invoked with the receipt and index of every transaction
+	// as soon as it is applied, allowing to stream the results of large blocks. The
+	// receipts of the system transactions are delivered once Finalize returns.
+	OnReceipt func(receipt *types.Receipt, txIndex int)
+
+	// PreCheck, if set, is invoked with the message of every normal transaction
+	// before it is applied. Returning an error rejects the block, e.g. to enforce
+	// an allowlist of senders. System transactions are not checked.
+	PreCheck func(msg *Message) error
+
+	// CollectIntermediateRoots, if set, records the state root after every normal
+	// transaction of the processed block, retrievable through IntermediateRoots.
+	// After Byzantium the roots are not part of the receipts and are computed only
+	// for collection, which is expensive.
+	CollectIntermediateRoots bool
+	intermediateRoots        []common.Hash
+
+	// NewBlockContext, if set, replaces NewEVMBlockContext in creating the EVM
+	// block context of processed blocks, e.g. to customise the BLOCKHASH results
+	// of sidechain experiments.
+	NewBlockContext func(header *types.Header, chain ChainContext, author *common.Address) vm.BlockContext
+
+	// SyncBloom, if set, creates the blooms of the receipts synchronously as the
+	// transactions are applied, rather than on a background goroutine, which is
+	// cheaper on single core or memory constrained machines. The blooms are the
+	// same either way.
+	SyncBloom bool
+
+	// WasmExecutor, if set, applies the normal transactions calling a contract
+	// whose code starts with WasmCodePrefix instead of the EVM, e.g. to experiment
+	// with a WASM execution layer. Transactions are then never executed in parallel.
+	WasmExecutor Executor
 }
 
 // NewStateProcessor initialises a new StateProcessor.
 func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consensus.Engine) *StateProcessor {
 	return &StateProcessor{
-		config: config,
-		bc:     bc,
-		engine: engine,
+		config:    config,
+		bc:        bc,
+		engine:    engine,
+		daoActive: config.DAOForkSupport && config.DAOForkBlock != nil,
+		upgrades:  systemcontracts.NewUpgradeSchedule(config),
+	}
+}
+
+// applyPreApplied accounts for the pre-applied transaction tx at index i, whose
+// receipt is reused instead of executing it again. As its state changes are
+// already contained in statedb, only the gas and logs are applied.
+func (p *StateProcessor) applyPreApplied(receipt *types.Receipt, executed bool, gp *GasPool, statedb *state.StateDB, tx *types.Transaction, i int, usedGas *uint64) error {
+	if executed {
+		return fmt.Errorf("%w: follows an executed transaction", ErrInvalidPreAppliedTx)
+	}
+	if receipt.TxHash != tx.Hash() {
+		return fmt.Errorf("%w: receipt of tx %v", ErrInvalidPreAppliedTx, receipt.TxHash.Hex())
+	}
+	if err := gp.SubGas(receipt.GasUsed); err != nil {
+		return err
+	}
+	*usedGas += receipt.GasUsed
+	if receipt.CumulativeGasUsed != *usedGas {
+		return fmt.Errorf("%w: cumulative gas used %d, want %d", ErrInvalidPreAppliedTx, receipt.CumulativeGasUsed, *usedGas)
+	}
+	statedb.SetTxContext(tx.Hash(), i)
+	for _, log := range receipt.Logs {
+		statedb.AddLog(log)
+	}
+	return nil
+}
+
+// IntermediateRoots returns the state roots after every normal transaction of the
+// last block processed with CollectIntermediateRoots set.
+func (p *StateProcessor) IntermediateRoots() []common.Hash {
+	return p.intermediateRoots
+}
+
+// collectIntermediateRoot records the state root after the transaction with the
+// given receipt, if CollectIntermediateRoots is set. Before Byzantium the root
+// was already computed for the receipt.
+func (p *StateProcessor) collectIntermediateRoot(statedb *state.StateDB, receipt *types.Receipt, blockNumber *big.Int) {
+	if !p.CollectIntermediateRoots {
+		return
+	}
+	if p.config.IsByzantium(blockNumber) {
+		p.intermediateRoots = append(p.intermediateRoots, statedb.IntermediateRoot(p.config.IsEIP158(blockNumber)))
+	} else {
+		p.intermediateRoots = append(p.intermediateRoots, common.BytesToHash(receipt.PostState))
+	}
+}
+
+// isDAOForkBlock reports whether the DAO hard-fork state transition is to be
+// applied at the given block number.
+func (p *StateProcessor) isDAOForkBlock(number *big.Int) bool {
+	return p.daoActive && p.config.DAOForkBlock.Cmp(number) == 0
+}
+
+// txToMessage converts tx into a Message using TxToMessageFunc if set, or the
+// standard TransactionToMessage otherwise.
+func (p *StateProcessor) txToMessage(tx *types.Transaction, signer types.Signer, baseFee *big.Int) (*Message, error) {
+	if p.TxToMessageFunc != nil {
+		return p.TxToMessageFunc(tx, signer, baseFee)
 	}
+	return TransactionToMessage(tx, signer, baseFee)
 }
 
 // Process processes the state changes according to the Ethereum rules by running
@@ -59,111 +170,887 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 // returns the amount of gas that was used in the process. If any of the
 // transactions failed to execute due to insufficient gas it will return an error.
 func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	return p.ProcessWithConfig(block, statedb, ProcessConfig{Config: cfg})
+}
+
+// ProcessWithConfig is like Process, but additionally applies the block
+// processing policies and gathers the statistics requested by cfg.
+func (p *StateProcessor) ProcessWithConfig(block *types.Block, statedb *state.StateDB, cfg ProcessConfig) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{})
+	return statedb, receipts, allLogs, usedGas, err
+}
+
+// ProcessWithReceiptProcessors is like Process, but applies receiptProcessors,
+// e.g. decorators attaching custom data, to the receipt of every executed normal
+// transaction, before its bloom is created.
+func (p *StateProcessor) ProcessWithReceiptProcessors(block *types.Block, statedb *state.StateDB, cfg ProcessConfig, receiptProcessors ...ReceiptProcessor) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{receiptProcessors: receiptProcessors})
+	return statedb, receipts, allLogs, usedGas, err
+}
+
+// ProcessWithContext is like Process, but aborts once ctx is cancelled, both in
+// between transactions and within the execution of one. The returned error wraps
+// the one of ctx, and the receipts, logs and gas used are the ones of the
+// transactions applied so far. If a transaction was interrupted, the returned state is nil, as
+// it holds the partial writes of the aborted transaction, which can not be
+// reverted once applied.
+//
+// Within a transaction, the cancellation is only observed by the JUMP and JUMPI
+// instructions, see vm.EVM.Cancel, so code without loops, precompiles and the
+// system calls run to completion.
+func (p *StateProcessor) ProcessWithContext(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg ProcessConfig) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(ctx, block, statedb, cfg, processOptions{})
+	return statedb, receipts, allLogs, usedGas, err
+}
+
+// ProcessWithSigner is like Process, but recovers the senders of the transactions
+// with signer instead of the one derived from the chain config, e.g. to replay
+// transactions signed under a different config. A nil signer falls back to the
+// derived one.
+func (p *StateProcessor) ProcessWithSigner(block *types.Block, statedb *state.StateDB, cfg ProcessConfig, signer types.Signer) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{signer: signer})
+	return statedb, receipts, allLogs, usedGas, err
+}
+
+// ProcessRootOnly is like Process, but only returns the state root after the
+// block is finalized, e.g. to verify a sync checkpoint. Receipts are built only
+// as far as the consensus engine needs them and no blooms are generated.
+func (p *StateProcessor) ProcessRootOnly(block *types.Block, statedb *state.StateDB, cfg ProcessConfig) (common.Hash, error) {
+	statedb, _, _, _, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{skipBlooms: true})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return statedb.IntermediateRoot(p.config.IsEIP158(block.Number())), nil
+}
+
+// ProcessWithRoots is like Process, but additionally returns the state root the
+// block is applied on and the resulting one, e.g. to assemble the witness of a
+// state transition proof. Pending changes of statedb are part of the pre-state.
+func (p *StateProcessor) ProcessWithRoots(block *types.Block, statedb *state.StateDB, cfg ProcessConfig) (*state.StateDB, types.Receipts, []*types.Log, uint64, common.Hash, common.Hash, error) {
+	deleteEmptyObjects := p.config.IsEIP158(block.Number())
+	preRoot := statedb.IntermediateRoot(deleteEmptyObjects)
+
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{})
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, preRoot, common.Hash{}, err
+	}
+	return statedb, receipts, allLogs, usedGas, preRoot, statedb.IntermediateRoot(deleteEmptyObjects), nil
+}
+
+// ProcessReusable is like Process, but applies block on a copy of parent, which
+// is never modified, and returns the resulting state. It allows processing many
+// candidate blocks against the same parent state, e.g. in a simulation server,
+// without the caller managing copies.
+func (p *StateProcessor) ProcessReusable(block *types.Block, parent *state.StateDB, cfg ProcessConfig) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, parent.Copy(), cfg, processOptions{})
+	return statedb, receipts, allLogs, usedGas, err
+}
+
+// ProcessDetailed is like Process, but additionally returns the non-consensus
+// statistics gathered while processing the block, as requested by cfg.
+func (p *StateProcessor) ProcessDetailed(block *types.Block, statedb *state.StateDB, cfg ProcessConfig) (*state.StateDB, types.Receipts, []*types.Log, uint64, *ProcessStats, error) {
+	return p.process(context.Background(), block, statedb, cfg, processOptions{})
+}
+
+// ProcessAndStore is like Process, but hands the final receipts of the block,
+// including the ones of the system transactions applied during finalization,
+// to writer before returning. Nothing is written if the block fails to process.
+func (p *StateProcessor) ProcessAndStore(block *types.Block, statedb *state.StateDB, cfg ProcessConfig, writer ReceiptWriter) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{})
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, err
+	}
+	if err := writer.WriteReceipts(block, receipts); err != nil {
+		return statedb, receipts, allLogs, usedGas, fmt.Errorf("failed to store receipts: %w", err)
+	}
+	return statedb, receipts, allLogs, usedGas, nil
+}
+
+// ProcessWithProof is like Process, but additionally returns a Merkle proof of
+// the final state of target against the post-state root of the block. The proof
+// lists the trie nodes from the root down to the account, and can be checked
+// with trie.VerifyProof against the root of the resulting statedb.
+func (p *StateProcessor) ProcessWithProof(block *types.Block, statedb *state.StateDB, cfg ProcessConfig, target common.Address) (*state.StateDB, types.Receipts, []*types.Log, uint64, trienode.ProofList, error) {
+	statedb, receipts, allLogs, usedGas, _, err := p.process(context.Background(), block, statedb, cfg, processOptions{})
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, nil, err
+	}
+	statedb.IntermediateRoot(p.config.IsEIP158(block.Number()))
+	tr, err := statedb.Trie()
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, nil, fmt.Errorf("failed to open state trie: %w", err)
+	}
+	var proof trienode.ProofList
+	if err := tr.Prove(crypto.Keccak256(target.Bytes()), &proof); err != nil {
+		return statedb, receipts, allLogs, usedGas, nil, fmt.Errorf("failed to prove account %v: %w", target, err)
+	}
+	return statedb, receipts, allLogs, usedGas, proof, nil
+}
+
+// ProcessBundle applies txs atomically on top of statedb in the context of
+// header, with txIndex being the position of the first one in the block. Either
+// all transactions are included and execute successfully, or the gas pool and
+// usedGas are reverted to their checkpoints and an error is returned.
+//
+// As state snapshots can not be reverted across transactions, the bundle is
+// applied on a copy of statedb, which is returned on success. The passed statedb
+// is never modified.
+func (p *StateProcessor) ProcessBundle(header *types.Header, txs types.Transactions, txIndex int, statedb *state.StateDB, gp *GasPool, usedGas *uint64, cfg vm.Config) (*state.StateDB, types.Receipts, error) {
+	var (
+		gasSnapshot = gp.Snapshot()
+		usedGasPrev = *usedGas
+		bundle      = statedb.Copy()
+		receipts    = make(types.Receipts, 0, len(txs))
+	)
+	for i, tx := range txs {
+		bundle.SetTxContext(tx.Hash(), txIndex+i)
+		receipt, err := ApplyTransaction(p.config, p.bc, nil, gp, bundle, header, tx, usedGas, cfg, NewReceiptBloomGenerator())
+		if err == nil && receipt.Status == types.ReceiptStatusFailed {
+			err = ErrBundleReverted
+		}
+		if err != nil {
+			gp.Revert(gasSnapshot)
+			*usedGas = usedGasPrev
+			return statedb, nil, fmt.Errorf("could not apply bundle tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return bundle, receipts, nil
+}
+
+// ProcessedTx bundles a transaction of a processed block with its outcome.
+type ProcessedTx struct {
+	Tx      *types.Transaction
+	Receipt *types.Receipt
+	Logs    []*types.Log
+	Err     error // EVM error of a failed normal transaction, nil otherwise
+}
+
+// ProcessZipped is like Process, but returns the transactions of the block in
+// execution order zipped together with their receipts, logs and EVM errors. As
+// PoSA system transactions are executed during finalization, the order may
+// differ from the one in the block.
+func (p *StateProcessor) ProcessZipped(block *types.Block, statedb *state.StateDB, cfg ProcessConfig) ([]ProcessedTx, uint64, error) {
+	cfg.CaptureTxErrors = true
+	_, receipts, _, usedGas, stats, err := p.process(context.Background(), block, statedb, cfg, processOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	index := make(map[common.Hash]int, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		index[tx.Hash()] = i
+	}
+	zipped := make([]ProcessedTx, len(receipts))
+	for i, receipt := range receipts {
+		idx, ok := index[receipt.TxHash]
+		if !ok {
+			return nil, 0, fmt.Errorf("receipt %d for unknown tx %v", i, receipt.TxHash.Hex())
+		}
+		zipped[i] = ProcessedTx{
+			Tx:      block.Transactions()[idx],
+			Receipt: receipt,
+			Logs:    receipt.Logs,
+			Err:     stats.TxErrors[idx],
+		}
+		if cfg.CanonicalizeLogOutput {
+			zipped[i].Logs = canonicalLogOrder(receipt.Logs)
+		}
+	}
+	return zipped, usedGas, nil
+}
+
+// canonicalLogOrder returns a copy of logs sorted by their topics, then emitting
+// contract and data, for diffing the output of different executions. The logs
+// themselves, and thus their indices, are left untouched.
+func canonicalLogOrder(logs []*types.Log) []*types.Log {
+	sorted := make([]*types.Log, len(logs))
+	copy(sorted, logs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		for k := 0; k < len(a.Topics) && k < len(b.Topics); k++ {
+			if c := bytes.Compare(a.Topics[k][:], b.Topics[k][:]); c != 0 {
+				return c < 0
+			}
+		}
+		if len(a.Topics) != len(b.Topics) {
+			return len(a.Topics) < len(b.Topics)
+		}
+		if c := bytes.Compare(a.Address[:], b.Address[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(a.Data, b.Data) < 0
+	})
+	return sorted
+}
+
+// processOptions are the internal variations of block processing requested by
+// the different Process methods.
+type processOptions struct {
+	signer            types.Signer       // Signer recovering the senders, derived from the chain config if nil
+	receiptProcessors []ReceiptProcessor // Processors applied to the receipts of normal transactions
+	skipBlooms        bool               // Whether to leave the blooms of the receipts unset
+}
+
+func (p *StateProcessor) process(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg ProcessConfig, opts processOptions) (*state.StateDB, types.Receipts, []*types.Log, uint64, *ProcessStats, error) {
+	if err := cfg.Validate(); err != nil {
+		return statedb, nil, nil, 0, nil, err
+	}
+	if cfg.DeterminismCheck {
+		return p.processTwice(ctx, block, statedb, cfg, opts)
+	}
 	var (
+		stats       = newProcessStats(cfg, len(block.Transactions()))
 		usedGas     = new(uint64)
+		blobGasUsed = new(uint64)
 		header      = block.Header()
 		blockHash   = block.Hash()
 		blockNumber = block.Number()
 		allLogs     []*types.Log
 		gp          = new(GasPool).AddGas(block.GasLimit())
+
+		opcodeProfile []vm.OpcodeSample // collected if cfg.ProfileOutput is set
 	)
 
+	if cfg.BaseFeeOverride != nil {
+		header.BaseFee = new(big.Int).Set(cfg.BaseFeeOverride)
+	}
+	if cfg.StateHealer != nil {
+		// Left attached, so that the post-state root can be computed as well
+		statedb.SetNodeHealer(cfg.StateHealer)
+	}
 	var receipts = make([]*types.Receipt, 0)
+	if p.CollectIntermediateRoots {
+		p.intermediateRoots = make([]common.Hash, 0, len(block.Transactions()))
+	}
 	// Mutate the block and state according to any hard-fork specs
-	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
-		misc.ApplyDAOHardFork(statedb)
+	if p.isDAOForkBlock(block.Number()) {
+		if cfg.DAOHandler != nil {
+			cfg.DAOHandler(statedb)
+		} else {
+			misc.ApplyDAOHardFork(statedb)
+		}
 	}
 
 	lastBlock := p.bc.GetBlockByHash(block.ParentHash())
 	if lastBlock == nil {
-		return statedb, nil, nil, 0, errors.New("could not get parent block")
+		return statedb, nil, nil, 0, stats, fmt.Errorf("%w %s", ErrMissingParent, block.ParentHash().Hex())
 	}
-	if !p.config.IsFeynman(block.Number(), block.Time()) {
+	stats.ParentTime = lastBlock.Time()
+	stats.ForkBoundary = isForkBoundary(p.config, lastBlock.Header(), header)
+	if !p.config.IsFeynman(block.Number(), block.Time()) && p.upgrades.HasUpgrade(blockNumber, lastBlock.Time(), block.Time()) {
 		// Handle upgrade build-in system contract code
 		systemcontracts.UpgradeBuildInSystemContract(p.config, blockNumber, lastBlock.Time(), block.Time(), statedb)
 	}
 
+	newBlockContext := NewEVMBlockContext
+	if p.NewBlockContext != nil {
+		newBlockContext = p.NewBlockContext
+	}
+	context := newBlockContext(header, p.bc, nil)
+	if cfg.RandaoOverride != nil {
+		random := *cfg.RandaoOverride
+		context.Random = &random
+	}
+	if cfg.ProfileOutput != nil {
+		cfg.ProfileOpcodes = true
+	}
+	var opcodeGas *opcodeGasLogger
+	if cfg.OpcodeGas {
+		opcodeGas = newOpcodeGasLogger(cfg.Tracer)
+		cfg.Tracer = opcodeGas
+	}
 	var (
-		context = NewEVMBlockContext(header, p.bc, nil)
-		vmenv   = vm.NewEVM(context, vm.TxContext{}, statedb, p.config, cfg)
-		signer  = types.MakeSigner(p.config, header.Number, header.Time)
-		txNum   = len(block.Transactions())
+		vmenv = vm.NewEVM(context, vm.TxContext{}, statedb, p.config, cfg.Config)
+		txNum = len(block.Transactions())
 	)
-	if beaconRoot := block.BeaconRoot(); beaconRoot != nil {
-		ProcessBeaconBlockRoot(*beaconRoot, vmenv, statedb)
+	signer := opts.signer
+	if signer == nil {
+		signer = types.MakeSigner(p.config, header.Number, header.Time)
+	}
+	if beaconRoot := block.BeaconRoot(); beaconRoot != nil && !(cfg.SkipZeroBeaconRoot && *beaconRoot == (common.Hash{})) {
+		ProcessBeaconBlockRootWithGas(*beaconRoot, BeaconRootGas(header), vmenv, statedb)
+	}
+	if p.config.IsPrague(blockNumber, block.Time()) {
+		ProcessParentBlockHash(block.ParentHash(), vmenv, statedb)
 	}
+	var coinbaseBalance *big.Int
+	if cfg.TrackCoinbaseDelta {
+		coinbaseBalance = statedb.GetBalance(context.Coinbase).ToBig()
+	}
+
+	// Abort any running transaction once ctx is cancelled
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				vmenv.Cancel()
+			case <-done:
+			}
+		}()
+	}
+
 	// Iterate over and process the individual transactions
 	posa, isPoSA := p.engine.(consensus.PoSA)
+
+	var spec *speculation
+	if p.speculative && cfg.ParallelExecution && speculationSupported(cfg) && p.WasmExecutor == nil && p.config.IsByzantium(blockNumber) {
+		spec = p.speculate(ctx, block, statedb, signer, context, cfg)
+	}
 	commonTxs := make([]*types.Transaction, 0, txNum)
 
 	// initialise bloom processors
-	bloomProcessors := NewAsyncReceiptBloomGenerator(txNum)
+	var bloomProcessors bloomGenerator
+	if p.SyncBloom {
+		bloomProcessors = NewReceiptBloomGenerator()
+	} else {
+		bloomProcessors = NewAsyncReceiptBloomGenerator(txNum)
+	}
+	// Decorate the receipts before the bloom generator hands them to its worker
+	processors := make([]ReceiptProcessor, 0, len(opts.receiptProcessors)+1)
+	processors = append(processors, opts.receiptProcessors...)
+	if !opts.skipBlooms {
+		processors = append(processors, bloomProcessors)
+	}
 	statedb.MarkFullProcessed()
 
 	// usually do have two tx, one for validator set contract, another for system reward contract.
 	systemTxs := make([]*types.Transaction, 0, 2)
 
+	var (
+		contracts map[common.Address]struct{}
+		failed    int
+		refunded  uint64
+		grossGas  uint64 // Gas used by the executed normal transactions before refunds
+		executed  bool   // Whether a normal transaction was executed
+		rules     = p.config.Rules(blockNumber, context.Random != nil, context.Time)
+	)
+
+	if opcodeGas != nil {
+		// Leave out the system calls made before the transactions
+		clear(opcodeGas.gas)
+	}
 	for i, tx := range block.Transactions() {
+		if err := ctx.Err(); err != nil {
+			// The partial receipts are returned, so their blooms must be complete
+			bloomProcessors.Close()
+			for _, receipt := range receipts {
+				allLogs = append(allLogs, receipt.Logs...)
+			}
+			return statedb, receipts, allLogs, *usedGas, stats, fmt.Errorf("block processing aborted before tx %d: %w", i, err)
+		}
 		if isPoSA {
 			if isSystemTx, err := posa.IsSystemTransaction(tx, block.Header()); err != nil {
-				bloomProcessors.Close()
-				return statedb, nil, nil, 0, err
+				bloomProcessors.Cancel()
+				return statedb, nil, nil, 0, stats, err
 			} else if isSystemTx {
 				systemTxs = append(systemTxs, tx)
 				continue
 			}
 		}
-		if p.config.IsCancun(block.Number(), block.Time()) {
-			if len(systemTxs) > 0 {
-				// systemTxs should be always at the end of block.
-				return statedb, nil, nil, 0, fmt.Errorf("normal tx %d [%v] after systemTx", i, tx.Hash().Hex())
+		// systemTxs should be always at the end of block. This is only enforced from
+		// Cancun on unless explicitly requested, as earlier blocks were accepted
+		// without the check and rejecting them now could fork the chain on replay.
+		if (cfg.StrictSystemTxOrder || p.config.IsCancun(block.Number(), block.Time())) && len(systemTxs) > 0 {
+			bloomProcessors.Cancel()
+			return statedb, nil, nil, 0, stats, fmt.Errorf("%w: normal tx %d [%v] after %d systemTxs", ErrTxAfterSystemTx, i, tx.Hash().Hex(), len(systemTxs))
+		}
+
+		if cfg.RecordInputHashes {
+			stats.InputHashes[i] = crypto.Keccak256Hash(tx.Data())
+		}
+		// Reuse the receipts of pre-applied transactions. Their changes are
+		// contained in statedb, which is only sound for leading transactions, see
+		// ProcessConfig.PreAppliedReceipts.
+		if receipt, ok := cfg.PreAppliedReceipts[tx.Hash()]; ok {
+			if err := p.applyPreApplied(receipt, executed, gp, statedb, tx, i, usedGas); err != nil {
+				bloomProcessors.Cancel()
+				return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+			}
+			p.collectIntermediateRoot(statedb, receipt, blockNumber)
+			*blobGasUsed += receipt.BlobGasUsed
+			if p.OnReceipt != nil {
+				p.OnReceipt(receipt, i)
 			}
+			commonTxs = append(commonTxs, tx)
+			receipts = append(receipts, receipt)
+			continue
 		}
+		executed = true
 
-		msg, err := TransactionToMessage(tx, signer, header.BaseFee)
+		var (
+			start   = time.Now()
+			timings *TxPhaseTimings
+		)
+		msg, err := p.txToMessage(tx, signer, header.BaseFee)
 		if err != nil {
-			bloomProcessors.Close()
-			return statedb, nil, nil, 0, err
+			bloomProcessors.Cancel()
+			return statedb, nil, nil, 0, stats, err
+		}
+		if cfg.PhaseTimings {
+			timings = &TxPhaseTimings{Sender: time.Since(start)}
+		}
+		if p.PreCheck != nil {
+			if err := p.PreCheck(msg); err != nil {
+				bloomProcessors.Cancel()
+				return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+			}
+		}
+		if cfg.MinGasPrice != nil && msg.GasPrice.Cmp(cfg.MinGasPrice) < 0 {
+			bloomProcessors.Cancel()
+			return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w: address %v, gasPrice: %s, minGasPrice: %s",
+				i, tx.Hash().Hex(), ErrGasPriceBelowMinimum, msg.From.Hex(), msg.GasPrice, cfg.MinGasPrice)
+		}
+		if msg.GasLimit < cfg.MinTxGasLimit {
+			bloomProcessors.Cancel()
+			return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w: address %v, gas: %d, minGas: %d",
+				i, tx.Hash().Hex(), ErrGasLimitBelowMinimum, msg.From.Hex(), msg.GasLimit, cfg.MinTxGasLimit)
+		}
+		if cfg.AllowedTargets != nil && !targetAllowed(cfg, msg, statedb) {
+			if cfg.SkipDisallowedTxs {
+				stats.DisallowedTxs = append(stats.DisallowedTxs, i)
+				continue
+			}
+			bloomProcessors.Cancel()
+			target := "contract creation"
+			if msg.To != nil {
+				target = msg.To.Hex()
+			}
+			return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w: address %v, target: %s",
+				i, tx.Hash().Hex(), ErrTargetNotAllowed, msg.From.Hex(), target)
 		}
 		statedb.SetTxContext(tx.Hash(), i)
 
-		receipt, err := applyTransaction(msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv, bloomProcessors)
+		if cfg.CountUniqueContracts && msg.To != nil && statedb.GetCodeSize(*msg.To) > 0 {
+			if contracts == nil {
+				contracts = make(map[common.Address]struct{})
+			}
+			contracts[*msg.To] = struct{}{}
+		}
+		if cfg.FlagCallToEmptyCode && msg.To != nil && len(msg.Data) > 0 && statedb.GetCodeSize(*msg.To) == 0 {
+			stats.EmptyCodeCalls = append(stats.EmptyCodeCalls, i)
+		}
+		if cfg.FlagPrecompileTargets && msg.To != nil && vmenv.IsPrecompile(*msg.To) {
+			stats.PrecompileTargets = append(stats.PrecompileTargets, i)
+		}
+		if cfg.MaxBlockRefund > 0 {
+			budget := cfg.MaxBlockRefund - refunded
+			msg.MaxRefund = &budget
+		}
+		var nonce uint64
+		if cfg.RecordSenderNonces {
+			nonce = statedb.GetNonce(msg.From)
+		}
+		var preState *state.StateDB
+		if cfg.SuggestGasForFailures {
+			preState = statedb.Copy()
+		}
+		var inspect func()
+		if (cfg.AuditSystemReads && isPoSA) || cfg.TrackStorageWrites {
+			inspect = func() {
+				if cfg.AuditSystemReads && isPoSA {
+					if reads := systemReads(statedb, posa); len(reads) > 0 {
+						stats.SystemReads[i] = reads
+					}
+				}
+				if cfg.TrackStorageWrites {
+					stats.trackStorageWrites(i, statedb.TxStorageWrites())
+				}
+			}
+		}
+		var applyStart time.Time
+		if cfg.TxDurations {
+			applyStart = time.Now()
+		}
+		var (
+			receipt *types.Receipt
+			result  *ExecutionResult
+		)
+		if spec != nil {
+			receipt, result, err = spec.apply(i, msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv, inspect, timings, processors...)
+		} else {
+			receipt, result, err = applyTransaction(msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv, p.executor(msg, statedb), cfg.StateCommitment, inspect, timings, processors...)
+		}
+		if cfg.TxDurations {
+			stats.TxDurations[i] = time.Since(applyStart)
+		}
 		if err != nil {
+			bloomProcessors.Cancel()
+			if errors.Is(err, ErrGasLimitReached) {
+				return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w: %w", i, tx.Hash().Hex(), ErrBlockGasExhausted, err)
+			}
+			return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+		}
+		if vmenv.Cancelled() {
+			// The state holds the writes of the aborted transaction, drop it, but
+			// complete the blooms of the partial receipts returned
 			bloomProcessors.Close()
-			return statedb, nil, nil, 0, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+			for _, receipt := range receipts {
+				allLogs = append(allLogs, receipt.Logs...)
+			}
+			return nil, receipts, allLogs, *usedGas - result.UsedGas, stats, fmt.Errorf("block processing aborted in tx %d: %w", i, ctx.Err())
+		}
+		p.collectIntermediateRoot(statedb, receipt, blockNumber)
+		*blobGasUsed += receipt.BlobGasUsed
+		if p.OnReceipt != nil {
+			p.OnReceipt(receipt, i)
+		}
+		if cfg.MaxNewSlotsPerBlock > 0 {
+			if growth := statedb.StorageGrowth(); growth > cfg.MaxNewSlotsPerBlock {
+				bloomProcessors.Cancel()
+				return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w: %d new slots, limit %d",
+					i, tx.Hash().Hex(), ErrStorageGrowthLimit, growth, cfg.MaxNewSlotsPerBlock)
+			}
+		}
+		refunded += result.RefundedGas
+		grossGas += result.UsedGas + result.RefundedGas
+		if cfg.TopLevelCallGas {
+			// The intrinsic gas was charged successfully, so it can't fail here
+			intrinsic, _ := IntrinsicGas(msg.Data, msg.AccessList, msg.To == nil, rules.IsHomestead, rules.IsIstanbul, rules.IsShanghai)
+			stats.TopLevelCallGas[i] = result.UsedGas + result.RefundedGas - intrinsic
+		}
+		if cfg.TrackMaxDepth {
+			stats.MaxDepth[i] = vmenv.MaxDepth()
+		}
+		if result.Failed() {
+			failed++
+			if preState != nil && (errors.Is(result.Err, vm.ErrOutOfGas) || errors.Is(result.Err, vm.ErrCodeStoreOutOfGas)) {
+				if gas, ok := p.suggestGasLimit(*msg, preState, context, block.GasLimit()); ok {
+					stats.SuggestedGas[i] = gas
+				}
+			}
+			if cfg.MaxFailureRate > 0 && float64(failed) > cfg.MaxFailureRate*float64(txNum) {
+				bloomProcessors.Cancel()
+				return statedb, nil, nil, 0, stats, fmt.Errorf("could not apply tx %d [%v]: %w: %d of %d txs failed, limit %v",
+					i, tx.Hash().Hex(), ErrFailureRateExceeded, failed, txNum, cfg.MaxFailureRate)
+			}
+			if cfg.CaptureTxErrors {
+				stats.TxErrors[i] = result.Err
+			}
+		}
+		if cfg.DetectStakingActivity && accessesStakingContracts(statedb.AccessList()) {
+			stats.StakingTxs = append(stats.StakingTxs, tx.Hash())
+		}
+		if cfg.RecordSenderNonces {
+			stats.SenderNonces = append(stats.SenderNonces, SenderNonce{Sender: msg.From, Before: nonce, After: statedb.GetNonce(msg.From)})
+		}
+		if reverted := vmenv.TakeRevertedTransfers(); len(reverted) > 0 {
+			stats.RevertedTransfers[i] = reverted
+		}
+		if cfg.TrackSelfdestructValue {
+			for _, transfer := range statedb.TakeSelfdestructTransfers() {
+				if stats.SelfdestructValue[transfer.Beneficiary] == nil {
+					stats.SelfdestructValue[transfer.Beneficiary] = new(big.Int)
+				}
+				stats.SelfdestructValue[transfer.Beneficiary].Add(stats.SelfdestructValue[transfer.Beneficiary], transfer.Value.ToBig())
+			}
+		}
+		if usage := vmenv.TakeTransientStorageUsage(); usage != nil {
+			stats.TransientStorage[i] = usage
+		}
+		stats.PrecompileGas += vmenv.TakePrecompileGas()
+		if writes := vmenv.TakeRedundantStorageWrites(); len(writes) > 0 {
+			stats.RedundantStorageWrites[i] = writes
+		}
+		for slot, count := range vmenv.TakeSlotAccesses() {
+			stats.SlotHeatmap[slot] += count
+		}
+		opcodeProfile = append(opcodeProfile, vmenv.TakeOpcodeProfile()...)
+		if timings != nil {
+			stats.PhaseTimings = append(stats.PhaseTimings, *timings)
+		}
+		if cfg.LogCountThreshold > 0 && len(receipt.Logs) > cfg.LogCountThreshold {
+			stats.LogHeavyTxs[i] = len(receipt.Logs)
+		}
+		if cfg.OnEffectiveGasPrice != nil {
+			cfg.OnEffectiveGasPrice(i, new(big.Int).Set(msg.GasPrice))
+		}
+		if cfg.GasGriefingRatio > 0 && overProvisioned(msg.GasLimit, result.UsedGas, cfg.GasGriefingRatio) {
+			stats.OverProvisioned = append(stats.OverProvisioned, i)
 		}
 		commonTxs = append(commonTxs, tx)
 		receipts = append(receipts, receipt)
 	}
 	bloomProcessors.Close()
+	stats.UniqueContracts = len(contracts)
+	if opcodeGas != nil {
+		stats.OpcodeGas = opcodeGas.gas
+	}
+	if cfg.CountTxTypes {
+		stats.TxTypes = make(map[uint8]int)
+		for _, tx := range block.Transactions() {
+			stats.TxTypes[tx.Type()]++
+		}
+	}
+	stats.SystemTxs = append([]*types.Transaction(nil), systemTxs...)
+	if cfg.DetectStakingActivity {
+		for _, tx := range systemTxs {
+			if to := tx.To(); to != nil && isStakingContract(*to) {
+				stats.StakingTxs = append(stats.StakingTxs, tx.Hash())
+			}
+		}
+	}
+	stats.BlobGasUsed = *blobGasUsed
+	if cfg.TrackPrecompileGas {
+		stats.ExecutionGas = *usedGas - stats.PrecompileGas
+	}
+	if grossGas > 0 {
+		stats.RefundRatio = float64(refunded) / float64(grossGas)
+	}
+	if spec != nil {
+		stats.ReexecutedTxs = spec.reexecuted
+	}
 
 	// Fail if Shanghai not enabled and len(withdrawals) is non-zero.
 	withdrawals := block.Withdrawals()
 	if len(withdrawals) > 0 && !p.config.IsShanghai(block.Number(), block.Time()) {
-		return nil, nil, nil, 0, errors.New("withdrawals before shanghai")
+		return nil, nil, nil, 0, stats, errors.New("withdrawals before shanghai")
+	}
+	if cfg.SkipFinalize {
+		for _, receipt := range receipts {
+			allLogs = append(allLogs, receipt.Logs...)
+		}
+		return statedb, receipts, allLogs, *usedGas, stats, nil
 	}
 
 	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
+	var (
+		executionGas = *usedGas
+		normalCount  = len(receipts)
+	)
+	var (
+		finalizeStart time.Time
+		systemTimer   systemTxTimer
+	)
+	// The engine sets the tx context of every system transaction before applying
+	// it, which the hooks observing them are attached to.
+	var hooks []func(common.Hash, int)
+	if cfg.TxDurations {
+		finalizeStart = time.Now()
+		hooks = append(hooks, systemTimer.next)
+	}
+	if cfg.OnBeforeSystemTx != nil {
+		pending := make(map[common.Hash]*types.Transaction, len(systemTxs))
+		for _, tx := range systemTxs {
+			pending[tx.Hash()] = tx
+		}
+		hooks = append(hooks, func(hash common.Hash, i int) {
+			if tx, ok := pending[hash]; ok {
+				cfg.OnBeforeSystemTx(i, tx, statedb)
+			}
+		})
+	}
+	if len(hooks) > 0 {
+		statedb.SetTxContextHook(func(hash common.Hash, i int) {
+			for _, hook := range hooks {
+				hook(hash, i)
+			}
+		})
+	}
 	err := p.engine.Finalize(p.bc, header, statedb, &commonTxs, block.Uncles(), withdrawals, &receipts, &systemTxs, usedGas)
+	if len(hooks) > 0 {
+		statedb.SetTxContextHook(nil)
+	}
+	if cfg.TxDurations {
+		systemTimer.stop()
+		stats.SystemTxDurations = append(stats.SystemTxDurations, systemTimer.durations...)
+		stats.FinalizeDuration = time.Since(finalizeStart)
+	}
 	if err != nil {
-		return statedb, receipts, allLogs, *usedGas, err
+		return statedb, receipts, allLogs, *usedGas, stats, err
+	}
+	if p.OnReceipt != nil {
+		for i, receipt := range receipts[normalCount:] {
+			p.OnReceipt(receipt, normalCount+i)
+		}
+	}
+	if cfg.TrackCoinbaseDelta {
+		stats.CoinbaseDelta = new(big.Int).Sub(statedb.GetBalance(context.Coinbase).ToBig(), coinbaseBalance)
+	}
+	if cfg.SystemGasAccounting {
+		stats.reconcileSystemGas(executionGas, receipts[normalCount:])
 	}
-	for _, receipt := range receipts {
+	if cfg.RecordGasCurve {
+		stats.GasCurve = make([]uint64, len(receipts))
+	}
+	for i, receipt := range receipts {
 		allLogs = append(allLogs, receipt.Logs...)
+		if cfg.RecordGasCurve {
+			stats.GasCurve[i] = receipt.CumulativeGasUsed
+		}
+	}
+	stats.LogCount = len(allLogs)
+	if cfg.StrictLogContext {
+		if err := validateLogContext(receipts, blockHash, blockNumber.Uint64()); err != nil {
+			return statedb, receipts, allLogs, *usedGas, stats, err
+		}
 	}
+	if stats.EventSignatures != nil {
+		for _, log := range allLogs {
+			if len(log.Topics) > 0 {
+				stats.EventSignatures[log.Topics[0]]++
+			}
+		}
+	}
+	if cfg.CompactReport {
+		if stats.CompactReport, err = EncodeExecutionReport(receipts); err != nil {
+			return statedb, receipts, allLogs, *usedGas, stats, err
+		}
+	}
+	if cfg.ExecutionFingerprint {
+		if stats.Fingerprint, err = ExecutionFingerprint(commonTxs, receipts, *usedGas); err != nil {
+			return statedb, receipts, allLogs, *usedGas, stats, err
+		}
+	}
+	if cfg.ExportTrieDiff {
+		statedb.Finalise(p.config.IsEIP158(blockNumber))
+		if stats.TrieDiff, err = rlp.EncodeToBytes(statedb.TrieDiff()); err != nil {
+			return statedb, receipts, allLogs, *usedGas, stats, err
+		}
+	}
+	if cfg.ProfileOutput != nil {
+		if err := WriteExecutionProfile(cfg.ProfileOutput, opcodeProfile); err != nil {
+			return statedb, receipts, allLogs, *usedGas, stats, fmt.Errorf("failed to write execution profile: %w", err)
+		}
+	}
+	if cfg.TrackAccountChurn {
+		statedb.Finalise(p.config.IsEIP158(blockNumber))
+		stats.AccountsCreated, stats.AccountsDestroyed = statedb.AccountChurn()
+	}
+	if cfg.CaptureFinalStorage {
+		statedb.Finalise(p.config.IsEIP158(blockNumber))
+		stats.FinalStorage = statedb.FinalStorage()
+	}
+	if cfg.StateCommitment != nil {
+		stats.StateRoot = stateRoot(cfg.StateCommitment, statedb, p.config.IsEIP158(blockNumber))
+	}
+	if gasLimit := block.GasLimit(); gasLimit > 0 {
+		stats.GasUtilization = float64(*usedGas) / float64(gasLimit)
+	}
+	return statedb, receipts, allLogs, *usedGas, stats, nil
+}
+
+// processTwice processes the block on statedb and once more on a copy of its
+// initial state, returning ErrNonDeterministicProcessing if the two runs disagree
+// on the receipts root, the logs or the gas used.
+//
+// The second run only honours the options influencing its outcome: the hooks of
+// the processor and cfg, tracers, receipt processors and statistics are left
+// out of it, so they observe the block once. A DAOHandler changes the state and
+// is thus invoked on both runs.
+func (p *StateProcessor) processTwice(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg ProcessConfig, opts processOptions) (*state.StateDB, types.Receipts, []*types.Log, uint64, *ProcessStats, error) {
+	cfg.DeterminismCheck = false
+
+	shadow := statedb.Copy()
+	statedb, receipts, allLogs, usedGas, stats, err := p.process(ctx, block, statedb, cfg, opts)
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, stats, err
+	}
+	shadowProcessor := *p
+	shadowProcessor.OnReceipt, shadowProcessor.PreCheck = nil, nil
+	shadowProcessor.CollectIntermediateRoots, shadowProcessor.intermediateRoots = false, nil
+
+	shadowOpts := processOptions{signer: opts.signer, skipBlooms: opts.skipBlooms}
+	_, shadowReceipts, shadowLogs, shadowGas, _, err := shadowProcessor.process(ctx, block, shadow, cfg.outcomeConfig(), shadowOpts)
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, stats, fmt.Errorf("%w: second run failed: %v", ErrNonDeterministicProcessing, err)
+	}
+	if usedGas != shadowGas {
+		return statedb, receipts, allLogs, usedGas, stats, fmt.Errorf("%w: gas used mismatch: %d != %d", ErrNonDeterministicProcessing, usedGas, shadowGas)
+	}
+	root, shadowRoot := types.DeriveSha(receipts, trie.NewStackTrie(nil)), types.DeriveSha(shadowReceipts, trie.NewStackTrie(nil))
+	if root != shadowRoot {
+		return statedb, receipts, allLogs, usedGas, stats, fmt.Errorf("%w: receipts root mismatch: %x != %x", ErrNonDeterministicProcessing, root, shadowRoot)
+	}
+	enc, err := rlp.EncodeToBytes(allLogs)
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, stats, err
+	}
+	shadowEnc, err := rlp.EncodeToBytes(shadowLogs)
+	if err != nil {
+		return statedb, receipts, allLogs, usedGas, stats, err
+	}
+	if !bytes.Equal(enc, shadowEnc) {
+		return statedb, receipts, allLogs, usedGas, stats, fmt.Errorf("%w: logs mismatch (%d != %d logs)", ErrNonDeterministicProcessing, len(allLogs), len(shadowLogs))
+	}
+	return statedb, receipts, allLogs, usedGas, stats, nil
+}
+
+// validateLogContext checks that every log of receipts carries the given block
+// hash and number, catching logs attributed to the wrong block by the statedb.
+func validateLogContext(receipts types.Receipts, blockHash common.Hash, blockNumber uint64) error {
+	for i, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			if log.BlockHash != blockHash || log.BlockNumber != blockNumber {
+				return fmt.Errorf("%w: receipt %d log %d references block %d [%x], want %d [%x]", ErrLogContextMismatch, i, log.Index, log.BlockNumber, log.BlockHash, blockNumber, blockHash)
+			}
+		}
+	}
+	return nil
+}
+
+// suggestGasLimit searches the lowest gas limit up to maxGas with which msg, which
+// failed with its own limit, executes successfully on top of the pre-state. The
+// pre-state itself is left untouched.
+func (p *StateProcessor) suggestGasLimit(msg Message, pre *state.StateDB, blockCtx vm.BlockContext, maxGas uint64) (uint64, bool) {
+	msg.MaxRefund = nil
+	succeeds := func(gas uint64) bool {
+		msg.GasLimit = gas
+		evm := vm.NewEVM(blockCtx, NewEVMTxContext(&msg), pre.Copy(), p.config, vm.Config{})
+		result, err := ApplyMessage(evm, &msg, new(GasPool).AddGas(gas))
+		return err == nil && !result.Failed()
+	}
+	// The transaction failed with its own gas limit, so the search starts there
+	lo, hi := msg.GasLimit, maxGas
+	if lo >= hi || !succeeds(hi) {
+		return 0, false
+	}
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		if succeeds(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, true
+}
 
-	return statedb, receipts, allLogs, *usedGas, nil
+// stateRoot finalises statedb and returns its root as computed by commitment, or
+// the root of the Merkle-Patricia trie if commitment is nil.
+func stateRoot(commitment StateCommitment, statedb *state.StateDB, deleteEmptyObjects bool) common.Hash {
+	if commitment == nil {
+		return statedb.IntermediateRoot(deleteEmptyObjects)
+	}
+	statedb.Finalise(deleteEmptyObjects)
+	return commitment.Root(statedb)
 }
 
-func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, tx *types.Transaction, usedGas *uint64, evm *vm.EVM, receiptProcessors ...ReceiptProcessor) (*types.Receipt, error) {
+// applyTransaction applies msg to statedb with executor, computing the pre-Byzantium
+// receipt roots with commitment if non-nil. If inspect is non-nil,
+// it is invoked after the execution but before the state is finalised, i.e. while
+// the changes made by the transaction can still be told apart from the ones
+// before it. If timings is non-nil, the time spent in the individual phases is
+// recorded in it.
+func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, tx *types.Transaction, usedGas *uint64, evm *vm.EVM, executor Executor, commitment StateCommitment, inspect func(), timings *TxPhaseTimings, receiptProcessors ...ReceiptProcessor) (*types.Receipt, *ExecutionResult, error) {
 	// Create a new context to be used in the EVM environment.
 	txContext := NewEVMTxContext(msg)
+	txContext.TxIndex = statedb.TxIndex()
 	evm.Reset(txContext, statedb)
 
 	// Apply the transaction to the current state (included in the env).
-	result, err := ApplyMessage(evm, msg, gp)
+	start := time.Now()
+	result, err := executor.Apply(evm, msg, gp)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if inspect != nil {
+		inspect()
+	}
+	if timings != nil {
+		timings.Execution = time.Since(start)
+		start = time.Now()
 	}
 
 	// Update the state with pending changes.
@@ -171,13 +1058,27 @@ func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, sta
 	if config.IsByzantium(blockNumber) {
 		statedb.Finalise(true)
 	} else {
-		root = statedb.IntermediateRoot(config.IsEIP158(blockNumber)).Bytes()
+		root = stateRoot(commitment, statedb, config.IsEIP158(blockNumber)).Bytes()
 	}
 	*usedGas += result.UsedGas
+	if timings != nil {
+		timings.Finalise = time.Since(start)
+		start = time.Now()
+	}
 
+	receipt := newReceipt(msg, statedb, blockNumber, blockHash, tx, *usedGas, root, result, evm, receiptProcessors...)
+	if timings != nil {
+		timings.Receipt = time.Since(start)
+	}
+	return receipt, result, err
+}
+
+// newReceipt creates the receipt of tx, which was executed as msg by evm with the
+// given result, collecting its logs from statedb.
+func newReceipt(msg *Message, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, tx *types.Transaction, usedGas uint64, root []byte, result *ExecutionResult, evm *vm.EVM, receiptProcessors ...ReceiptProcessor) *types.Receipt {
 	// Create a new receipt for the transaction, storing the intermediate root and gas used
 	// by the tx.
-	receipt := &types.Receipt{Type: tx.Type(), PostState: root, CumulativeGasUsed: *usedGas}
+	receipt := &types.Receipt{Type: tx.Type(), PostState: root, CumulativeGasUsed: usedGas}
 	if result.Failed() {
 		receipt.Status = types.ReceiptStatusFailed
 	} else {
@@ -192,8 +1093,11 @@ func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, sta
 	}
 
 	// If the transaction created a contract, store the creation address in the receipt.
+	// This includes successful deployments of empty code, i.e. an empty init code or
+	// one returning no data: the account is still created and, as EIP-158 starts its
+	// nonce at 1, it is not considered empty and survives the end of the transaction.
 	if msg.To == nil {
-		receipt.ContractAddress = crypto.CreateAddress(evm.TxContext.Origin, tx.Nonce())
+		receipt.ContractAddress = evm.CreateAddress(msg.From, tx.Nonce())
 	}
 
 	// Set the receipt logs and create the bloom filter.
@@ -204,7 +1108,7 @@ func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, sta
 	for _, receiptProcessor := range receiptProcessors {
 		receiptProcessor.Apply(receipt)
 	}
-	return receipt, err
+	return receipt
 }
 
 // ApplyTransaction attempts to apply a transaction to the given state database
@@ -212,9 +1116,18 @@ func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, sta
 // for the transaction, gas used and an error if the transaction failed,
 // indicating the block was invalid.
 func ApplyTransaction(config *params.ChainConfig, bc ChainContext, author *common.Address, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *uint64, cfg vm.Config, receiptProcessors ...ReceiptProcessor) (*types.Receipt, error) {
+	receipt, _, err := ApplyTransactionWithResult(config, bc, author, gp, statedb, header, tx, usedGas, cfg, receiptProcessors...)
+	return receipt, err
+}
+
+// ApplyTransactionWithResult is like ApplyTransaction, but additionally returns
+// the result of executing the transaction, carrying its return data and thus the
+// revert reason of failed ones, e.g. for simulations to surface them without
+// re-executing.
+func ApplyTransactionWithResult(config *params.ChainConfig, bc ChainContext, author *common.Address, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *uint64, cfg vm.Config, receiptProcessors ...ReceiptProcessor) (*types.Receipt, *ExecutionResult, error) {
 	msg, err := TransactionToMessage(tx, types.MakeSigner(config, header.Number, header.Time), header.BaseFee)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// Create a new context to be used in the EVM environment
 	blockContext := NewEVMBlockContext(header, bc, author)
@@ -225,17 +1138,50 @@ func ApplyTransaction(config *params.ChainConfig, bc ChainContext, author *commo
 		vm.EVMInterpreterPool.Put(ite)
 		vm.EvmPool.Put(vmenv)
 	}()
-	return applyTransaction(msg, config, gp, statedb, header.Number, header.Hash(), tx, usedGas, vmenv, receiptProcessors...)
+	return applyTransaction(msg, config, gp, statedb, header.Number, header.Hash(), tx, usedGas, vmenv, EVMExecutor{}, nil, nil, nil, receiptProcessors...)
+}
+
+// ApplyTransactionWithEVM is like ApplyTransaction, but executes tx on evm, which
+// must have been created for the block context of header. The transaction
+// context of evm is reset, allowing one EVM to apply many transactions of the
+// same block without allocating a new one each time. The caller owns evm and is
+// responsible for returning it to the pools.
+func ApplyTransactionWithEVM(config *params.ChainConfig, evm *vm.EVM, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *uint64, receiptProcessors ...ReceiptProcessor) (*types.Receipt, error) {
+	msg, err := TransactionToMessage(tx, types.MakeSigner(config, header.Number, header.Time), header.BaseFee)
+	if err != nil {
+		return nil, err
+	}
+	receipt, _, err := applyTransaction(msg, config, gp, statedb, header.Number, header.Hash(), tx, usedGas, evm, EVMExecutor{}, nil, nil, nil, receiptProcessors...)
+	return receipt, err
+}
+
+// systemCallGas is the default gas available to the system calls applied before
+// the transactions of a block. It is not accounted against the block gas limit.
+const systemCallGas = 30_000_000
+
+// BeaconRootGas returns the gas available to the EIP-4788 system call of the block
+// with the given header: the default system call gas, capped at the gas limit of
+// the header on chains with a lower one. As it only depends on the header, block
+// production and import always agree on it.
+func BeaconRootGas(header *types.Header) uint64 {
+	return min(header.GasLimit, systemCallGas)
 }
 
 // ProcessBeaconBlockRoot applies the EIP-4788 system call to the beacon block root
 // contract. This method is exported to be used in tests.
 func ProcessBeaconBlockRoot(beaconRoot common.Hash, vmenv *vm.EVM, statedb *state.StateDB) {
+	ProcessBeaconBlockRootWithGas(beaconRoot, systemCallGas, vmenv, statedb)
+}
+
+// ProcessBeaconBlockRootWithGas is like ProcessBeaconBlockRoot, but makes gas
+// available to the system call instead of the default, e.g. the gas limit of the
+// header on chains with a lower one, see BeaconRootGas.
+func ProcessBeaconBlockRootWithGas(beaconRoot common.Hash, gas uint64, vmenv *vm.EVM, statedb *state.StateDB) {
 	// If EIP-4788 is enabled, we need to invoke the beaconroot storage contract with
 	// the new root
 	msg := &Message{
 		From:      params.SystemAddress,
-		GasLimit:  30_000_000,
+		GasLimit:  gas,
 		GasPrice:  common.Big0,
 		GasFeeCap: common.Big0,
 		GasTipCap: common.Big0,
@@ -244,6 +1190,25 @@ func ProcessBeaconBlockRoot(beaconRoot common.Hash, vmenv *vm.EVM, statedb *stat
 	}
 	vmenv.Reset(NewEVMTxContext(msg), statedb)
 	statedb.AddAddressToAccessList(params.BeaconRootsAddress)
-	_, _, _ = vmenv.Call(vm.AccountRef(msg.From), *msg.To, msg.Data, 30_000_000, common.U2560)
+	_, _, _ = vmenv.Call(vm.AccountRef(msg.From), *msg.To, msg.Data, gas, common.U2560)
+	statedb.Finalise(true)
+}
+
+// ProcessParentBlockHash applies the EIP-2935 system call to the history storage
+// contract, storing the parent block hash. This method is exported to be used in
+// tests.
+func ProcessParentBlockHash(prevHash common.Hash, vmenv *vm.EVM, statedb *state.StateDB) {
+	msg := &Message{
+		From:      params.SystemAddress,
+		GasLimit:  systemCallGas,
+		GasPrice:  common.Big0,
+		GasFeeCap: common.Big0,
+		GasTipCap: common.Big0,
+		To:        &params.HistoryStorageAddress,
+		Data:      prevHash.Bytes(),
+	}
+	vmenv.Reset(NewEVMTxContext(msg), statedb)
+	statedb.AddAddressToAccessList(params.HistoryStorageAddress)
+	_, _, _ = vmenv.Call(vm.AccountRef(msg.From), *msg.To, msg.Data, systemCallGas, common.U2560)
 	statedb.Finalise(true)
 }
@@ -17,11 +17,19 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/big"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/consensus"
@@ -30,11 +38,16 @@ import (
 	"github.com/ethereum/go-ethereum/consensus/misc/eip1559"
 	"github.com/ethereum/go-ethereum/consensus/misc/eip4844"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/systemcontracts"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb"
+	"github.com/google/pprof/profile"
 	"github.com/holiman/uint256"
 	"golang.org/x/crypto/sha3"
 )
@@ -429,3 +442,4121 @@ func GenerateBadBlock(parent *types.Block, engine consensus.Engine, txs types.Tr
 	}
 	return types.NewBlock(header, txs, nil, receipts, trie.NewStackTrie(nil))
 }
+
+var (
+	// processTestKey is a funded account used by the Process tests below.
+	processTestKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	processTestAddr   = crypto.PubkeyToAddress(processTestKey.PublicKey)
+
+	// processTestValidatorKey signs the system transactions handed to fakePoSA.
+	processTestValidatorKey, _ = crypto.HexToECDSA("0202020202020202020202020202020202020202020202020202002020202020")
+)
+
+// fakePoSA is a minimal consensus.PoSA wrapping another engine. Every transaction
+// sent to systemContract is classified as a system transaction and is applied in
+// Finalize, mirroring the way Parlia handles them.
+type fakePoSA struct {
+	consensus.Engine
+	systemContract common.Address
+}
+
+func newFakePoSA(engine consensus.Engine) *fakePoSA {
+	return &fakePoSA{Engine: engine, systemContract: common.HexToAddress("0x0000000000000000000000000000000000001000")}
+}
+
+func (e *fakePoSA) IsSystemTransaction(tx *types.Transaction, header *types.Header) (bool, error) {
+	// Like Parlia, only zero priced calls into the system contract are system txs
+	return tx.GasPrice().Sign() == 0 && e.IsSystemContract(tx.To()), nil
+}
+
+func (e *fakePoSA) IsSystemContract(to *common.Address) bool {
+	return to != nil && *to == e.systemContract
+}
+
+func (e *fakePoSA) EnoughDistance(chain consensus.ChainReader, header *types.Header) bool {
+	return true
+}
+
+func (e *fakePoSA) IsLocalBlock(header *types.Header) bool { return false }
+
+func (e *fakePoSA) GetJustifiedNumberAndHash(chain consensus.ChainHeaderReader, headers []*types.Header) (uint64, common.Hash, error) {
+	return 0, common.Hash{}, errors.New("not supported")
+}
+
+func (e *fakePoSA) GetFinalizedHeader(chain consensus.ChainHeaderReader, header *types.Header) *types.Header {
+	return nil
+}
+
+func (e *fakePoSA) VerifyVote(chain consensus.ChainHeaderReader, vote *types.VoteEnvelope) error {
+	return nil
+}
+
+func (e *fakePoSA) IsActiveValidatorAt(chain consensus.ChainHeaderReader, header *types.Header, checkVoteKeyFn func(bLSPublicKey *types.BLSPublicKey) bool) bool {
+	return true
+}
+
+func (e *fakePoSA) Finalize(chain consensus.ChainHeaderReader, header *types.Header, statedb *state.StateDB, txs *[]*types.Transaction,
+	uncles []*types.Header, withdrawals []*types.Withdrawal, receipts *[]*types.Receipt, systemTxs *[]*types.Transaction, usedGas *uint64) error {
+	for len(*systemTxs) > 0 {
+		tx := (*systemTxs)[0]
+		statedb.SetTxContext(tx.Hash(), len(*txs))
+		receipt, err := ApplyTransaction(chain.Config(), chain.(ChainContext), &header.Coinbase, new(GasPool).AddGas(tx.Gas()), statedb, header, tx, usedGas, vm.Config{NoBaseFee: true}, NewReceiptBloomGenerator())
+		if err != nil {
+			return err
+		}
+		*txs = append(*txs, tx)
+		*receipts = append(*receipts, receipt)
+		*systemTxs = (*systemTxs)[1:]
+	}
+	return e.Engine.Finalize(chain, header, statedb, txs, uncles, withdrawals, receipts, systemTxs, usedGas)
+}
+
+// systemTx returns a zero priced transaction from the validator to the system
+// contract of engine, which fakePoSA will treat as a system transaction.
+func (e *fakePoSA) systemTx(t *testing.T, config *params.ChainConfig, nonce uint64, data []byte) *types.Transaction {
+	t.Helper()
+	tx, err := types.SignTx(types.NewTransaction(nonce, e.systemContract, new(big.Int), 100000, new(big.Int), data), types.LatestSigner(config), processTestValidatorKey)
+	if err != nil {
+		t.Fatalf("failed to sign system tx: %v", err)
+	}
+	return tx
+}
+
+// newProcessTestChain generates n blocks on top of gspec with gen and imports them
+// into a fresh blockchain, so that any of the returned blocks can be re-processed
+// on top of its parent state obtained via processTestState.
+func newProcessTestChain(t *testing.T, gspec *Genesis, engine consensus.Engine, n int, gen func(int, *BlockGen)) (*BlockChain, []*types.Block) {
+	t.Helper()
+	_, blocks, _ := GenerateChainWithGenesis(gspec, engine, n, gen)
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	t.Cleanup(chain.Stop)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return chain, blocks
+}
+
+// processTestState returns a fresh state database positioned on the parent of block.
+func processTestState(t *testing.T, chain *BlockChain, block *types.Block) *state.StateDB {
+	t.Helper()
+	statedb, err := chain.StateAt(chain.GetBlockByHash(block.ParentHash()).Root())
+	if err != nil {
+		t.Fatalf("failed to open parent state: %v", err)
+	}
+	return statedb
+}
+
+// newProcessTestGenesis returns a genesis on a pre-merge ethash chain with London
+// activated, funding processTestAddr and merging in the given extra accounts.
+func newProcessTestGenesis(alloc types.GenesisAlloc) *Genesis {
+	config := *params.AllEthashProtocolChanges
+	gspec := &Genesis{
+		Config: &config,
+		Alloc: types.GenesisAlloc{
+			processTestAddr: {Balance: big.NewInt(params.Ether)},
+		},
+	}
+	for addr, account := range alloc {
+		gspec.Alloc[addr] = account
+	}
+	return gspec
+}
+
+// newProcessTestCancunGenesis is like newProcessTestGenesis, but on a merged chain
+// with Shanghai activated at genesis and Cancun at the given block time. Chains
+// built from it need to be sealed by the beacon engine.
+func newProcessTestCancunGenesis(alloc types.GenesisAlloc, cancunTime uint64) *Genesis {
+	gspec := newProcessTestGenesis(alloc)
+	gspec.Config.TerminalTotalDifficulty = big.NewInt(0)
+	gspec.Config.TerminalTotalDifficultyPassed = true
+	gspec.Config.ShanghaiTime = new(uint64)
+	gspec.Config.CancunTime = &cancunTime
+	return gspec
+}
+
+// TestProcessMinGasPrice checks that the configured gas price floor rejects
+// underpriced normal transactions while leaving system transactions untouched.
+func TestProcessMinGasPrice(t *testing.T) {
+	var (
+		gspec    = newProcessTestGenesis(nil)
+		signer   = types.LatestSigner(gspec.Config)
+		engine   = newFakePoSA(ethash.NewFaker())
+		gasPrice = big.NewInt(2 * params.GWei)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, big.NewInt(1), params.TxGas, gasPrice, nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	for i, tt := range []struct {
+		floor *big.Int
+		want  error
+	}{
+		{floor: nil},
+		{floor: new(big.Int).Sub(gasPrice, common.Big1)},
+		{floor: gasPrice},
+		{floor: new(big.Int).Add(gasPrice, common.Big1), want: ErrGasPriceBelowMinimum},
+	} {
+		processor := NewStateProcessor(gspec.Config, chain, engine)
+		_, receipts, _, _, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{MinGasPrice: tt.floor})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.want)
+			continue
+		}
+		// The zero priced system transaction must always be exempt from the floor.
+		if err == nil && len(receipts) != 2 {
+			t.Errorf("test %d: receipt count mismatch: have %d, want 2", i, len(receipts))
+		}
+	}
+}
+
+// TestProcessCaptureTxErrors checks that the EVM errors of failed transactions
+// are exposed as real error values when requested.
+func TestProcessCaptureTxErrors(t *testing.T) {
+	var (
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		looper   = common.HexToAddress("0x000000000000000000000000000000000000beef")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0, PUSH1 0, REVERT
+			reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}},
+			// JUMPDEST, PUSH1 0, JUMP
+			looper: {Code: []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{{1}, reverter, looper} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	_, _, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if stats.TxErrors != nil {
+		t.Fatalf("tx errors captured without being requested: %v", stats.TxErrors)
+	}
+	_, receipts, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{CaptureTxErrors: true})
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if len(stats.TxErrors) != 2 {
+		t.Fatalf("captured error count mismatch: have %d, want 2", len(stats.TxErrors))
+	}
+	if receipts[0].Status != types.ReceiptStatusSuccessful {
+		t.Errorf("transfer failed unexpectedly")
+	}
+	if err := stats.TxErrors[1]; !errors.Is(err, vm.ErrExecutionReverted) {
+		t.Errorf("tx 1 error mismatch: have %v, want %v", err, vm.ErrExecutionReverted)
+	}
+	if err := stats.TxErrors[2]; !errors.Is(err, vm.ErrOutOfGas) {
+		t.Errorf("tx 2 error mismatch: have %v, want %v", err, vm.ErrOutOfGas)
+	}
+}
+
+// TestProcessGasUtilization checks the reported block fullness against the gas
+// limit of the processed block.
+func TestProcessGasUtilization(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {
+		// Leave the first block empty, fill the second with two transfers
+		if i == 0 {
+			return
+		}
+		for nonce := uint64(0); nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(nonce, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	for i, block := range blocks {
+		_, _, _, usedGas, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+		if err != nil {
+			t.Fatalf("block %d: failed to process: %v", i, err)
+		}
+		want := float64(block.GasUsed()) / float64(block.GasLimit())
+		if stats.GasUtilization != want {
+			t.Errorf("block %d: utilization mismatch: have %v, want %v", i, stats.GasUtilization, want)
+		}
+		if usedGas != uint64(i)*2*params.TxGas {
+			t.Errorf("block %d: gas used mismatch: have %d, want %d", i, usedGas, uint64(i)*2*params.TxGas)
+		}
+	}
+}
+
+func TestProcessDeterminismCheck(t *testing.T) {
+	var (
+		logger = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{logger, {1}, logger} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	// The hooks and collectors must observe the first run only
+	var onReceipt, onPrice int
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	processor.OnReceipt = func(receipt *types.Receipt, txIndex int) { onReceipt++ }
+	processor.CollectIntermediateRoots = true
+
+	cfg := ProcessConfig{DeterminismCheck: true, OnEffectiveGasPrice: func(txIndex int, price *big.Int) { onPrice++ }}
+
+	_, receipts, logs, usedGas, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), cfg)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(receipts) != 3 || len(logs) != 2 {
+		t.Errorf("unexpected output: have %d receipts and %d logs, want 3 and 2", len(receipts), len(logs))
+	}
+	if usedGas != block.GasUsed() {
+		t.Errorf("gas used mismatch: have %d, want %d", usedGas, block.GasUsed())
+	}
+	if onReceipt != 3 || onPrice != 3 {
+		t.Errorf("hook invocations mismatch: have %d receipts and %d prices, want 3 and 3", onReceipt, onPrice)
+	}
+	if roots := processor.IntermediateRoots(); len(roots) != 3 {
+		t.Errorf("intermediate roots mismatch: have %d, want 3", len(roots))
+	}
+}
+
+func TestProcessDeterminismCheckDAOHandler(t *testing.T) {
+	var (
+		credited = common.Address{0xda, 0x0}
+		logger   = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH20 credited BALANCE PUSH1 0 MSTORE PUSH1 32 PUSH1 0 LOG0
+			logger: {Code: append(append([]byte{byte(vm.PUSH20)}, credited.Bytes()...), byte(vm.BALANCE), byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG0)), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	gspec.Config.DAOForkBlock = big.NewInt(1)
+	gspec.Config.DAOForkSupport = true
+
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, logger, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	// The handler changes the state observed by the transaction, so both runs
+	// have to apply it to agree on the logs
+	var invoked int
+	cfg := ProcessConfig{DeterminismCheck: true, DAOHandler: func(statedb vm.StateDB) {
+		invoked++
+		statedb.AddBalance(credited, uint256.NewInt(42))
+	}}
+	_, _, logs, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), cfg)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if invoked != 2 {
+		t.Errorf("handler invocations mismatch: have %d, want 2", invoked)
+	}
+	if len(logs) != 1 || new(big.Int).SetBytes(logs[0].Data).Uint64() != 42 {
+		t.Errorf("logged balance mismatch: have %v, want 42", logs)
+	}
+}
+
+func TestProcessEventSignatures(t *testing.T) {
+	var (
+		single = common.HexToAddress("0x000000000000000000000000000000000000aaaa")
+		double = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// LOG1(0xaa) followed by an anonymous LOG0
+			single: {Code: []byte{
+				byte(vm.PUSH1), 0xaa, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1),
+				byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0),
+			}, Balance: new(big.Int)},
+			// LOG2(0xcc, 0xbb)
+			double: {Code: []byte{
+				byte(vm.PUSH1), 0xbb, byte(vm.PUSH1), 0xcc, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG2),
+			}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{single, double, single} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+	)
+	_, _, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if stats.EventSignatures != nil {
+		t.Errorf("event signatures collected without being requested: %v", stats.EventSignatures)
+	}
+	_, _, _, _, stats, err = processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{EventSignatures: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[common.Hash]int{
+		common.BigToHash(big.NewInt(0xaa)): 2,
+		common.BigToHash(big.NewInt(0xcc)): 1,
+	}
+	if !reflect.DeepEqual(stats.EventSignatures, want) {
+		t.Errorf("event signatures mismatch: have %v, want %v", stats.EventSignatures, want)
+	}
+}
+
+func TestProcessSkipZeroBeaconRoot(t *testing.T) {
+	var (
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			// TIMESTAMP PUSH1 0 SSTORE, recording every system call
+			params.BeaconRootsAddress: {Code: []byte{byte(vm.TIMESTAMP), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, nil)
+
+	// Attach a zero parent beacon root to the otherwise valid block
+	header := blocks[0].Header()
+	header.ParentBeaconRoot = new(common.Hash)
+	block := types.NewBlockWithHeader(header)
+
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	for _, skip := range []bool{false, true} {
+		statedb, _, _, _, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{SkipZeroBeaconRoot: skip})
+		if err != nil {
+			t.Fatalf("skip %v: failed to process: %v", skip, err)
+		}
+		want := common.Hash{}
+		if !skip {
+			want = common.BigToHash(new(big.Int).SetUint64(block.Time()))
+		}
+		if have := statedb.GetState(params.BeaconRootsAddress, common.Hash{}); have != want {
+			t.Errorf("skip %v: beacon root call mismatch: have %x, want %x", skip, have, want)
+		}
+	}
+}
+
+func TestProcessBeaconRootGas(t *testing.T) {
+	var (
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			// TIMESTAMP PUSH1 0 SSTORE, costing over 22000 gas
+			params.BeaconRootsAddress: {Code: []byte{byte(vm.TIMESTAMP), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, nil)
+
+	// The system call gas follows the gas limit of the header, capped at 30M
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	for _, tt := range []struct {
+		gasLimit uint64
+		stored   bool
+	}{
+		{gasLimit: 100_000_000, stored: true},
+		{gasLimit: 30_000, stored: true},
+		{gasLimit: 10_000, stored: false},
+	} {
+		header := blocks[0].Header()
+		header.ParentBeaconRoot = &common.Hash{0x47, 0x88}
+		header.GasLimit = tt.gasLimit
+		block := types.NewBlockWithHeader(header)
+
+		if want := min(tt.gasLimit, 30_000_000); BeaconRootGas(header) != want {
+			t.Errorf("gas limit %d: system call gas mismatch: have %d, want %d", tt.gasLimit, BeaconRootGas(header), want)
+		}
+		statedb, _, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+		if err != nil {
+			t.Fatalf("gas limit %d: failed to process: %v", tt.gasLimit, err)
+		}
+		want := common.Hash{}
+		if tt.stored {
+			want = common.BigToHash(new(big.Int).SetUint64(block.Time()))
+		}
+		if have := statedb.GetState(params.BeaconRootsAddress, common.Hash{}); have != want {
+			t.Errorf("gas limit %d: beacon root call mismatch: have %x, want %x", tt.gasLimit, have, want)
+		}
+	}
+}
+
+func TestProcessAuditSystemReads(t *testing.T) {
+	var (
+		engine = newFakePoSA(ethash.NewFaker())
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// SLOAD(0), then SSTORE(1, 1) if any calldata is given
+			engine.systemContract: {
+				Code: []byte{
+					byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.CALLDATASIZE), byte(vm.PUSH1), 9, byte(vm.JUMPI), byte(vm.STOP),
+					byte(vm.JUMPDEST), byte(vm.PUSH1), 1, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+				},
+				Storage: map[common.Hash]common.Hash{{}: {0x01}},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine.Engine, 1, func(i int, b *BlockGen) {
+		for nonce, data := range [][]byte{nil, {0x01}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), engine.systemContract, new(big.Int), 50000, b.BaseFee(), data), signer, processTestKey)
+			b.AddTx(tx)
+		}
+		tx, _ := types.SignTx(types.NewTransaction(2, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{AuditSystemReads: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// Both user txs read slot 0, the written slot 1 and the system tx are omitted
+	read := types.AccessList{{Address: engine.systemContract, StorageKeys: []common.Hash{{}}}}
+	want := map[int]types.AccessList{0: read, 1: read}
+	if !reflect.DeepEqual(stats.SystemReads, want) {
+		t.Errorf("system reads mismatch: have %v, want %v", stats.SystemReads, want)
+	}
+}
+
+func TestProcessPhaseTimings(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := uint64(0); nonce < 3; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(nonce, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+	)
+	_, _, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if stats.PhaseTimings != nil {
+		t.Errorf("phase timings collected without being requested: %v", stats.PhaseTimings)
+	}
+	_, receipts, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{PhaseTimings: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(stats.PhaseTimings) != len(receipts) {
+		t.Fatalf("phase timings not aligned with receipts: have %d, want %d", len(stats.PhaseTimings), len(receipts))
+	}
+	for i, timings := range stats.PhaseTimings {
+		if timings.Execution <= 0 {
+			t.Errorf("tx %d: execution time not recorded: %+v", i, timings)
+		}
+	}
+}
+
+func TestProcessMaxNewSlotsPerBlock(t *testing.T) {
+	var (
+		setter = common.HexToAddress("0x000000000000000000000000000000000000a000")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(calldata[32:64], calldata[0:32])
+			setter: {
+				Code:    []byte{byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD), byte(vm.PUSH1), 32, byte(vm.CALLDATALOAD), byte(vm.SSTORE)},
+				Storage: map[common.Hash]common.Hash{common.BigToHash(big.NewInt(9)): common.BigToHash(big.NewInt(1))},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		// Populate slots 1, 2 and 3, clear slot 2 again and overwrite slot 9
+		writes := [][2]int64{{1, 1}, {2, 1}, {2, 0}, {9, 2}, {3, 1}}
+		for nonce, write := range writes {
+			data := append(common.BigToHash(big.NewInt(write[1])).Bytes(), common.BigToHash(big.NewInt(write[0])).Bytes()...)
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), setter, new(big.Int), 50000, b.BaseFee(), data), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+	)
+	for _, tc := range []struct {
+		limit int
+		fail  bool
+	}{
+		{limit: 0},
+		{limit: 1, fail: true},
+		{limit: 2},
+	} {
+		_, _, _, _, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{MaxNewSlotsPerBlock: tc.limit})
+		if tc.fail && !errors.Is(err, ErrStorageGrowthLimit) {
+			t.Errorf("limit %d: expected storage growth error, got %v", tc.limit, err)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("limit %d: failed to process: %v", tc.limit, err)
+		}
+	}
+}
+
+func TestProcessZipped(t *testing.T) {
+	var (
+		logger   = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		engine   = newFakePoSA(ethash.NewFaker())
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+			// PUSH1 0 PUSH1 0 REVERT
+			reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine.Engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{logger, reverter} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	// Place the system tx in between the normal ones, it is executed last
+	var (
+		block = blocks[0]
+		txs   = block.Transactions()
+		sysTx = engine.systemTx(t, gspec.Config, 0, nil)
+	)
+	block = block.WithBody(types.Transactions{txs[0], sysTx, txs[1]}, nil)
+
+	zipped, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessZipped(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := []struct {
+		tx   *types.Transaction
+		logs int
+		err  error
+	}{
+		{tx: txs[0], logs: 1},
+		{tx: txs[1], err: vm.ErrExecutionReverted},
+		{tx: sysTx},
+	}
+	if len(zipped) != len(want) {
+		t.Fatalf("result count mismatch: have %d, want %d", len(zipped), len(want))
+	}
+	for i, res := range zipped {
+		if res.Tx.Hash() != want[i].tx.Hash() || res.Receipt.TxHash != res.Tx.Hash() {
+			t.Errorf("result %d: misaligned: tx %x, receipt for %x, want %x", i, res.Tx.Hash(), res.Receipt.TxHash, want[i].tx.Hash())
+		}
+		if len(res.Logs) != want[i].logs {
+			t.Errorf("result %d: log count mismatch: have %d, want %d", i, len(res.Logs), want[i].logs)
+		}
+		if res.Err != want[i].err {
+			t.Errorf("result %d: error mismatch: have %v, want %v", i, res.Err, want[i].err)
+		}
+	}
+}
+
+func TestProcessGasGriefing(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		// Plain transfers with an exact, a generous and an excessive gas limit
+		for nonce, gas := range []uint64{params.TxGas, 5 * params.TxGas, 20 * params.TxGas} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{1}, new(big.Int), gas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{GasGriefingRatio: 10})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if want := []int{2}; !reflect.DeepEqual(stats.OverProvisioned, want) {
+		t.Errorf("over-provisioned txs mismatch: have %v, want %v", stats.OverProvisioned, want)
+	}
+}
+
+func TestProcessParentTime(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, nil)
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	for i, block := range blocks {
+		_, _, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+		if err != nil {
+			t.Fatalf("block %d: failed to process: %v", i, err)
+		}
+		if want := chain.GetHeaderByHash(block.ParentHash()).Time; stats.ParentTime != want {
+			t.Errorf("block %d: parent time mismatch: have %d, want %d", i, stats.ParentTime, want)
+		}
+	}
+}
+
+func TestProcessOnEffectiveGasPrice(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+		tips   = []int64{3, 1, 2}
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, tip := range tips {
+			tx, _ := types.SignNewTx(processTestKey, signer, &types.DynamicFeeTx{
+				ChainID:   gspec.Config.ChainID,
+				Nonce:     uint64(nonce),
+				To:        &common.Address{1},
+				Gas:       params.TxGas,
+				GasTipCap: big.NewInt(tip),
+				GasFeeCap: new(big.Int).Add(b.BaseFee(), big.NewInt(tip)),
+				Value:     new(big.Int),
+			})
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block   = blocks[0]
+		indices []int
+		prices  []*big.Int
+	)
+	cfg := ProcessConfig{OnEffectiveGasPrice: func(txIndex int, price *big.Int) {
+		indices = append(indices, txIndex)
+		prices = append(prices, price)
+	}}
+	if _, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), cfg); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(prices) != len(tips) {
+		t.Fatalf("reported price count mismatch: have %d, want %d", len(prices), len(tips))
+	}
+	for i, tip := range tips {
+		want := new(big.Int).Add(block.BaseFee(), big.NewInt(tip))
+		if indices[i] != i || prices[i].Cmp(want) != 0 {
+			t.Errorf("report %d: have tx %d at %v, want tx %d at %v", i, indices[i], prices[i], i, want)
+		}
+	}
+}
+
+func TestSumIntrinsicGas(t *testing.T) {
+	var (
+		london   = *params.AllEthashProtocolChanges
+		shanghai = london
+		to       = common.Address{1}
+		initcode = bytes.Repeat([]byte{0xff}, 64)
+	)
+	shanghai.ShanghaiTime = new(uint64)
+
+	txs := types.Transactions{
+		// Plain transfer: 21000
+		types.NewTx(&types.LegacyTx{To: &to, Gas: params.TxGas}),
+		// Calldata with one zero and two non-zero bytes: 21000 + 4 + 2*16
+		types.NewTx(&types.LegacyTx{To: &to, Gas: 50000, Data: []byte{0, 1, 2}}),
+		// Access list with one address and two keys: 21000 + 2400 + 2*1900
+		types.NewTx(&types.AccessListTx{To: &to, Gas: 50000, AccessList: types.AccessList{{Address: to, StorageKeys: []common.Hash{{1}, {2}}}}}),
+		// Contract creation with 64 bytes initcode: 53000 + 64*16 (+ 2*2 for Shanghai)
+		types.NewTx(&types.DynamicFeeTx{Gas: 100000, Data: initcode}),
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1)}, txs, nil, nil, trie.NewStackTrie(nil))
+
+	for _, tc := range []struct {
+		config *params.ChainConfig
+		want   uint64
+	}{
+		{config: &london, want: 21000 + 21036 + 27200 + 54024},
+		{config: &shanghai, want: 21000 + 21036 + 27200 + 54028},
+	} {
+		have, err := SumIntrinsicGas(block, tc.config)
+		if err != nil {
+			t.Fatalf("failed to sum intrinsic gas: %v", err)
+		}
+		if have != tc.want {
+			t.Errorf("intrinsic gas mismatch: have %d, want %d", have, tc.want)
+		}
+	}
+}
+
+// testReceiptWriter is a ReceiptWriter keeping the written receipts in memory.
+type testReceiptWriter struct {
+	written map[common.Hash]types.Receipts
+	err     error
+}
+
+func (w *testReceiptWriter) WriteReceipts(block *types.Block, receipts types.Receipts) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.written[block.Hash()] = receipts
+	return nil
+}
+
+func TestProcessAndStore(t *testing.T) {
+	var (
+		engine = newFakePoSA(ethash.NewFaker())
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine.Engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+		writer    = &testReceiptWriter{written: make(map[common.Hash]types.Receipts)}
+	)
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	_, receipts, _, _, err := processor.ProcessAndStore(block, processTestState(t, chain, block), ProcessConfig{}, writer)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The system tx receipt appended during finalization must be included
+	if stored := writer.written[block.Hash()]; len(stored) != 2 || !reflect.DeepEqual(stored, receipts) {
+		t.Errorf("stored receipts mismatch: have %v, want %v", stored, receipts)
+	}
+	writer.err = errors.New("disk full")
+	if _, _, _, _, err := processor.ProcessAndStore(block, processTestState(t, chain, block), ProcessConfig{}, writer); !errors.Is(err, writer.err) {
+		t.Errorf("writer failure not reported: %v", err)
+	}
+}
+
+func TestProcessCompactReport(t *testing.T) {
+	var (
+		logger   = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+			// PUSH1 0 PUSH1 0 REVERT
+			reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{logger, reverter, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{CompactReport: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	report, err := DecodeExecutionReport(stats.CompactReport)
+	if err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	want := make([]TxReport, len(receipts))
+	for i, receipt := range receipts {
+		want[i] = TxReport{GasUsed: receipt.GasUsed, Status: receipt.Status, LogCount: uint64(len(receipt.Logs))}
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report mismatch: have %+v, want %+v", report, want)
+	}
+	if report[0].LogCount != 1 || report[1].Status != types.ReceiptStatusFailed {
+		t.Errorf("unexpected report content: %+v", report)
+	}
+	// Re-encoding the decoded report must reproduce it byte by byte
+	enc, err := rlp.EncodeToBytes(report)
+	if err != nil {
+		t.Fatalf("failed to encode report: %v", err)
+	}
+	if !bytes.Equal(enc, stats.CompactReport) {
+		t.Errorf("report round trip mismatch: have %x, want %x", enc, stats.CompactReport)
+	}
+}
+
+func TestProcessDAOHandler(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		engine = ethash.NewFaker()
+	)
+	gspec.Config.DAOForkBlock = big.NewInt(2)
+	gspec.Config.DAOForkSupport = true
+
+	chain, blocks := newProcessTestChain(t, gspec, engine, 3, nil)
+	var (
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+		invoked   []uint64
+	)
+	for _, block := range blocks {
+		number := block.NumberU64()
+		cfg := ProcessConfig{DAOHandler: func(statedb vm.StateDB) {
+			invoked = append(invoked, number)
+		}}
+		if _, _, _, _, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), cfg); err != nil {
+			t.Fatalf("block %d: failed to process: %v", number, err)
+		}
+	}
+	if want := []uint64{2}; !reflect.DeepEqual(invoked, want) {
+		t.Errorf("handler invocations mismatch: have %v, want %v", invoked, want)
+	}
+}
+
+// BenchmarkProcessDAOFork measures processing an empty block with and without the
+// DAO hard-fork at it, showing the per-block cost of the DAO fork check left on
+// chains without the fork like BSC.
+func BenchmarkProcessDAOFork(b *testing.B) {
+	for _, tt := range []struct {
+		name      string
+		forkBlock *big.Int
+	}{
+		{"no-dao-fork", nil},
+		{"dao-fork-block", big.NewInt(1)},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			var (
+				gspec  = newProcessTestGenesis(nil)
+				engine = ethash.NewFaker()
+			)
+			gspec.Config.DAOForkBlock = tt.forkBlock
+			gspec.Config.DAOForkSupport = tt.forkBlock != nil
+
+			_, blocks, _ := GenerateChainWithGenesis(gspec, engine, 1, nil)
+			chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, engine, vm.Config{}, nil, nil)
+			if err != nil {
+				b.Fatalf("failed to create tester chain: %v", err)
+			}
+			defer chain.Stop()
+			if _, err := chain.InsertChain(blocks); err != nil {
+				b.Fatalf("failed to insert chain: %v", err)
+			}
+			var (
+				block     = blocks[0]
+				processor = NewStateProcessor(gspec.Config, chain, engine)
+			)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				statedb, err := chain.StateAt(chain.Genesis().Root())
+				if err != nil {
+					b.Fatalf("failed to open parent state: %v", err)
+				}
+				if _, _, _, _, err := processor.Process(block, statedb, vm.Config{}); err != nil {
+					b.Fatalf("failed to process: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// storageWriterCode returns contract code setting the storage slots 1 to n to 1.
+func storageWriterCode(n int) []byte {
+	var code []byte
+	for slot := 1; slot <= n; slot++ {
+		code = append(code, byte(vm.PUSH1), 1, byte(vm.PUSH1), byte(slot), byte(vm.SSTORE))
+	}
+	return code
+}
+
+func TestProcessLargestStorageWriter(t *testing.T) {
+	var (
+		small = common.HexToAddress("0x000000000000000000000000000000000000b002")
+		large = common.HexToAddress("0x000000000000000000000000000000000000b005")
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			small: {Code: storageWriterCode(2), Balance: new(big.Int)},
+			large: {Code: storageWriterCode(5), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{small, large, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 200000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{TrackStorageWrites: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := &StorageWriter{TxIndex: 1, Slots: 5, Contracts: map[common.Address]int{large: 5}}
+	if !reflect.DeepEqual(stats.LargestStorageWriter, want) {
+		t.Errorf("largest storage writer mismatch: have %+v, want %+v", stats.LargestStorageWriter, want)
+	}
+}
+
+func TestProcessFlagCallToEmptyCode(t *testing.T) {
+	var (
+		destroyer = common.HexToAddress("0x000000000000000000000000000000000000d000")
+		logger    = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		gspec     = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0 SELFDESTRUCT
+			destroyer: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.SELFDESTRUCT)}, Balance: new(big.Int)},
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		calls := []struct {
+			to   common.Address
+			data []byte
+		}{
+			{to: destroyer, data: []byte{1}},         // destroys the contract
+			{to: destroyer, data: []byte{1}},         // calls the destroyed contract
+			{to: common.Address{1}, data: []byte{1}}, // calls an EOA
+			{to: common.Address{1}},                  // plain transfer
+			{to: logger, data: []byte{1}},            // calls a live contract
+		}
+		for nonce, call := range calls {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), call.to, new(big.Int), 50000, b.BaseFee(), call.data), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{FlagCallToEmptyCode: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(stats.EmptyCodeCalls, want) {
+		t.Errorf("flagged calls mismatch: have %v, want %v", stats.EmptyCodeCalls, want)
+	}
+}
+
+func TestProcessOpcodeGasModel(t *testing.T) {
+	var (
+		reader = common.HexToAddress("0x000000000000000000000000000000000000c000")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0 SLOAD POP
+			reader: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, reader, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+	)
+	for _, tc := range []struct {
+		model vm.OpcodeGasModel
+		want  uint64
+	}{
+		{model: nil, want: block.GasUsed()},
+		{model: vm.IdentityGasModel, want: block.GasUsed()},
+		// Doubling storage costs charges the cold SLOAD twice
+		{model: vm.OpcodeGasModel{vm.StorageCategory: 2}, want: block.GasUsed() + params.ColdSloadCostEIP2929},
+		// Other categories leave the SLOAD unaffected
+		{model: vm.OpcodeGasModel{vm.LogCategory: 2}, want: block.GasUsed()},
+	} {
+		_, _, _, usedGas, err := processor.Process(block, processTestState(t, chain, block), vm.Config{OpcodeGasModel: tc.model})
+		if err != nil {
+			t.Fatalf("model %v: failed to process: %v", tc.model, err)
+		}
+		if usedGas != tc.want {
+			t.Errorf("model %v: gas used mismatch: have %d, want %d", tc.model, usedGas, tc.want)
+		}
+	}
+}
+
+func TestProcessUniqueContracts(t *testing.T) {
+	var (
+		logger = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		reader = common.HexToAddress("0x000000000000000000000000000000000000c000")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+			reader: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		// Two calls to the logger, one to the reader and a plain transfer
+		for nonce, to := range []common.Address{logger, reader, logger, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+		// A contract creation
+		tx, _ := types.SignTx(types.NewContractCreation(4, new(big.Int), 100000, b.BaseFee(), []byte{byte(vm.STOP)}), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{CountUniqueContracts: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if stats.UniqueContracts != 2 {
+		t.Errorf("unique contract count mismatch: have %d, want 2", stats.UniqueContracts)
+	}
+}
+
+func TestProcessBundle(t *testing.T) {
+	var (
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0 PUSH1 0 REVERT
+			reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, nil)
+	var (
+		block     = blocks[0]
+		header    = block.Header()
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+		statedb   = processTestState(t, chain, block)
+		gp        = new(GasPool).AddGas(block.GasLimit())
+		usedGas   = new(uint64)
+	)
+	transfer := func(nonce uint64) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, common.Address{1}, big.NewInt(1), params.TxGas, header.BaseFee, nil), signer, processTestKey)
+		return tx
+	}
+	// A bundle failing halfway must leave no trace
+	revert, _ := types.SignTx(types.NewTransaction(1, reverter, new(big.Int), 50000, header.BaseFee, nil), signer, processTestKey)
+	if _, _, err := processor.ProcessBundle(header, types.Transactions{transfer(0), revert}, 0, statedb, gp, usedGas, vm.Config{}); !errors.Is(err, ErrBundleReverted) {
+		t.Fatalf("expected bundle revert, got %v", err)
+	}
+	if gp.Gas() != block.GasLimit() || *usedGas != 0 {
+		t.Errorf("gas not reverted: pool %d, used %d", gp.Gas(), *usedGas)
+	}
+	if nonce := statedb.GetNonce(processTestAddr); nonce != 0 {
+		t.Errorf("state not reverted: nonce %d", nonce)
+	}
+	// A successful bundle is applied as a whole
+	result, receipts, err := processor.ProcessBundle(header, types.Transactions{transfer(0), transfer(1)}, 0, statedb, gp, usedGas, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to apply bundle: %v", err)
+	}
+	if len(receipts) != 2 || *usedGas != 2*params.TxGas || gp.Gas() != block.GasLimit()-2*params.TxGas {
+		t.Errorf("unexpected bundle outcome: %d receipts, used %d, pool %d", len(receipts), *usedGas, gp.Gas())
+	}
+	if nonce := result.GetNonce(processTestAddr); nonce != 2 {
+		t.Errorf("bundle state mismatch: nonce %d, want 2", nonce)
+	}
+}
+
+func TestProcessLogCountThreshold(t *testing.T) {
+	var (
+		logger  = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		spammer = common.HexToAddress("0x000000000000000000000000000000000000babe")
+		gspec   = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger:  {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+			spammer: {Code: bytes.Repeat([]byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0)}, 10), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{logger, spammer} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{LogCountThreshold: 5})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if want := map[int]int{1: 10}; !reflect.DeepEqual(stats.LogHeavyTxs, want) {
+		t.Errorf("flagged txs mismatch: have %v, want %v", stats.LogHeavyTxs, want)
+	}
+}
+
+func TestProcessExportTrieDiff(t *testing.T) {
+	var (
+		writer    = common.HexToAddress("0x000000000000000000000000000000000000b003")
+		destroyer = common.HexToAddress("0x000000000000000000000000000000000000d000")
+		gspec     = newProcessTestGenesis(types.GenesisAlloc{
+			writer: {Code: storageWriterCode(3), Balance: new(big.Int)},
+			// PUSH1 0 SELFDESTRUCT
+			destroyer: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.SELFDESTRUCT)}, Storage: map[common.Hash]common.Hash{{1}: {1}}, Balance: big.NewInt(1)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{writer, destroyer, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, big.NewInt(1), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+		// Deploy a contract with the single byte code 0x60
+		initcode := []byte{byte(vm.PUSH1), 0x60, byte(vm.PUSH1), 0, byte(vm.MSTORE8), byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.RETURN)}
+		tx, _ := types.SignTx(types.NewContractCreation(3, new(big.Int), 100000, b.BaseFee(), initcode), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	statedb, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{ExportTrieDiff: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if root := statedb.IntermediateRoot(true); root != block.Root() {
+		t.Fatalf("processed root mismatch: have %x, want %x", root, block.Root())
+	}
+	// Apply the diff to a second copy of the parent state without execution
+	var diff []state.AccountDiff
+	if err := rlp.DecodeBytes(stats.TrieDiff, &diff); err != nil {
+		t.Fatalf("failed to decode diff: %v", err)
+	}
+	replica := processTestState(t, chain, block)
+	replica.ApplyTrieDiff(diff)
+	if root := replica.IntermediateRoot(true); root != block.Root() {
+		t.Errorf("replicated root mismatch: have %x, want %x", root, block.Root())
+	}
+}
+
+func TestProcessSystemGasAccounting(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	_, _, _, usedGas, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if stats.SystemGasUsed != 0 || stats.TotalGasUsed != 0 {
+		t.Errorf("system gas reported without being requested: %d / %d", stats.SystemGasUsed, stats.TotalGasUsed)
+	}
+	_, _, _, accounted, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{SystemGasAccounting: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if accounted != usedGas {
+		t.Errorf("consensus gas used changed: have %d, want %d", accounted, usedGas)
+	}
+	if stats.SystemGasUsed != params.TxGas {
+		t.Errorf("system gas mismatch: have %d, want %d", stats.SystemGasUsed, params.TxGas)
+	}
+	if want := 2 * params.TxGas; stats.TotalGasUsed != want {
+		t.Errorf("total gas mismatch: have %d, want %d", stats.TotalGasUsed, want)
+	}
+}
+
+func TestProcessForkBoundary(t *testing.T) {
+	var (
+		gspec  = newProcessTestCancunGenesis(nil, 20)
+		engine = beacon.New(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 3, func(i int, b *BlockGen) {})
+
+	// Blocks are 10 seconds apart, so Cancun activates at the second block
+	for i, want := range []bool{false, true, false} {
+		block := blocks[i]
+		_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+		if err != nil {
+			t.Fatalf("block %d: failed to process: %v", block.NumberU64(), err)
+		}
+		if stats.ForkBoundary != want {
+			t.Errorf("block %d (time %d): fork boundary mismatch: have %v, want %v", block.NumberU64(), block.Time(), stats.ForkBoundary, want)
+		}
+	}
+}
+
+func TestProcessTrackTransientStorage(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0x000000000000000000000000000000000000e1f3")
+		gspec    = newProcessTestCancunGenesis(types.GenesisAlloc{
+			contract: {
+				// TSTORE(0, 1), TLOAD(0) twice
+				Code: []byte{
+					byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.TSTORE),
+					byte(vm.PUSH1), 0, byte(vm.TLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 0, byte(vm.TLOAD), byte(vm.POP),
+				},
+				Balance: new(big.Int),
+			},
+		}, 0)
+		signer = types.LatestSigner(gspec.Config)
+		engine = beacon.New(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{{1}, contract} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{TrackTransientStorage: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[int]map[common.Address]vm.TransientStorageUsage{
+		1: {contract: {Loads: 2, Stores: 1}},
+	}
+	if !reflect.DeepEqual(stats.TransientStorage, want) {
+		t.Errorf("transient storage usage mismatch: have %v, want %v", stats.TransientStorage, want)
+	}
+}
+
+func TestProcessContractAddressFunc(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		// Deploy a contract with the single byte code 0x60
+		initcode := []byte{byte(vm.PUSH1), 0x60, byte(vm.PUSH1), 0, byte(vm.MSTORE8), byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.RETURN)}
+		tx, _ := types.SignTx(types.NewContractCreation(0, new(big.Int), 100000, b.BaseFee(), initcode), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	// Derive addresses by simply appending the nonce to the creator
+	scheme := func(origin common.Address, nonce uint64) common.Address {
+		return common.BytesToAddress(binary.BigEndian.AppendUint64(origin.Bytes(), nonce))
+	}
+	statedb, receipts, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{ContractAddressFunc: scheme})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := scheme(processTestAddr, 0)
+	if receipts[0].ContractAddress != want {
+		t.Errorf("receipt contract address mismatch: have %x, want %x", receipts[0].ContractAddress, want)
+	}
+	if code := statedb.GetCode(want); !bytes.Equal(code, []byte{0x60}) {
+		t.Errorf("code mismatch at custom address: have %x, want 60", code)
+	}
+	if keccak := crypto.CreateAddress(processTestAddr, 0); statedb.GetCodeSize(keccak) != 0 {
+		t.Errorf("contract deployed at the keccak address %x", keccak)
+	}
+}
+
+func TestProcessGasCurve(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, data := range [][]byte{nil, {1, 2, 3}, {0}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{1}, new(big.Int), 50000, b.BaseFee(), data), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	_, receipts, _, usedGas, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{RecordGasCurve: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(stats.GasCurve) != len(receipts) {
+		t.Fatalf("curve length mismatch: have %d, want %d", len(stats.GasCurve), len(receipts))
+	}
+	for i, receipt := range receipts {
+		if stats.GasCurve[i] != receipt.CumulativeGasUsed {
+			t.Errorf("tx %d: cumulative gas mismatch: have %d, want %d", i, stats.GasCurve[i], receipt.CumulativeGasUsed)
+		}
+	}
+	if last := stats.GasCurve[len(stats.GasCurve)-1]; last != usedGas {
+		t.Errorf("final cumulative gas mismatch: have %d, want %d", last, usedGas)
+	}
+}
+
+func TestProcessRecordSenderNonces(t *testing.T) {
+	var (
+		otherKey, _ = crypto.GenerateKey()
+		otherAddr   = crypto.PubkeyToAddress(otherKey.PublicKey)
+		gspec       = newProcessTestGenesis(types.GenesisAlloc{otherAddr: {Balance: big.NewInt(params.Ether)}})
+		signer      = types.LatestSigner(gspec.Config)
+		engine      = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {
+		keys := []*ecdsa.PrivateKey{processTestKey}
+		if i == 1 {
+			keys = []*ecdsa.PrivateKey{processTestKey, otherKey, processTestKey, processTestKey}
+		}
+		for _, key := range keys {
+			from := crypto.PubkeyToAddress(key.PublicKey)
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(from), common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, key)
+			b.AddTx(tx)
+		}
+	})
+	// Process the second block, so the first sender starts off at a non-zero nonce
+	block := blocks[1]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{RecordSenderNonces: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := []SenderNonce{
+		{Sender: processTestAddr, Before: 1, After: 2},
+		{Sender: otherAddr, Before: 0, After: 1},
+		{Sender: processTestAddr, Before: 2, After: 3},
+		{Sender: processTestAddr, Before: 3, After: 4},
+	}
+	if !reflect.DeepEqual(stats.SenderNonces, want) {
+		t.Errorf("sender nonces mismatch: have %v, want %v", stats.SenderNonces, want)
+	}
+}
+
+func TestProcessMaxFailureRate(t *testing.T) {
+	var (
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0 PUSH1 0 REVERT
+			reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	// Three out of four transactions revert
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{reverter, reverter, reverter, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	for i, tt := range []struct {
+		rate float64
+		want error
+	}{
+		{rate: 0},
+		{rate: 0.75},
+		{rate: 0.9},
+		{rate: 0.5, want: ErrFailureRateExceeded},
+		{rate: 0.1, want: ErrFailureRateExceeded},
+	} {
+		_, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{MaxFailureRate: tt.rate})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.want)
+		}
+	}
+}
+
+// blockContextTracer is an EVMLogger recording the block context of every top
+// level call frame.
+type blockContextTracer struct {
+	contexts []vm.BlockContext
+}
+
+func (t *blockContextTracer) CaptureTxStart(gasLimit uint64)         {}
+func (t *blockContextTracer) CaptureTxEnd(restGas uint64)            {}
+func (t *blockContextTracer) CaptureSystemTxEnd(intrinsicGas uint64) {}
+func (t *blockContextTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.contexts = append(t.contexts, env.Context)
+}
+func (t *blockContextTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {}
+func (t *blockContextTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+func (t *blockContextTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
+func (t *blockContextTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+}
+func (t *blockContextTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
+func TestBlockContextFromReceipt(t *testing.T) {
+	var (
+		gspec  = newProcessTestCancunGenesis(nil, 0)
+		signer = types.LatestSigner(gspec.Config)
+		engine = beacon.New(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0xc0})
+		for j := 0; j < 2; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(processTestAddr), common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[1]
+	tracer := new(blockContextTracer)
+	_, receipts, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{Tracer: tracer})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The first frame is the beacon root system call, skip it
+	if len(tracer.contexts) != len(receipts)+1 {
+		t.Fatalf("traced frame count mismatch: have %d, want %d", len(tracer.contexts), len(receipts)+1)
+	}
+	for i, receipt := range receipts {
+		have, err := BlockContextFromReceipt(receipt, block, chain)
+		if err != nil {
+			t.Fatalf("tx %d: failed to reconstruct context: %v", i, err)
+		}
+		want := tracer.contexts[i+1]
+		if have.Coinbase != want.Coinbase || have.GasLimit != want.GasLimit || have.Time != want.Time ||
+			have.BlockNumber.Cmp(want.BlockNumber) != 0 || have.Difficulty.Cmp(want.Difficulty) != 0 ||
+			have.BaseFee.Cmp(want.BaseFee) != 0 || have.BlobBaseFee.Cmp(want.BlobBaseFee) != 0 ||
+			!reflect.DeepEqual(have.Random, want.Random) {
+			t.Errorf("tx %d: context mismatch: have %+v, want %+v", i, have, want)
+		}
+		if hash := have.GetHash(0); hash != want.GetHash(0) || hash != chain.Genesis().Hash() {
+			t.Errorf("tx %d: ancestor hash mismatch: have %x, want %x", i, hash, want.GetHash(0))
+		}
+	}
+	// Receipts of other blocks must be rejected
+	if _, err := BlockContextFromReceipt(receipts[0], blocks[0], chain); !errors.Is(err, ErrReceiptBlockMismatch) {
+		t.Errorf("foreign receipt error mismatch: have %v, want %v", err, ErrReceiptBlockMismatch)
+	}
+}
+
+func TestProcessMaxInternalCalls(t *testing.T) {
+	// SSTORE(0, 1), followed by CALL(gas/2, self, 0, 0, 0, 0, 0) executed twice
+	store := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+	call := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.ADDRESS), byte(vm.PUSH1), 2, byte(vm.GAS), byte(vm.DIV), byte(vm.CALL), byte(vm.POP),
+	}
+	var (
+		bomb      = common.HexToAddress("0x000000000000000000000000000000000000b0b0")
+		recipient = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		gspec     = newProcessTestGenesis(types.GenesisAlloc{
+			bomb: {Code: append(append(store, call...), call...), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, bomb, new(big.Int), 1000000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+		tx, _ = types.SignTx(types.NewTransaction(1, recipient, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	for i, tt := range []struct {
+		limit   int
+		aborted bool
+	}{
+		{limit: 0},
+		{limit: 1000000},
+		{limit: 10, aborted: true},
+	} {
+		cfg := ProcessConfig{Config: vm.Config{MaxInternalCalls: tt.limit}, CaptureTxErrors: true}
+		statedb, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), cfg)
+		if err != nil {
+			t.Fatalf("test %d: failed to process block: %v", i, err)
+		}
+		// Exceeding the limit aborts the whole call tree, consuming all gas and
+		// reverting the state of the transaction, but not the rest of the block
+		if have := errors.Is(stats.TxErrors[0], vm.ErrInternalCallLimit); have != tt.aborted {
+			t.Errorf("test %d: abort mismatch: have %v (%v), want %v", i, have, stats.TxErrors[0], tt.aborted)
+		}
+		if have := receipts[0].Status == types.ReceiptStatusFailed; have != tt.aborted {
+			t.Errorf("test %d: receipt failure mismatch: have %v, want %v", i, have, tt.aborted)
+		}
+		if tt.aborted && receipts[0].GasUsed != block.Transactions()[0].Gas() {
+			t.Errorf("test %d: gas used mismatch: have %d, want %d", i, receipts[0].GasUsed, block.Transactions()[0].Gas())
+		}
+		if have := statedb.GetState(bomb, common.Hash{}) == (common.Hash{}); have != tt.aborted {
+			t.Errorf("test %d: storage revert mismatch: have %v, want %v", i, have, tt.aborted)
+		}
+		if receipts[1].Status != types.ReceiptStatusSuccessful || statedb.GetBalance(recipient).Uint64() != 1 {
+			t.Errorf("test %d: transfer after the aborted transaction not applied", i)
+		}
+	}
+}
+
+func TestProcessCoinbaseDelta(t *testing.T) {
+	var (
+		otherKey, _ = crypto.GenerateKey()
+		otherAddr   = crypto.PubkeyToAddress(otherKey.PublicKey)
+		gspec       = newProcessTestGenesis(types.GenesisAlloc{otherAddr: {Balance: big.NewInt(params.Ether)}})
+		signer      = types.LatestSigner(gspec.Config)
+		engine      = ethash.NewFaker()
+	)
+	// The coinbase both sends a transaction without tip and receives one with tip
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(processTestAddr)
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+		tx, _ = types.SignTx(types.NewTransaction(0, processTestAddr, big.NewInt(5), params.TxGas, new(big.Int).Mul(b.BaseFee(), common.Big2), nil), signer, otherKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{TrackCoinbaseDelta: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// reward - (value + burnt fee) + (value + tip)
+	fee := new(big.Int).Mul(block.BaseFee(), big.NewInt(int64(params.TxGas)))
+	want := ethash.ConstantinopleBlockReward.ToBig()
+	want.Sub(want, new(big.Int).Add(big.NewInt(1), fee))
+	want.Add(want, new(big.Int).Add(big.NewInt(5), fee))
+	if stats.CoinbaseDelta.Cmp(want) != 0 {
+		t.Errorf("coinbase delta mismatch: have %v, want %v", stats.CoinbaseDelta, want)
+	}
+}
+
+func TestProcessOnColdAccess(t *testing.T) {
+	var (
+		reader = common.HexToAddress("0x000000000000000000000000000000000000c01d")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// SLOAD(1), SLOAD(2), SLOAD(1), SLOAD(3), BALANCE(0xff)
+			reader: {
+				Code: []byte{
+					byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 2, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 3, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 0xff, byte(vm.BALANCE), byte(vm.POP),
+				},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{{1}, reader} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	type access struct {
+		tx   int
+		addr common.Address
+		slot common.Hash
+	}
+	var accesses []access
+	onColdAccess := func(txIndex int, addr common.Address, slot *common.Hash) {
+		a := access{tx: txIndex, addr: addr}
+		if slot != nil {
+			a.slot = *slot
+		}
+		accesses = append(accesses, a)
+	}
+	if _, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{OnColdAccess: onColdAccess}); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := []access{
+		{tx: 1, addr: reader, slot: common.Hash{31: 1}},
+		{tx: 1, addr: reader, slot: common.Hash{31: 2}},
+		{tx: 1, addr: reader, slot: common.Hash{31: 3}},
+		{tx: 1, addr: common.Address{19: 0xff}},
+	}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("cold accesses mismatch: have %v, want %v", accesses, want)
+	}
+}
+
+func TestProcessOnColdAccessReverted(t *testing.T) {
+	var (
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		caller   = common.HexToAddress("0x000000000000000000000000000000000000ca11")
+		call     = []byte{
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+			byte(vm.PUSH2), 0xde, 0xad, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+		}
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			// SLOAD(1), REVERT(0, 0)
+			reverter: {
+				Code:    []byte{byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)},
+				Balance: new(big.Int),
+			},
+			// CALL(gas, reverter, 0, 0, 0, 0, 0) twice
+			caller: {Code: append(append([]byte(nil), call...), call...), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, caller, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	type access struct {
+		addr common.Address
+		slot common.Hash
+	}
+	var accesses []access
+	onColdAccess := func(txIndex int, addr common.Address, slot *common.Hash) {
+		a := access{addr: addr}
+		if slot != nil {
+			a.slot = *slot
+		}
+		accesses = append(accesses, a)
+	}
+	if _, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{OnColdAccess: onColdAccess}); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The slot read in the reverted frames is reported for both calls, as the
+	// revert rolls back its warming, unlike the one of the callee account
+	want := []access{
+		{addr: reverter},
+		{addr: reverter, slot: common.Hash{31: 1}},
+		{addr: reverter, slot: common.Hash{31: 1}},
+	}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("cold accesses mismatch: have %v, want %v", accesses, want)
+	}
+}
+
+func TestProcessMaxBlockRefund(t *testing.T) {
+	var (
+		clearer = common.HexToAddress("0x000000000000000000000000000000000000c1ea")
+		gspec   = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(CALLDATALOAD(0), 0)
+			clearer: {
+				Code:    []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD), byte(vm.SSTORE)},
+				Storage: map[common.Hash]common.Hash{{31: 1}: {31: 1}, {31: 2}: {31: 1}},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	// Both transactions clear a slot, earning a refund of 4800 gas each
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, slot := range []common.Hash{{31: 1}, {31: 2}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), clearer, new(big.Int), 100000, b.BaseFee(), slot[:]), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	_, uncapped, _, uncappedGas, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	_, capped, _, cappedGas, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{MaxBlockRefund: 6000})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The first transaction is refunded in full, the second one only 1200 gas
+	refund := params.SstoreClearsScheduleRefundEIP3529
+	if capped[0].GasUsed != uncapped[0].GasUsed {
+		t.Errorf("first tx gas mismatch: have %d, want %d", capped[0].GasUsed, uncapped[0].GasUsed)
+	}
+	if want := uncapped[1].GasUsed + refund - (6000 - refund); capped[1].GasUsed != want {
+		t.Errorf("second tx gas mismatch: have %d, want %d", capped[1].GasUsed, want)
+	}
+	if want := uncappedGas + 2*refund - 6000; cappedGas != want {
+		t.Errorf("block gas mismatch: have %d, want %d", cappedGas, want)
+	}
+}
+
+func TestProcessTrackSelfdestructValue(t *testing.T) {
+	destroyer := func(beneficiary byte, balance int64) types.Account {
+		// PUSH1 beneficiary SELFDESTRUCT
+		return types.Account{Code: []byte{byte(vm.PUSH1), beneficiary, byte(vm.SELFDESTRUCT)}, Balance: big.NewInt(balance)}
+	}
+	var (
+		d1, d2, d3, d4 = common.Address{19: 0xd1}, common.Address{19: 0xd2}, common.Address{19: 0xd3}, common.Address{19: 0xd4}
+		reverter       = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		gspec          = newProcessTestGenesis(types.GenesisAlloc{
+			d1: destroyer(0xbe, 1),
+			d2: destroyer(0xbe, 2),
+			d3: destroyer(0xbf, 4),
+			d4: destroyer(0xbe, 8),
+			// CALL(gas, d4, 0, 0, 0, 0, 0) REVERT(0, 0)
+			reverter: {
+				Code: []byte{
+					byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+					byte(vm.PUSH1), 0xd4, byte(vm.GAS), byte(vm.CALL),
+					byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT),
+				},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{d1, reverter, d2, d3} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{TrackSelfdestructValue: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The self-destruct of d4 is reverted and must not be counted
+	want := map[common.Address]*big.Int{
+		{19: 0xbe}: big.NewInt(3),
+		{19: 0xbf}: big.NewInt(4),
+	}
+	if !reflect.DeepEqual(stats.SelfdestructValue, want) {
+		t.Errorf("self-destruct value mismatch: have %v, want %v", stats.SelfdestructValue, want)
+	}
+}
+
+// balanceCommitment is a StateCommitment committing to the balance of a
+// single account only.
+type balanceCommitment common.Address
+
+func (c balanceCommitment) Root(statedb vm.StateDB) common.Hash {
+	return statedb.GetBalance(common.Address(c)).Bytes32()
+}
+
+func TestProcessStateCommitment(t *testing.T) {
+	var (
+		// Receipts carry intermediate state roots before Byzantium
+		config = &params.ChainConfig{
+			ChainID:        big.NewInt(1),
+			HomesteadBlock: big.NewInt(0),
+			EIP150Block:    big.NewInt(0),
+			EIP155Block:    big.NewInt(0),
+			EIP158Block:    big.NewInt(0),
+			Ethash:         new(params.EthashConfig),
+		}
+		gspec     = &Genesis{Config: config, Alloc: types.GenesisAlloc{processTestAddr: {Balance: big.NewInt(params.Ether)}}}
+		signer    = types.LatestSigner(config)
+		engine    = ethash.NewFaker()
+		recipient = common.Address{1}
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := uint64(0); nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(nonce, recipient, big.NewInt(1), params.TxGas, big.NewInt(params.GWei), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, receipts, _, _, stats, err := NewStateProcessor(config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{StateCommitment: balanceCommitment(recipient)})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	for i, receipt := range receipts {
+		if want := common.BigToHash(big.NewInt(int64(i + 1))); !bytes.Equal(receipt.PostState, want[:]) {
+			t.Errorf("tx %d: intermediate root mismatch: have %x, want %x", i, receipt.PostState, want)
+		}
+	}
+	if want := common.BigToHash(big.NewInt(2)); stats.StateRoot != want {
+		t.Errorf("state root mismatch: have %x, want %x", stats.StateRoot, want)
+	}
+}
+
+func TestProcessCanonicalizeLogOutput(t *testing.T) {
+	var code []byte
+	for _, topic := range []byte{3, 1, 2} {
+		// LOG1(0, 0, topic)
+		code = append(code, byte(vm.PUSH1), topic, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1))
+	}
+	var (
+		logger = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{logger: {Code: code, Balance: new(big.Int)}})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, logger, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	plain, _, err := processor.ProcessZipped(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	sorted, _, err := processor.ProcessZipped(block, processTestState(t, chain, block), ProcessConfig{CanonicalizeLogOutput: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The consensus output must be unaffected
+	if have, want := types.DeriveSha(types.Receipts{sorted[0].Receipt}, trie.NewStackTrie(nil)), types.DeriveSha(types.Receipts{plain[0].Receipt}, trie.NewStackTrie(nil)); have != want {
+		t.Errorf("receipt root mismatch: have %x, want %x", have, want)
+	}
+	if sorted[0].Receipt.Bloom != plain[0].Receipt.Bloom {
+		t.Error("receipt bloom changed")
+	}
+	for i, log := range sorted[0].Receipt.Logs {
+		if want := (common.Hash{31: []byte{3, 1, 2}[i]}); log.Topics[0] != want || log.Index != uint(i) {
+			t.Errorf("receipt log %d changed: have topic %x at index %d, want %x at %d", i, log.Topics[0], log.Index, want, i)
+		}
+	}
+	// The captured logs must be ordered by topic
+	for i, log := range sorted[0].Logs {
+		if want := (common.Hash{31: byte(i + 1)}); log.Topics[0] != want {
+			t.Errorf("captured log %d: topic mismatch: have %x, want %x", i, log.Topics[0], want)
+		}
+	}
+}
+
+func TestProcessTrackRevertedTransfers(t *testing.T) {
+	var (
+		reverter  = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		forwarder = common.HexToAddress("0x000000000000000000000000000000000000f0f0")
+		gspec     = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0 PUSH1 0 REVERT
+			reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}, Balance: new(big.Int)},
+			// CALL(gas, reverter, 3, 0, 0, 0, 0), ignoring the failure
+			forwarder: {
+				Code: []byte{
+					byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 3,
+					byte(vm.PUSH2), 0xde, 0xad, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+				},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{reverter, forwarder, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, big.NewInt(5), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{TrackRevertedTransfers: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if receipts[1].Status != types.ReceiptStatusSuccessful {
+		t.Fatal("forwarding transaction failed")
+	}
+	want := map[int][]vm.ValueTransfer{
+		0: {{From: processTestAddr, To: reverter, Value: big.NewInt(5)}},
+		1: {{From: forwarder, To: reverter, Value: big.NewInt(3)}},
+	}
+	if !reflect.DeepEqual(stats.RevertedTransfers, want) {
+		t.Errorf("reverted transfers mismatch: have %v, want %v", stats.RevertedTransfers, want)
+	}
+}
+
+func TestProcessWithProof(t *testing.T) {
+	var (
+		target = common.HexToAddress("0x000000000000000000000000000000000000beef")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, target, big.NewInt(7), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	statedb, _, _, _, proof, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithProof(block, processTestState(t, chain, block), ProcessConfig{}, target)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	root := statedb.IntermediateRoot(true)
+	if root != block.Root() {
+		t.Fatalf("state root mismatch: have %x, want %x", root, block.Root())
+	}
+	blob, err := trie.VerifyProof(root, crypto.Keccak256(target.Bytes()), proof.Set())
+	if err != nil {
+		t.Fatalf("failed to verify proof: %v", err)
+	}
+	var account types.StateAccount
+	if err := rlp.DecodeBytes(blob, &account); err != nil {
+		t.Fatalf("failed to decode proven account: %v", err)
+	}
+	if account.Balance.Uint64() != 7 {
+		t.Errorf("proven balance mismatch: have %v, want 7", account.Balance)
+	}
+}
+
+// Tests that deploying empty code records the contract address in the receipt
+// and leaves an existing, codeless account behind post-EIP-158.
+func TestProcessCreateEmptyCode(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+		inits  = [][]byte{
+			nil,
+			// PUSH1 0 PUSH1 0 RETURN
+			{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.RETURN)},
+		}
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, init := range inits {
+			tx, _ := types.SignTx(types.NewContractCreation(uint64(nonce), new(big.Int), 100000, b.BaseFee(), init), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	statedb, receipts, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	for i, receipt := range receipts {
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("deployment %d failed", i)
+		}
+		if want := crypto.CreateAddress(processTestAddr, uint64(i)); receipt.ContractAddress != want {
+			t.Errorf("deployment %d: contract address mismatch: have %x, want %x", i, receipt.ContractAddress, want)
+		}
+		addr := receipt.ContractAddress
+		if !statedb.Exist(addr) {
+			t.Errorf("deployment %d: account does not exist", i)
+		}
+		if nonce := statedb.GetNonce(addr); nonce != 1 {
+			t.Errorf("deployment %d: nonce mismatch: have %d, want 1", i, nonce)
+		}
+		if code := statedb.GetCode(addr); len(code) != 0 {
+			t.Errorf("deployment %d: unexpected code %x", i, code)
+		}
+	}
+}
+
+func TestProcessProfileOutput(t *testing.T) {
+	var (
+		writer    = common.HexToAddress("0x000000000000000000000000000000000000b003")
+		forwarder = common.HexToAddress("0x000000000000000000000000000000000000f0f0")
+		gspec     = newProcessTestGenesis(types.GenesisAlloc{
+			writer: {Code: storageWriterCode(3), Balance: new(big.Int)},
+			// CALL(gas, writer, 0, 0, 0, 0, 0)
+			forwarder: {
+				Code: []byte{
+					byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+					byte(vm.PUSH2), 0xb0, 0x03, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+				},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, forwarder, new(big.Int), 200000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	var out bytes.Buffer
+	if _, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{ProfileOutput: &out}); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if out.Len() == 0 {
+		t.Fatal("empty profile")
+	}
+	prof, err := profile.Parse(&out)
+	if err != nil {
+		t.Fatalf("failed to parse profile: %v", err)
+	}
+	if len(prof.Sample) == 0 {
+		t.Fatal("profile has no samples")
+	}
+	// The storage writes must be attributed to the writer called by the forwarder
+	for _, sample := range prof.Sample {
+		var stack []string
+		for _, loc := range sample.Location {
+			stack = append(stack, loc.Line[0].Function.Name)
+		}
+		if reflect.DeepEqual(stack, []string{"SSTORE", writer.Hex(), forwarder.Hex()}) {
+			if sample.Value[0] != 3 {
+				t.Errorf("SSTORE execution count mismatch: have %d, want 3", sample.Value[0])
+			}
+			return
+		}
+	}
+	t.Error("no SSTORE sample in the writer frame")
+}
+
+func TestProcessStrictLogContext(t *testing.T) {
+	var (
+		emitter = common.HexToAddress("0x000000000000000000000000000000000000e000")
+		gspec   = newProcessTestGenesis(types.GenesisAlloc{
+			// LOG0(0, 0) twice
+			emitter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 3; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), emitter, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, receipts, logs, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{StrictLogContext: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(logs) != 6 {
+		t.Fatalf("log count mismatch: have %d, want 6", len(logs))
+	}
+	for i, log := range logs {
+		if log.BlockHash != block.Hash() || log.BlockNumber != block.NumberU64() {
+			t.Errorf("log %d references block %d [%x], want %d [%x]", i, log.BlockNumber, log.BlockHash, block.NumberU64(), block.Hash())
+		}
+	}
+	// A log attributed to another block must be caught
+	receipts[1].Logs[0].BlockHash = common.Hash{1}
+	if err := validateLogContext(receipts, block.Hash(), block.NumberU64()); !errors.Is(err, ErrLogContextMismatch) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrLogContextMismatch)
+	}
+}
+
+func TestProcessTxToMessageFunc(t *testing.T) {
+	var (
+		recipient  = common.Address{0xaa}
+		redirected = common.Address{0xbb}
+		gspec      = newProcessTestGenesis(types.GenesisAlloc{})
+		signer     = types.LatestSigner(gspec.Config)
+		engine     = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, recipient, big.NewInt(9), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	var converted int
+	processor.TxToMessageFunc = func(tx *types.Transaction, signer types.Signer, baseFee *big.Int) (*Message, error) {
+		converted++
+		msg, err := TransactionToMessage(tx, signer, baseFee)
+		if err != nil {
+			return nil, err
+		}
+		msg.To = &redirected
+		return msg, nil
+	}
+	statedb, _, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if converted != 1 {
+		t.Errorf("conversion count mismatch: have %d, want 1", converted)
+	}
+	if balance := statedb.GetBalance(redirected); balance.Uint64() != 9 {
+		t.Errorf("redirected balance mismatch: have %v, want 9", balance)
+	}
+	if balance := statedb.GetBalance(recipient); !balance.IsZero() {
+		t.Errorf("original recipient balance mismatch: have %v, want 0", balance)
+	}
+}
+
+func TestProcessExportSlotHeatmap(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0x000000000000000000000000000000000000c000")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// SLOAD(1) SLOAD(1) SLOAD(2) SSTORE(1, 7)
+			contract: {
+				Code: []byte{
+					byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 2, byte(vm.SLOAD), byte(vm.POP),
+					byte(vm.PUSH1), 7, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+				},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), contract, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{ExportSlotHeatmap: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[vm.StorageSlot]int{
+		{Address: contract, Slot: common.Hash{31: 1}}: 6,
+		{Address: contract, Slot: common.Hash{31: 2}}: 2,
+	}
+	if !reflect.DeepEqual(stats.SlotHeatmap, want) {
+		t.Errorf("slot heatmap mismatch: have %v, want %v", stats.SlotHeatmap, want)
+	}
+}
+
+func TestProcessOnReceipt(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	var (
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+		streamed  []*types.Receipt
+	)
+	processor.OnReceipt = func(receipt *types.Receipt, txIndex int) {
+		if txIndex != len(streamed) {
+			t.Errorf("receipt %d delivered with index %d", len(streamed), txIndex)
+		}
+		streamed = append(streamed, receipt)
+	}
+	_, receipts, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(streamed) != 3 {
+		t.Fatalf("callback invocation count mismatch: have %d, want 3", len(streamed))
+	}
+	for i := range receipts {
+		if streamed[i] != receipts[i] {
+			t.Errorf("streamed receipt %d differs from the returned one", i)
+		}
+	}
+}
+
+// checkPartialReceipts checks that the receipts returned by an aborted block
+// processing carry complete blooms and that the logs are the ones of them.
+func checkPartialReceipts(t *testing.T, receipts types.Receipts, logs []*types.Log) {
+	t.Helper()
+	var want []*types.Log
+	for i, receipt := range receipts {
+		if bloom := types.CreateBloom(types.Receipts{receipt}); receipt.Bloom != bloom {
+			t.Errorf("receipt %d: bloom mismatch: have %x, want %x", i, receipt.Bloom, bloom)
+		}
+		want = append(want, receipt.Logs...)
+	}
+	if len(want) == 0 {
+		t.Fatal("partial receipts without logs")
+	}
+	if !reflect.DeepEqual(logs, want) {
+		t.Errorf("logs mismatch: have %v, want %v", logs, want)
+	}
+}
+
+func TestProcessWithContextCancel(t *testing.T) {
+	var (
+		logger = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 3; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), logger, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	// Cancel the processing once the first transaction is applied
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	processor.OnReceipt = func(receipt *types.Receipt, txIndex int) { cancel() }
+
+	_, receipts, logs, usedGas, err := processor.ProcessWithContext(ctx, block, processTestState(t, chain, block), ProcessConfig{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if len(receipts) != 1 {
+		t.Fatalf("receipt count mismatch: have %d, want 1", len(receipts))
+	}
+	if usedGas != receipts[0].GasUsed {
+		t.Errorf("partial gas used mismatch: have %d, want %d", usedGas, receipts[0].GasUsed)
+	}
+	checkPartialReceipts(t, receipts, logs)
+}
+
+// cancellingTracer is an EVMLogger cancelling a context at the first JUMP it
+// traces, waiting for the EVM to observe the cancellation before continuing.
+type cancellingTracer struct {
+	blockContextTracer
+	cancel context.CancelFunc
+	env    *vm.EVM
+}
+
+func (t *cancellingTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+}
+func (t *cancellingTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if t.cancel != nil && op == vm.JUMP {
+		t.cancel()
+		t.cancel = nil
+		for !t.env.Cancelled() {
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestProcessWithContextCancelInTx(t *testing.T) {
+	var (
+		logger = common.HexToAddress("0x000000000000000000000000000000000000cafe")
+		looper = common.HexToAddress("0x000000000000000000000000000000000000100f")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// PUSH1 0x2a PUSH1 0 PUSH1 0 LOG1
+			logger: {Code: []byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+			// JUMPDEST PUSH1 0 JUMP
+			looper: {Code: []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{logger, looper, {1}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	// Cancel the processing within the looping second transaction
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := ProcessConfig{Config: vm.Config{Tracer: &cancellingTracer{cancel: cancel}}}
+	statedb, receipts, logs, usedGas, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithContext(ctx, block, processTestState(t, chain, block), cfg)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if statedb != nil {
+		t.Error("state with the partial writes of the aborted transaction returned")
+	}
+	if len(receipts) != 1 {
+		t.Fatalf("receipt count mismatch: have %d, want 1", len(receipts))
+	}
+	if usedGas != receipts[0].GasUsed {
+		t.Errorf("partial gas used mismatch: have %d, want %d", usedGas, receipts[0].GasUsed)
+	}
+	checkPartialReceipts(t, receipts, logs)
+}
+
+func TestProcessSuggestGasForFailures(t *testing.T) {
+	var (
+		writer = common.HexToAddress("0x000000000000000000000000000000000000b001")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			writer: {Code: storageWriterCode(1), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		// The first transaction can not afford the storage write, the second one can
+		for nonce, gas := range []uint64{30000, 100000} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), writer, new(big.Int), gas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{SuggestGasForFailures: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if receipts[0].Status != types.ReceiptStatusFailed {
+		t.Fatal("underfunded transaction succeeded")
+	}
+	// Intrinsic gas, two pushes and a cold zero to non-zero storage write
+	want := map[int]uint64{0: params.TxGas + 2*3 + params.ColdSloadCostEIP2929 + params.SstoreSetGasEIP2200}
+	if !reflect.DeepEqual(stats.SuggestedGas, want) {
+		t.Errorf("suggested gas mismatch: have %v, want %v", stats.SuggestedGas, want)
+	}
+}
+
+func TestProcessExecutionFingerprint(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{1}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	fingerprint := func(block *types.Block) common.Hash {
+		_, receipts, _, usedGas, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{ExecutionFingerprint: true})
+		if err != nil {
+			t.Fatalf("failed to process: %v", err)
+		}
+		want, err := ExecutionFingerprint(block.Transactions(), receipts, usedGas)
+		if err != nil {
+			t.Fatalf("failed to compute fingerprint: %v", err)
+		}
+		if stats.Fingerprint != want {
+			t.Errorf("fingerprint mismatch: have %x, want %x", stats.Fingerprint, want)
+		}
+		return stats.Fingerprint
+	}
+	first := fingerprint(blocks[0])
+	if first == (common.Hash{}) {
+		t.Fatal("fingerprint not set")
+	}
+	if again := fingerprint(blocks[0]); again != first {
+		t.Errorf("fingerprint not stable across runs: %x != %x", again, first)
+	}
+	if other := fingerprint(blocks[1]); other == first {
+		t.Error("different blocks share a fingerprint")
+	}
+}
+
+func TestProcessTxDurations(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	_, _, _, _, stats, err := processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if stats.TxDurations != nil || stats.SystemTxDurations != nil || stats.FinalizeDuration != 0 {
+		t.Error("durations reported without being requested")
+	}
+	_, _, _, _, stats, err = processor.ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{TxDurations: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// Durations are indexed by position, leaving the system transaction at zero
+	if len(stats.TxDurations) != 3 {
+		t.Fatalf("tx duration count mismatch: have %d, want 3", len(stats.TxDurations))
+	}
+	if stats.TxDurations[0] == 0 || stats.TxDurations[1] == 0 || stats.TxDurations[2] != 0 {
+		t.Errorf("tx durations not aligned with the block: %v", stats.TxDurations)
+	}
+	if len(stats.SystemTxDurations) != 1 {
+		t.Fatalf("system tx duration count mismatch: have %d, want 1", len(stats.SystemTxDurations))
+	}
+	if stats.FinalizeDuration < stats.SystemTxDurations[0] {
+		t.Errorf("finalize duration %v shorter than its system tx %v", stats.FinalizeDuration, stats.SystemTxDurations[0])
+	}
+}
+
+func TestProcessTrackAccountChurn(t *testing.T) {
+	var (
+		destructible = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		gspec        = newProcessTestGenesis(types.GenesisAlloc{
+			// SELFDESTRUCT(CALLER)
+			destructible: {Code: []byte{byte(vm.CALLER), byte(vm.SELFDESTRUCT)}, Balance: big.NewInt(1)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(processTestAddr)
+		for nonce, to := range []common.Address{{0x42}, destructible} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, big.NewInt(1), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	statedb, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{TrackAccountChurn: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if statedb.Exist(destructible) {
+		t.Fatal("contract not destructed")
+	}
+	if stats.AccountsCreated != 1 || stats.AccountsDestroyed != 1 {
+		t.Errorf("account churn mismatch: have %d created / %d destroyed, want 1 / 1", stats.AccountsCreated, stats.AccountsDestroyed)
+	}
+}
+
+func TestReplayBaseFeeDrift(t *testing.T) {
+	var (
+		recorder = common.HexToAddress("0x000000000000000000000000000000000000bfee")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(NUMBER, BASEFEE)
+			recorder: {Code: []byte{byte(vm.BASEFEE), byte(vm.NUMBER), byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer   = types.LatestSigner(gspec.Config)
+		engine   = ethash.NewFaker()
+		gasPrice = big.NewInt(2 * params.InitialBaseFee)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 3, func(i int, b *BlockGen) {
+		for nonce := 0; nonce <= i; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(processTestAddr), recorder, new(big.Int), 100000, gasPrice, nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+		statedb   = processTestState(t, chain, blocks[0])
+		frozen    = big.NewInt(params.InitialBaseFee)
+	)
+	drift, err := processor.ReplayBaseFeeDrift(blocks, statedb, ProcessConfig{BaseFeeOverride: frozen})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(drift) != len(blocks) {
+		t.Fatalf("drift length mismatch: have %d, want %d", len(drift), len(blocks))
+	}
+	for i, block := range blocks {
+		// The gas usage does not depend on the base fee, so the fee market must
+		// follow the canonical chain
+		if drift[i].GasUsed != block.GasUsed() {
+			t.Errorf("block %d: gas used mismatch: have %d, want %d", i, drift[i].GasUsed, block.GasUsed())
+		}
+		if drift[i].BaseFee.Cmp(block.BaseFee()) != 0 {
+			t.Errorf("block %d: base fee mismatch: have %v, want %v", i, drift[i].BaseFee, block.BaseFee())
+		}
+		// The execution itself must have seen the frozen base fee
+		if have := statedb.GetState(recorder, common.BigToHash(block.Number())).Big(); have.Cmp(frozen) != 0 {
+			t.Errorf("block %d: executed base fee mismatch: have %v, want %v", i, have, frozen)
+		}
+	}
+}
+
+func TestParallelStateProcessor(t *testing.T) {
+	var (
+		// SSTORE(0, SLOAD(0) + 1)
+		counter = []byte{byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.ADD), byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+		first   = common.HexToAddress("0x000000000000000000000000000000000000c001")
+		second  = common.HexToAddress("0x000000000000000000000000000000000000c002")
+	)
+	tests := []struct {
+		name       string
+		targets    []common.Address
+		reexecuted []int
+	}{
+		{"conflict", []common.Address{first, first}, []int{1}},
+		{"disjoint", []common.Address{first, second}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				keys  = make([]*ecdsa.PrivateKey, len(tt.targets))
+				alloc = types.GenesisAlloc{
+					first:  {Code: counter, Balance: new(big.Int)},
+					second: {Code: counter, Balance: new(big.Int)},
+				}
+			)
+			for i := range keys {
+				keys[i], _ = crypto.GenerateKey()
+				alloc[crypto.PubkeyToAddress(keys[i].PublicKey)] = types.Account{Balance: big.NewInt(params.Ether)}
+			}
+			var (
+				gspec  = newProcessTestGenesis(alloc)
+				signer = types.LatestSigner(gspec.Config)
+				engine = ethash.NewFaker()
+			)
+			chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+				for j, to := range tt.targets {
+					tx, _ := types.SignTx(types.NewTransaction(0, to, new(big.Int), 100000, b.BaseFee(), nil), signer, keys[j])
+					b.AddTx(tx)
+				}
+			})
+			block := blocks[0]
+			cfg := ProcessConfig{ParallelExecution: true}
+
+			serialState, serialReceipts, _, serialGas, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), cfg)
+			if err != nil {
+				t.Fatalf("failed to process serially: %v", err)
+			}
+			parallelState, parallelReceipts, _, parallelGas, stats, err := NewParallelStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), cfg)
+			if err != nil {
+				t.Fatalf("failed to process in parallel: %v", err)
+			}
+			if !reflect.DeepEqual(stats.ReexecutedTxs, tt.reexecuted) {
+				t.Errorf("re-executed txs mismatch: have %v, want %v", stats.ReexecutedTxs, tt.reexecuted)
+			}
+			if parallelGas != serialGas {
+				t.Errorf("gas used mismatch: have %d, want %d", parallelGas, serialGas)
+			}
+			if len(parallelReceipts) != len(serialReceipts) {
+				t.Fatalf("receipt count mismatch: have %d, want %d", len(parallelReceipts), len(serialReceipts))
+			}
+			for i := range serialReceipts {
+				have, _ := parallelReceipts[i].MarshalBinary()
+				want, _ := serialReceipts[i].MarshalBinary()
+				if !bytes.Equal(have, want) {
+					t.Errorf("receipt %d mismatch: have %x, want %x", i, have, want)
+				}
+			}
+			if have, want := parallelState.IntermediateRoot(true), serialState.IntermediateRoot(true); have != want {
+				t.Errorf("state root mismatch: have %v, want %v", have, want)
+			}
+			if have, want := parallelState.IntermediateRoot(true), block.Root(); have != want {
+				t.Errorf("state root differs from block: have %v, want %v", have, want)
+			}
+		})
+	}
+}
+
+func TestProcessPreCheck(t *testing.T) {
+	var (
+		allowedKey, _ = crypto.GenerateKey()
+		allowed       = crypto.PubkeyToAddress(allowedKey.PublicKey)
+		gspec         = newProcessTestGenesis(types.GenesisAlloc{
+			allowed: {Balance: big.NewInt(params.Ether)},
+		})
+		signer     = types.LatestSigner(gspec.Config)
+		engine     = ethash.NewFaker()
+		errBlocked = errors.New("sender blocked")
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for _, key := range []*ecdsa.PrivateKey{allowedKey, processTestKey} {
+			tx, _ := types.SignTx(types.NewTransaction(0, common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	var checked []common.Address
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	processor.PreCheck = func(msg *Message) error {
+		checked = append(checked, msg.From)
+		if msg.From == processTestAddr {
+			return errBlocked
+		}
+		return nil
+	}
+	if _, _, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{}); !errors.Is(err, errBlocked) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errBlocked)
+	}
+	if want := []common.Address{allowed, processTestAddr}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("checked senders mismatch: have %v, want %v", checked, want)
+	}
+}
+
+func TestProcessPreAppliedReceipts(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block   = blocks[0]
+		txs     = block.Transactions()
+		usedGas uint64
+		gp      = new(GasPool).AddGas(block.GasLimit())
+	)
+	// Execute the first transaction upfront, as if done before a crash
+	statedb := processTestState(t, chain, block)
+	statedb.SetTxContext(txs[0].Hash(), 0)
+	cached, err := ApplyTransaction(gspec.Config, chain, nil, gp, statedb, block.Header(), txs[0], &usedGas, vm.Config{}, NewReceiptBloomGenerator())
+	if err != nil {
+		t.Fatalf("failed to apply tx: %v", err)
+	}
+	cfg := ProcessConfig{PreAppliedReceipts: map[common.Hash]*types.Receipt{txs[0].Hash(): cached}}
+	statedb, receipts, _, gas, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, statedb, cfg)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if receipts[0] != cached {
+		t.Error("cached receipt not reused")
+	}
+	if gas != block.GasUsed() {
+		t.Errorf("gas used mismatch: have %d, want %d", gas, block.GasUsed())
+	}
+	if have := types.DeriveSha(receipts, trie.NewStackTrie(nil)); have != block.ReceiptHash() {
+		t.Errorf("receipt root mismatch: have %v, want %v", have, block.ReceiptHash())
+	}
+	if have := statedb.IntermediateRoot(true); have != block.Root() {
+		t.Errorf("state root mismatch: have %v, want %v", have, block.Root())
+	}
+	// Transactions executed after fresh ones can not be skipped
+	cfg = ProcessConfig{PreAppliedReceipts: map[common.Hash]*types.Receipt{txs[1].Hash(): receipts[1]}}
+	if _, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), cfg); !errors.Is(err, ErrInvalidPreAppliedTx) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrInvalidPreAppliedTx)
+	}
+}
+
+func TestCompareProcess(t *testing.T) {
+	var (
+		emitter = common.HexToAddress("0x000000000000000000000000000000000000e017")
+		gspec   = newProcessTestGenesis(types.GenesisAlloc{
+			// LOG0(BASEFEE)
+			emitter: {Code: []byte{byte(vm.BASEFEE), byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG0)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, emitter, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+	)
+	same, err := processor.CompareProcess(block, processTestState(t, chain, block), ProcessConfig{}, ProcessConfig{CaptureTxErrors: true})
+	if err != nil {
+		t.Fatalf("failed to compare: %v", err)
+	}
+	if !same.Equal() {
+		t.Errorf("identical configs differ: %+v", same)
+	}
+	if same.A.Root != block.Root() {
+		t.Errorf("state root mismatch: have %v, want %v", same.A.Root, block.Root())
+	}
+	diff, err := processor.CompareProcess(block, processTestState(t, chain, block), ProcessConfig{}, ProcessConfig{BaseFeeOverride: big.NewInt(1)})
+	if err != nil {
+		t.Fatalf("failed to compare: %v", err)
+	}
+	if diff.Equal() {
+		t.Fatal("differing configs reported equal")
+	}
+	if diff.A.GasUsed != diff.B.GasUsed {
+		t.Errorf("gas used differs: %d != %d", diff.A.GasUsed, diff.B.GasUsed)
+	}
+	if diff.A.Root == diff.B.Root {
+		t.Error("state roots equal despite differing tips")
+	}
+	if want := []int{0}; !reflect.DeepEqual(diff.ReceiptDiffs, want) || !reflect.DeepEqual(diff.LogDiffs, want) {
+		t.Errorf("diff mismatch: receipts %v, logs %v, want %v", diff.ReceiptDiffs, diff.LogDiffs, want)
+	}
+}
+
+func TestProcessIntermediateRoots(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 3; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{byte(nonce + 1)}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	// Compute the expected roots by applying the transactions one by one
+	var (
+		statedb = processTestState(t, chain, block)
+		gp      = new(GasPool).AddGas(block.GasLimit())
+		usedGas uint64
+		want    []common.Hash
+	)
+	for i, tx := range block.Transactions() {
+		statedb.SetTxContext(tx.Hash(), i)
+		if _, err := ApplyTransaction(gspec.Config, chain, nil, gp, statedb, block.Header(), tx, &usedGas, vm.Config{}); err != nil {
+			t.Fatalf("failed to apply tx %d: %v", i, err)
+		}
+		want = append(want, statedb.IntermediateRoot(true))
+	}
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	processor.CollectIntermediateRoots = true
+	if _, _, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{}); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if have := processor.IntermediateRoots(); !reflect.DeepEqual(have, want) {
+		t.Errorf("intermediate roots mismatch: have %v, want %v", have, want)
+	}
+}
+
+func TestProcessRecordInputHashes(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, data := range [][]byte{{0xca, 0xfe}, {0xca, 0xfe}, {0xbe, 0xef}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{0x42}, new(big.Int), 50000, b.BaseFee(), data), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{RecordInputHashes: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(stats.InputHashes) != 3 {
+		t.Fatalf("input hash count mismatch: have %d, want 3", len(stats.InputHashes))
+	}
+	if stats.InputHashes[0] != stats.InputHashes[1] {
+		t.Errorf("identical calldata hashed differently: %v != %v", stats.InputHashes[0], stats.InputHashes[1])
+	}
+	if stats.InputHashes[0] == stats.InputHashes[2] {
+		t.Error("distinct calldata hashed identically")
+	}
+	if want := crypto.Keccak256Hash([]byte{0xca, 0xfe}); stats.InputHashes[0] != want {
+		t.Errorf("input hash mismatch: have %v, want %v", stats.InputHashes[0], want)
+	}
+}
+
+func TestProcessRejectsInterleavedSystemTx(t *testing.T) {
+	// Interleaving is rejected from Cancun on, earlier blocks only if requested
+	tests := []struct {
+		name   string
+		gspec  *Genesis
+		engine *fakePoSA
+		strict bool
+		reject bool
+	}{
+		{"pre-cancun", newProcessTestGenesis(nil), newFakePoSA(ethash.NewFaker()), false, false},
+		{"pre-cancun-strict", newProcessTestGenesis(nil), newFakePoSA(ethash.NewFaker()), true, true},
+		{"post-cancun", newProcessTestCancunGenesis(nil, 0), newFakePoSA(beacon.New(ethash.NewFaker())), false, true},
+		{"post-cancun-strict", newProcessTestCancunGenesis(nil, 0), newFakePoSA(beacon.New(ethash.NewFaker())), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := types.LatestSigner(tt.gspec.Config)
+			chain, blocks := newProcessTestChain(t, tt.gspec, tt.engine, 1, func(i int, b *BlockGen) {
+				for nonce := 0; nonce < 2; nonce++ {
+					tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+					b.AddTx(tx)
+				}
+			})
+			var (
+				block = blocks[0]
+				txs   = block.Transactions()
+			)
+			block = block.WithBody(types.Transactions{txs[0], tt.engine.systemTx(t, tt.gspec.Config, 0, nil), txs[1]}, nil)
+			_, _, _, _, err := NewStateProcessor(tt.gspec.Config, chain, tt.engine).ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{StrictSystemTxOrder: tt.strict})
+			if have := errors.Is(err, ErrTxAfterSystemTx); have != tt.reject {
+				t.Errorf("rejection mismatch: have %v (%v), want %v", have, err, tt.reject)
+			}
+			if tt.reject && err != nil && (!strings.Contains(err.Error(), "normal tx 2 ") || !strings.Contains(err.Error(), "after 1 systemTxs")) {
+				t.Errorf("offending index or system tx count missing from error: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessTrackPrecompileGas(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+		modexp = common.BytesToAddress([]byte{5})
+
+		// 2048 bit base and modulus with a 256 bit exponent of all ones
+		input = bytes.Join([][]byte{
+			common.LeftPadBytes([]byte{1, 0}, 32), // base length
+			common.LeftPadBytes([]byte{32}, 32),   // exponent length
+			common.LeftPadBytes([]byte{1, 0}, 32), // modulus length
+			bytes.Repeat([]byte{0xff}, 256),       // base
+			bytes.Repeat([]byte{0xff}, 32),        // exponent
+			bytes.Repeat([]byte{0xfe}, 256),       // modulus
+		}, nil)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{modexp, {0x42}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 500000, b.BaseFee(), input), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, receipts, _, usedGas, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{TrackPrecompileGas: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if receipts[0].Status != types.ReceiptStatusSuccessful {
+		t.Fatal("modexp call failed")
+	}
+	// The first transaction spends all but its intrinsic gas in the precompile
+	intrinsic, err := IntrinsicGas(input, nil, false, true, true, true)
+	if err != nil {
+		t.Fatalf("failed to compute intrinsic gas: %v", err)
+	}
+	if want := receipts[0].GasUsed - intrinsic; stats.PrecompileGas != want {
+		t.Errorf("precompile gas mismatch: have %d, want %d", stats.PrecompileGas, want)
+	}
+	if stats.PrecompileGas <= stats.ExecutionGas {
+		t.Errorf("modexp gas %d not dominating execution gas %d", stats.PrecompileGas, stats.ExecutionGas)
+	}
+	if stats.PrecompileGas+stats.ExecutionGas != usedGas {
+		t.Errorf("gas split mismatch: %d + %d != %d", stats.PrecompileGas, stats.ExecutionGas, usedGas)
+	}
+}
+
+func TestProcessSkipFinalize(t *testing.T) {
+	var (
+		gspec    = newProcessTestGenesis(nil)
+		signer   = types.LatestSigner(gspec.Config)
+		engine   = ethash.NewFaker()
+		coinbase = common.Address{0xc0}
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(coinbase)
+		// Pay exactly the base fee, leaving no tip to the coinbase
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	statedb, receipts, _, usedGas, err := processor.ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{SkipFinalize: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if balance := statedb.GetBalance(coinbase); !balance.IsZero() {
+		t.Errorf("coinbase rewarded: balance %v", balance)
+	}
+	if len(receipts) != 1 || usedGas != block.GasUsed() {
+		t.Errorf("outcome mismatch: have %d receipts / %d gas, want 1 / %d", len(receipts), usedGas, block.GasUsed())
+	}
+	statedb, _, _, _, err = processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if statedb.GetBalance(coinbase).IsZero() {
+		t.Error("coinbase not rewarded without SkipFinalize")
+	}
+}
+
+func TestProcessRandaoOverride(t *testing.T) {
+	var (
+		recorder = common.HexToAddress("0x000000000000000000000000000000000000da0a")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(0, PREVRANDAO)
+			recorder: {Code: []byte{byte(vm.PREVRANDAO), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+		randao = common.HexToHash("0x5eed")
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, recorder, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	statedb, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{RandaoOverride: &randao})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if have := statedb.GetState(recorder, common.Hash{}); have != randao {
+		t.Errorf("PREVRANDAO mismatch: have %v, want %v", have, randao)
+	}
+}
+
+func TestProcessSystemTxs(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	var (
+		block = blocks[0]
+		// Calldata standing in for a validator set update
+		update = engine.systemTx(t, gspec.Config, 0, common.FromHex("0x3b071dcc"))
+	)
+	block = block.WithBody(append(block.Transactions(), update), nil)
+
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(stats.SystemTxs) != 1 || stats.SystemTxs[0].Hash() != update.Hash() {
+		t.Fatalf("system txs mismatch: have %v, want [%v]", stats.SystemTxs, update.Hash())
+	}
+	// The system transaction is applied in Finalize, after the normal ones
+	if receipts[0].TxHash == update.Hash() || receipts[1].TxHash != update.Hash() {
+		t.Errorf("system tx receipt misplaced: %v, %v", receipts[0].TxHash, receipts[1].TxHash)
+	}
+}
+
+func TestProcessBlobGasUsed(t *testing.T) {
+	var (
+		gspec  = newProcessTestCancunGenesis(nil, 0)
+		signer = types.LatestSigner(gspec.Config)
+		engine = beacon.New(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {})
+	block := blocks[0]
+
+	var txs types.Transactions
+	for nonce, blobs := range []int{1, 3} {
+		hashes := make([]common.Hash, blobs)
+		for i := range hashes {
+			hashes[i] = common.Hash{0x01, byte(i)} // versioned KZG hash
+		}
+		tx, err := types.SignTx(types.NewTx(&types.BlobTx{
+			ChainID:    uint256.MustFromBig(gspec.Config.ChainID),
+			Nonce:      uint64(nonce),
+			GasTipCap:  new(uint256.Int),
+			GasFeeCap:  uint256.MustFromBig(block.BaseFee()),
+			Gas:        params.TxGas,
+			To:         common.Address{0x42},
+			Value:      new(uint256.Int),
+			BlobFeeCap: uint256.NewInt(params.GWei),
+			BlobHashes: hashes,
+		}), signer, processTestKey)
+		if err != nil {
+			t.Fatalf("failed to sign blob tx: %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	plain, _ := types.SignTx(types.NewTransaction(2, common.Address{0x42}, new(big.Int), params.TxGas, block.BaseFee(), nil), signer, processTestKey)
+	block = block.WithBody(append(txs, plain), nil)
+
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if receipts[2].BlobGasUsed != 0 {
+		t.Errorf("plain tx used blob gas: %d", receipts[2].BlobGasUsed)
+	}
+	if want := uint64(4 * params.BlobTxBlobGasPerBlob); stats.BlobGasUsed != want {
+		t.Errorf("blob gas used mismatch: have %d, want %d", stats.BlobGasUsed, want)
+	}
+}
+
+func TestProcessCaptureFinalStorage(t *testing.T) {
+	var (
+		store = common.HexToAddress("0x000000000000000000000000000000000000570e")
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(0, CALLDATALOAD(0))
+			store: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, value := range []byte{1, 2} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), store, new(big.Int), 100000, b.BaseFee(), common.LeftPadBytes([]byte{value}, 32)), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{CaptureFinalStorage: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[common.Address]map[common.Hash]common.Hash{
+		store: {{}: common.BigToHash(big.NewInt(2))},
+	}
+	if !reflect.DeepEqual(stats.FinalStorage, want) {
+		t.Errorf("final storage mismatch: have %v, want %v", stats.FinalStorage, want)
+	}
+}
+
+func TestProcessWithSigner(t *testing.T) {
+	var (
+		gspec     = newProcessTestGenesis(nil)
+		oldSigner = types.LatestSigner(gspec.Config)
+		engine    = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), oldSigner, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	// Replay under a config with a different chain id, invalidating the signatures
+	config := *gspec.Config
+	config.ChainID = new(big.Int).Add(gspec.Config.ChainID, common.Big1)
+	processor := NewStateProcessor(&config, chain, engine)
+
+	if _, _, _, _, err := processor.ProcessWithSigner(block, processTestState(t, chain, block), ProcessConfig{}, nil); !errors.Is(err, types.ErrInvalidChainId) {
+		t.Errorf("derived signer error mismatch: have %v, want %v", err, types.ErrInvalidChainId)
+	}
+	statedb, _, _, _, err := processor.ProcessWithSigner(block, processTestState(t, chain, block), ProcessConfig{}, oldSigner)
+	if err != nil {
+		t.Fatalf("failed to process with old signer: %v", err)
+	}
+	if nonce := statedb.GetNonce(processTestAddr); nonce != 1 {
+		t.Errorf("sender nonce mismatch: have %d, want 1", nonce)
+	}
+}
+
+func TestProcessDetectStakingActivity(t *testing.T) {
+	var (
+		gspec    = newProcessTestGenesis(nil)
+		signer   = types.LatestSigner(gspec.Config)
+		engine   = newFakePoSA(ethash.NewFaker())
+		stakeHub = common.HexToAddress(systemcontracts.StakeHubContract)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{{0x42}, stakeHub} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, big.NewInt(1), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block  = blocks[0]
+		txs    = block.Transactions()
+		update = engine.systemTx(t, gspec.Config, 0, nil) // sent to the validator set contract
+	)
+	block = block.WithBody(append(txs, update), nil)
+
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{DetectStakingActivity: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if want := []common.Hash{txs[1].Hash(), update.Hash()}; !reflect.DeepEqual(stats.StakingTxs, want) {
+		t.Errorf("staking txs mismatch: have %v, want %v", stats.StakingTxs, want)
+	}
+}
+
+// TestProcessMinTxGasLimit checks that block processing rejects normal
+// transactions below the gas limit floor while exempting system transactions.
+func TestProcessMinTxGasLimit(t *testing.T) {
+	var (
+		gspec    = newProcessTestGenesis(nil)
+		signer   = types.LatestSigner(gspec.Config)
+		engine   = newFakePoSA(ethash.NewFaker())
+		gasLimit = uint64(200000)
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, big.NewInt(1), gasLimit, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+	// The system transaction's gas limit of 100000 is below all non-zero floors
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	for i, tt := range []struct {
+		floor uint64
+		want  error
+	}{
+		{floor: 0},
+		{floor: gasLimit},
+		{floor: gasLimit + 1, want: ErrGasLimitBelowMinimum},
+	} {
+		_, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), ProcessConfig{MinTxGasLimit: tt.floor})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.want)
+		}
+	}
+}
+
+func TestProcessBlockGasExhausted(t *testing.T) {
+	var (
+		looper = common.HexToAddress("0x000000000000000000000000000000000000beef")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// JUMPDEST, PUSH1 0, JUMP
+			looper: {Code: []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {})
+	block := blocks[0]
+
+	// Pack transactions burning all their gas until they exceed the block gas limit
+	var (
+		txs    types.Transactions
+		packed uint64
+	)
+	for nonce := uint64(0); packed <= block.GasLimit(); nonce++ {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, looper, new(big.Int), block.GasLimit()/4, block.BaseFee(), nil), signer, processTestKey)
+		txs = append(txs, tx)
+		packed += tx.Gas()
+	}
+	block = block.WithBody(txs, nil)
+
+	_, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{})
+	if !errors.Is(err, ErrBlockGasExhausted) || !errors.Is(err, ErrGasLimitReached) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrBlockGasExhausted)
+	}
+}
+
+// sentinelReceiptProcessor marks every receipt it is applied to with a sentinel
+// effective gas price.
+type sentinelReceiptProcessor struct {
+	applied int
+}
+
+func (p *sentinelReceiptProcessor) Apply(receipt *types.Receipt) {
+	receipt.EffectiveGasPrice = big.NewInt(0xdead)
+	p.applied++
+}
+
+func TestProcessReceiptProcessors(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 3; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	decorator := new(sentinelReceiptProcessor)
+	_, receipts, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithReceiptProcessors(block, processTestState(t, chain, block), ProcessConfig{}, decorator)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if decorator.applied != 3 {
+		t.Errorf("processor invocation count mismatch: have %d, want 3", decorator.applied)
+	}
+	for i, receipt := range receipts[:3] {
+		if receipt.EffectiveGasPrice == nil || receipt.EffectiveGasPrice.Int64() != 0xdead {
+			t.Errorf("receipt %d not decorated", i)
+		}
+		if receipt.Bloom != types.CreateBloom(types.Receipts{receipt}) {
+			t.Errorf("receipt %d bloom mismatch", i)
+		}
+	}
+}
+
+func TestProcessRootOnly(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), common.Address{byte(nonce + 1)}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	var (
+		block     = blocks[0]
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+	)
+	root, err := processor.ProcessRootOnly(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process root only: %v", err)
+	}
+	statedb, _, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if want := statedb.IntermediateRoot(true); root != want {
+		t.Errorf("root mismatch: have %v, want %v", root, want)
+	}
+	if root != block.Root() {
+		t.Errorf("root differs from block: have %v, want %v", root, block.Root())
+	}
+}
+
+func TestProcessFlagRedundantStorageWrites(t *testing.T) {
+	var (
+		writer = common.HexToAddress("0x000000000000000000000000000000000000b001")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(1, 1) twice, the second one being redundant
+			writer: {Code: append(storageWriterCode(1), storageWriterCode(1)...), Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{{0x42}, writer} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{FlagRedundantStorageWrites: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[int][]vm.StorageSlot{
+		1: {{Address: writer, Slot: common.BigToHash(common.Big1)}},
+	}
+	if !reflect.DeepEqual(stats.RedundantStorageWrites, want) {
+		t.Errorf("redundant writes mismatch: have %v, want %v", stats.RedundantStorageWrites, want)
+	}
+}
+
+func TestProcessNewBlockContext(t *testing.T) {
+	var (
+		recorder = common.HexToAddress("0x000000000000000000000000000000000000b10c")
+		gspec    = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(0, BLOCKHASH(0))
+			recorder: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.BLOCKHASH), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+		fixed  = common.HexToHash("0xb10cb10c")
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, recorder, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	processor.NewBlockContext = func(header *types.Header, chain ChainContext, author *common.Address) vm.BlockContext {
+		context := NewEVMBlockContext(header, chain, author)
+		context.GetHash = func(uint64) common.Hash { return fixed }
+		return context
+	}
+	statedb, _, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if have := statedb.GetState(recorder, common.Hash{}); have != fixed {
+		t.Errorf("BLOCKHASH mismatch: have %v, want %v", have, fixed)
+	}
+}
+
+func TestProcessTxTypes(t *testing.T) {
+	var (
+		gspec  = newProcessTestCancunGenesis(nil, 0)
+		signer = types.LatestSigner(gspec.Config)
+		engine = beacon.New(ethash.NewFaker())
+		to     = common.Address{0x42}
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {})
+	block := blocks[0]
+
+	txdata := []types.TxData{
+		&types.LegacyTx{Nonce: 0, GasPrice: block.BaseFee(), Gas: params.TxGas, To: &to, Value: new(big.Int)},
+		&types.LegacyTx{Nonce: 1, GasPrice: block.BaseFee(), Gas: params.TxGas, To: &to, Value: new(big.Int)},
+		&types.AccessListTx{ChainID: gspec.Config.ChainID, Nonce: 2, GasPrice: block.BaseFee(), Gas: params.TxGas, To: &to, Value: new(big.Int)},
+		&types.DynamicFeeTx{ChainID: gspec.Config.ChainID, Nonce: 3, GasTipCap: new(big.Int), GasFeeCap: block.BaseFee(), Gas: params.TxGas, To: &to, Value: new(big.Int)},
+		&types.BlobTx{
+			ChainID:    uint256.MustFromBig(gspec.Config.ChainID),
+			Nonce:      4,
+			GasTipCap:  new(uint256.Int),
+			GasFeeCap:  uint256.MustFromBig(block.BaseFee()),
+			Gas:        params.TxGas,
+			To:         to,
+			Value:      new(uint256.Int),
+			BlobFeeCap: uint256.NewInt(params.GWei),
+			BlobHashes: []common.Hash{{0x01}},
+		},
+	}
+	var txs types.Transactions
+	for _, data := range txdata {
+		tx, err := types.SignTx(types.NewTx(data), signer, processTestKey)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	block = block.WithBody(txs, nil)
+
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{CountTxTypes: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[uint8]int{
+		types.LegacyTxType:     2,
+		types.AccessListTxType: 1,
+		types.DynamicFeeTxType: 1,
+		types.BlobTxType:       1,
+	}
+	if !reflect.DeepEqual(stats.TxTypes, want) {
+		t.Errorf("tx type distribution mismatch: have %v, want %v", stats.TxTypes, want)
+	}
+}
+
+func TestProcessReusable(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {})
+	var (
+		processor = NewStateProcessor(gspec.Config, chain, engine)
+		parent    = processTestState(t, chain, blocks[0])
+		root      = parent.IntermediateRoot(true)
+	)
+	// Process two competing candidates for the same height against one parent
+	for i, value := range []int64{1, 2} {
+		header := blocks[0].Header()
+		header.Extra = []byte{byte(i)}
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{0x42}, big.NewInt(value), params.TxGas, header.BaseFee, nil), signer, processTestKey)
+		candidate := types.NewBlockWithHeader(header).WithBody(types.Transactions{tx}, nil)
+
+		statedb, receipts, _, _, err := processor.ProcessReusable(candidate, parent, ProcessConfig{})
+		if err != nil {
+			t.Fatalf("candidate %d: failed to process: %v", i, err)
+		}
+		if have := parent.IntermediateRoot(true); have != root {
+			t.Fatalf("candidate %d: parent root changed: have %v, want %v", i, have, root)
+		}
+		if balance := statedb.GetBalance(common.Address{0x42}); balance.Uint64() != uint64(value) {
+			t.Errorf("candidate %d: recipient balance mismatch: have %v, want %d", i, balance, value)
+		}
+		if receipts[0].BlockHash != candidate.Hash() || receipts[0].BlockNumber.Cmp(candidate.Number()) != 0 {
+			t.Errorf("candidate %d: receipt block mismatch: have %v #%v, want %v #%v", i, receipts[0].BlockHash, receipts[0].BlockNumber, candidate.Hash(), candidate.Number())
+		}
+	}
+}
+
+func TestProcessOnBeforeSystemTx(t *testing.T) {
+	var (
+		validatorSet = common.HexToAddress("0x0000000000000000000000000000000000001000")
+		gspec        = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(0, CALLDATALOAD(0))
+			validatorSet: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, common.Address{1}, new(big.Int), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	var (
+		block  = blocks[0]
+		update = engine.systemTx(t, gspec.Config, 0, common.LeftPadBytes([]byte{0x01}, 32))
+	)
+	block = block.WithBody(append(block.Transactions(), update), nil)
+
+	var calls int
+	cfg := ProcessConfig{
+		OnBeforeSystemTx: func(txIndex int, tx *types.Transaction, statedb vm.StateDB) {
+			calls++
+			if txIndex != 1 || tx.Hash() != update.Hash() {
+				t.Errorf("system tx mismatch: have #%d %v, want #1 %v", txIndex, tx.Hash(), update.Hash())
+			}
+			if have := statedb.GetState(validatorSet, common.Hash{}); have != (common.Hash{}) {
+				t.Errorf("system tx applied before the callback: slot holds %v", have)
+			}
+		},
+	}
+	statedb, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithConfig(block, processTestState(t, chain, block), cfg)
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("callback invocations mismatch: have %d, want 1", calls)
+	}
+	if have := statedb.GetState(validatorSet, common.Hash{}); have != common.BytesToHash([]byte{0x01}) {
+		t.Errorf("validator set update not applied: slot holds %v", have)
+	}
+}
+
+func TestProcessFlagPrecompileTargets(t *testing.T) {
+	var (
+		gspec     = newProcessTestGenesis(nil)
+		signer    = types.LatestSigner(gspec.Config)
+		engine    = ethash.NewFaker()
+		ecrecover = common.BytesToAddress([]byte{0x01})
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{{0x42}, ecrecover} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{FlagPrecompileTargets: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if want := []int{1}; !reflect.DeepEqual(stats.PrecompileTargets, want) {
+		t.Errorf("flagged txs mismatch: have %v, want %v", stats.PrecompileTargets, want)
+	}
+}
+
+func TestProcessMissingParent(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {})
+	statedb := processTestState(t, chain, blocks[0])
+
+	header := blocks[0].Header()
+	header.ParentHash = common.Hash{0xde, 0xad}
+	block := types.NewBlockWithHeader(header)
+
+	_, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, statedb, vm.Config{})
+	if !errors.Is(err, ErrMissingParent) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrMissingParent)
+	}
+	if !strings.Contains(err.Error(), header.ParentHash.Hex()) {
+		t.Errorf("error %q lacks the parent hash %v", err, header.ParentHash.Hex())
+	}
+}
+
+func TestProcessStateHealer(t *testing.T) {
+	var (
+		copier = common.HexToAddress("0x000000000000000000000000000000000000c0de")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(1, SLOAD(0))
+			copier: {
+				Code:    []byte{byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.SSTORE)},
+				Storage: map[common.Hash]common.Hash{{}: common.BytesToHash([]byte{0x2a})},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, copier, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[0]
+
+	// Commit the parent state into a hash based database and prune all trie nodes
+	// but the root, handing them to the healer instead.
+	db := rawdb.NewMemoryDatabase()
+	genesis := gspec.MustCommit(db, triedb.NewDatabase(db, triedb.HashDefaults))
+
+	nodes := make(map[common.Hash][]byte)
+	it := db.NewIterator(nil, nil)
+	for it.Next() {
+		if len(it.Key()) == common.HashLength && common.BytesToHash(it.Key()) != genesis.Root() {
+			nodes[common.BytesToHash(it.Key())] = common.CopyBytes(it.Value())
+		}
+	}
+	it.Release()
+	for hash := range nodes {
+		rawdb.DeleteLegacyTrieNode(db, hash)
+	}
+	if len(nodes) == 0 {
+		t.Fatal("no trie nodes pruned")
+	}
+	openState := func() *state.StateDB {
+		statedb, err := state.New(genesis.Root(), state.NewDatabaseWithConfig(db, triedb.HashDefaults), nil)
+		if err != nil {
+			t.Fatalf("failed to open pruned state: %v", err)
+		}
+		return statedb
+	}
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	// Without a healer the missing nodes surface as a database error
+	statedb, _, _, _, err := processor.Process(block, openState(), vm.Config{})
+	if err == nil && statedb.Error() == nil {
+		t.Fatal("processed pruned state without error")
+	}
+	// With a healer, the block executes as on the full state
+	var healed int
+	healer := func(hash common.Hash) ([]byte, error) {
+		blob, ok := nodes[hash]
+		if !ok {
+			return nil, fmt.Errorf("unknown node %v", hash)
+		}
+		healed++
+		return blob, nil
+	}
+	statedb, _, _, _, err = processor.ProcessWithConfig(block, openState(), ProcessConfig{StateHealer: healer})
+	if err != nil {
+		t.Fatalf("failed to process with healer: %v", err)
+	}
+	if have := statedb.GetState(copier, common.BytesToHash([]byte{1})); have != common.BytesToHash([]byte{0x2a}) {
+		t.Errorf("copied slot mismatch: have %v, want %v", have, common.BytesToHash([]byte{0x2a}))
+	}
+	if root := statedb.IntermediateRoot(true); root != block.Root() {
+		t.Errorf("post-state root mismatch: have %v, want %v", root, block.Root())
+	}
+	if err := statedb.Error(); err != nil {
+		t.Errorf("unexpected database error: %v", err)
+	}
+	if healed == 0 {
+		t.Error("no trie nodes healed")
+	}
+}
+
+func TestProcessSyncBloom(t *testing.T) {
+	var (
+		logger = common.HexToAddress("0x0000000000000000000000000000000000001099")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// LOG1(0, 0, CALLDATALOAD(0))
+			logger: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := 0; nonce < 32; nonce++ {
+			topic := common.BytesToHash([]byte{byte(nonce)})
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), logger, new(big.Int), 50000, b.BaseFee(), topic.Bytes()), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	_, async, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process with async blooms: %v", err)
+	}
+	processor.SyncBloom = true
+	_, sync, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process with sync blooms: %v", err)
+	}
+	if len(sync) != len(async) {
+		t.Fatalf("receipt count mismatch: sync %d, async %d", len(sync), len(async))
+	}
+	for i := range sync {
+		if sync[i].Bloom == (types.Bloom{}) {
+			t.Errorf("receipt %d: bloom not set", i)
+		}
+		if sync[i].Bloom != async[i].Bloom {
+			t.Errorf("receipt %d: bloom mismatch: sync %x, async %x", i, sync[i].Bloom, async[i].Bloom)
+		}
+	}
+	if have, want := types.CreateBloom(sync), block.Bloom(); have != want {
+		t.Errorf("block bloom mismatch: have %x, want %x", have, want)
+	}
+}
+
+// mockWasmExecutor is an Executor standing in for a WASM interpreter, applying
+// messages on the EVM while recording the contracts called and marking their
+// storage.
+type mockWasmExecutor struct {
+	calls []common.Address
+}
+
+func (e *mockWasmExecutor) Apply(evm *vm.EVM, msg *Message, gp *GasPool) (*ExecutionResult, error) {
+	result, err := ApplyMessage(evm, msg, gp)
+	if err != nil {
+		return nil, err
+	}
+	e.calls = append(e.calls, *msg.To)
+	evm.StateDB.SetState(*msg.To, common.Hash{}, common.HexToHash("0x7761736d"))
+	return result, nil
+}
+
+func TestProcessWasmExecutor(t *testing.T) {
+	var (
+		wasm  = common.HexToAddress("0x000000000000000000000000000000000000a5a5")
+		evm   = common.HexToAddress("0x000000000000000000000000000000000000e5e5")
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			wasm: {Code: append(append([]byte{}, WasmCodePrefix...), 0x01, 0x00, 0x00, 0x00), Balance: new(big.Int)},
+			// SSTORE(0, 1)
+			evm: {Code: []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{evm, wasm} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	executor := new(mockWasmExecutor)
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+	processor.WasmExecutor = executor
+
+	statedb, receipts, _, _, err := processor.Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if len(executor.calls) != 1 || executor.calls[0] != wasm {
+		t.Fatalf("wasm executor calls mismatch: have %v, want [%v]", executor.calls, wasm)
+	}
+	if have := statedb.GetState(wasm, common.Hash{}); have != common.HexToHash("0x7761736d") {
+		t.Errorf("wasm contract not executed by the executor: slot holds %v", have)
+	}
+	if have := statedb.GetState(evm, common.Hash{}); have != common.BytesToHash([]byte{1}) {
+		t.Errorf("evm contract not executed by the EVM: slot holds %v", have)
+	}
+	for i, receipt := range receipts {
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Errorf("receipt %d: status %d", i, receipt.Status)
+		}
+	}
+}
+
+func TestProcessRefundRatio(t *testing.T) {
+	var (
+		clearer = common.HexToAddress("0x000000000000000000000000000000000000c1ea")
+		gspec   = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(0, 0), clearing the preset slot
+			clearer: {
+				Code:    []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE)},
+				Storage: map[common.Hash]common.Hash{{}: common.BytesToHash([]byte{1})},
+				Balance: new(big.Int),
+			},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	// A refund-light block with a plain transfer, followed by a refund-heavy one
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {
+		to := common.Address{0x42}
+		if i == 1 {
+			to = clearer
+		}
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), to, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	_, _, _, _, stats, err := processor.ProcessDetailed(blocks[0], processTestState(t, chain, blocks[0]), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process refund-light block: %v", err)
+	}
+	if stats.RefundRatio != 0 {
+		t.Errorf("refund-light ratio mismatch: have %v, want 0", stats.RefundRatio)
+	}
+	_, receipts, _, _, stats, err := processor.ProcessDetailed(blocks[1], processTestState(t, chain, blocks[1]), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process refund-heavy block: %v", err)
+	}
+	// Clearing the slot refunds less than the EIP-3529 cap of a fifth of the gas
+	refund := params.SstoreClearsScheduleRefundEIP3529
+	if want := float64(refund) / float64(receipts[0].GasUsed+refund); stats.RefundRatio != want {
+		t.Errorf("refund-heavy ratio mismatch: have %v, want %v", stats.RefundRatio, want)
+	}
+}
+
+func TestProcessAllowedTargets(t *testing.T) {
+	var (
+		allowed    = common.HexToAddress("0x000000000000000000000000000000000000a110")
+		disallowed = common.HexToAddress("0x000000000000000000000000000000000000d150")
+		gspec      = newProcessTestGenesis(types.GenesisAlloc{
+			allowed:    {Code: []byte{byte(vm.STOP)}, Balance: new(big.Int)},
+			disallowed: {Code: []byte{byte(vm.STOP)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 3, func(i int, b *BlockGen) {
+		var txs []*types.Transaction
+		switch i {
+		case 0:
+			// A call of the allowed contract and a plain transfer
+			txs = append(txs,
+				types.NewTransaction(b.TxNonce(processTestAddr), allowed, new(big.Int), 50000, b.BaseFee(), nil),
+				types.NewTransaction(b.TxNonce(processTestAddr)+1, common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil))
+		case 1:
+			// An allowed call followed by a disallowed one
+			txs = append(txs,
+				types.NewTransaction(b.TxNonce(processTestAddr), allowed, new(big.Int), 50000, b.BaseFee(), nil),
+				types.NewTransaction(b.TxNonce(processTestAddr)+1, disallowed, new(big.Int), 50000, b.BaseFee(), nil))
+		case 2:
+			txs = append(txs, types.NewContractCreation(b.TxNonce(processTestAddr), new(big.Int), 100000, b.BaseFee(), []byte{byte(vm.STOP)}))
+		}
+		for _, tx := range txs {
+			signed, _ := types.SignTx(tx, signer, processTestKey)
+			b.AddTx(signed)
+		}
+	})
+	allowlist := map[common.Address]bool{allowed: true}
+	processor := NewStateProcessor(gspec.Config, chain, engine)
+
+	tests := []struct {
+		name       string
+		block      *types.Block
+		cfg        ProcessConfig
+		err        error
+		receipts   int
+		disallowed []int
+	}{
+		{"allowed", blocks[0], ProcessConfig{AllowedTargets: allowlist}, nil, 2, nil},
+		{"disallowed", blocks[1], ProcessConfig{AllowedTargets: allowlist}, ErrTargetNotAllowed, 0, nil},
+		{"disallowed skipped", blocks[1], ProcessConfig{AllowedTargets: allowlist, SkipDisallowedTxs: true}, nil, 1, []int{1}},
+		{"creation", blocks[2], ProcessConfig{AllowedTargets: allowlist}, ErrTargetNotAllowed, 0, nil},
+		{"creation allowed", blocks[2], ProcessConfig{AllowedTargets: allowlist, AllowCreations: true}, nil, 1, nil},
+	}
+	for _, tt := range tests {
+		_, receipts, _, _, stats, err := processor.ProcessDetailed(tt.block, processTestState(t, chain, tt.block), tt.cfg)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error mismatch: have %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if len(receipts) != tt.receipts {
+			t.Errorf("%s: receipt count mismatch: have %d, want %d", tt.name, len(receipts), tt.receipts)
+		}
+		if len(stats.DisallowedTxs)+len(tt.disallowed) > 0 && !reflect.DeepEqual(stats.DisallowedTxs, tt.disallowed) {
+			t.Errorf("%s: skipped txs mismatch: have %v, want %v", tt.name, stats.DisallowedTxs, tt.disallowed)
+		}
+	}
+}
+
+func TestProcessLogCount(t *testing.T) {
+	var (
+		logger = common.HexToAddress("0x0000000000000000000000000000000000001099")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// LOG1(0, 0, 0x2a), LOG0(0, 0)
+			logger: {Code: []byte{
+				byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1),
+				byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0),
+			}, Balance: new(big.Int)},
+			// LOG0(0, 0)
+			common.HexToAddress("0x0000000000000000000000000000000000001000"): {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = newFakePoSA(ethash.NewFaker())
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce := uint64(0); nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(nonce, logger, new(big.Int), 50000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+	block = block.WithBody(append(block.Transactions(), engine.systemTx(t, gspec.Config, 0, nil)), nil)
+
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	var want int
+	for _, receipt := range receipts {
+		want += len(receipt.Logs)
+	}
+	if stats.LogCount != want {
+		t.Errorf("log count mismatch: have %d, want %d", stats.LogCount, want)
+	}
+	// Two logs of each normal transaction and one of the system transaction
+	if want != 5 {
+		t.Errorf("receipt log count mismatch: have %d, want 5", want)
+	}
+}
+
+func TestProcessTopLevelCallGas(t *testing.T) {
+	var (
+		store = common.HexToAddress("0x000000000000000000000000000000000000570e")
+		gspec = newProcessTestGenesis(types.GenesisAlloc{
+			// SSTORE(0, 1)
+			store: {Code: []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+		input  = []byte{0xff, 0xff, 0xff, 0xff}
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		call, _ := types.SignTx(types.NewTransaction(0, store, new(big.Int), 100000, b.BaseFee(), input), signer, processTestKey)
+		transfer, _ := types.SignTx(types.NewTransaction(1, common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(call)
+		b.AddTx(transfer)
+	})
+	block := blocks[0]
+
+	_, receipts, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{TopLevelCallGas: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	var (
+		intrinsic = params.TxGas + uint64(len(input))*params.TxDataNonZeroGasEIP2028
+		execution = 2*vm.GasFastestStep + params.ColdSloadCostEIP2929 + params.SstoreSetGasEIP2200
+	)
+	if have := stats.TopLevelCallGas[0]; have != execution {
+		t.Errorf("call execution gas mismatch: have %d, want %d", have, execution)
+	}
+	if receipts[0].GasUsed != intrinsic+execution {
+		t.Errorf("call gas used mismatch: have %d, want %d", receipts[0].GasUsed, intrinsic+execution)
+	}
+	if have, ok := stats.TopLevelCallGas[1]; !ok || have != 0 {
+		t.Errorf("transfer execution gas mismatch: have %d (recorded %t), want 0", have, ok)
+	}
+}
+
+func TestProcessParentBlockHash(t *testing.T) {
+	var (
+		gspec = newProcessTestCancunGenesis(types.GenesisAlloc{
+			params.HistoryStorageAddress: {Code: params.HistoryStorageCode, Balance: new(big.Int)},
+		}, 0)
+		engine = beacon.New(ethash.NewFaker())
+	)
+	gspec.Config.PragueTime = new(uint64)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {})
+	block := blocks[1]
+
+	statedb, _, _, _, err := NewStateProcessor(gspec.Config, chain, engine).Process(block, processTestState(t, chain, block), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	// The hash of block n-1 is stored in slot (n-1) % 8191
+	slot := common.BigToHash(new(big.Int).Sub(block.Number(), common.Big1))
+	if have := statedb.GetState(params.HistoryStorageAddress, slot); have != block.ParentHash() {
+		t.Errorf("stored parent hash mismatch: have %v, want %v", have, block.ParentHash())
+	}
+	if root := statedb.IntermediateRoot(true); root != block.Root() {
+		t.Errorf("post-state root mismatch with generated chain: have %v, want %v", root, block.Root())
+	}
+}
+
+func TestProcessOpcodeGas(t *testing.T) {
+	var (
+		caller = common.HexToAddress("0x000000000000000000000000000000000000ca11")
+		callee = common.HexToAddress("0x000000000000000000000000000000000000ca1e")
+		gspec  = newProcessTestGenesis(types.GenesisAlloc{
+			// CALL(GAS, callee, 0, 0, 0, 0, 0), SSTORE(0, 1)
+			caller: {Code: append(append([]byte{
+				byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+				byte(vm.PUSH20)}, callee.Bytes()...),
+				byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+				byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+			), Balance: new(big.Int)},
+			// SSTORE(1, 1)
+			callee: {Code: []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 1, byte(vm.SSTORE)}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		for nonce, to := range []common.Address{caller, {0x42}} {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(nonce), to, new(big.Int), 100000, b.BaseFee(), nil), signer, processTestKey)
+			b.AddTx(tx)
+		}
+	})
+	block := blocks[0]
+
+	_, _, _, usedGas, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{OpcodeGas: true})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	var total uint64
+	for _, gas := range stats.OpcodeGas {
+		total += gas
+	}
+	if intrinsic := uint64(len(block.Transactions())) * params.TxGas; total != usedGas-intrinsic {
+		t.Errorf("opcode gas total mismatch: have %d, want %d", total, usedGas-intrinsic)
+	}
+	// The callee's SSTORE is accounted on its own rather than to the CALL
+	if have := stats.OpcodeGas[vm.CALL]; have != params.ColdAccountAccessCostEIP2929 {
+		t.Errorf("CALL gas mismatch: have %d, want %d", have, params.ColdAccountAccessCostEIP2929)
+	}
+	if have, want := stats.OpcodeGas[vm.SSTORE], 2*(params.ColdSloadCostEIP2929+params.SstoreSetGasEIP2200); have != want {
+		t.Errorf("SSTORE gas mismatch: have %d, want %d", have, want)
+	}
+}
+
+func TestProcessTrackMaxDepth(t *testing.T) {
+	var (
+		recursive = common.HexToAddress("0x000000000000000000000000000000000000dee9")
+		gspec     = newProcessTestGenesis(types.GenesisAlloc{
+			// if n := CALLDATALOAD(0); n != 0 { MSTORE(0, n-1); CALL(GAS, ADDRESS, 0, 0, 32, 0, 0) }
+			recursive: {Code: []byte{
+				byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD), byte(vm.DUP1), byte(vm.ISZERO), byte(vm.PUSH1), 29, byte(vm.JUMPI),
+				byte(vm.PUSH1), 1, byte(vm.SWAP1), byte(vm.SUB), byte(vm.PUSH1), 0, byte(vm.MSTORE),
+				byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+				byte(vm.ADDRESS), byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+				byte(vm.JUMPDEST), byte(vm.STOP),
+			}, Balance: new(big.Int)},
+		})
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 1, func(i int, b *BlockGen) {
+		txs := []*types.Transaction{
+			types.NewTransaction(0, recursive, new(big.Int), 500000, b.BaseFee(), common.LeftPadBytes([]byte{5}, 32)),
+			types.NewTransaction(1, recursive, new(big.Int), 500000, b.BaseFee(), nil),
+			types.NewTransaction(2, common.Address{0x42}, new(big.Int), params.TxGas, b.BaseFee(), nil),
+		}
+		for _, tx := range txs {
+			signed, _ := types.SignTx(tx, signer, processTestKey)
+			b.AddTx(signed)
+		}
+	})
+	block := blocks[0]
+
+	_, _, _, _, stats, err := NewStateProcessor(gspec.Config, chain, engine).ProcessDetailed(block, processTestState(t, chain, block), ProcessConfig{Config: vm.Config{TrackMaxDepth: true}})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	want := map[int]int{0: 6, 1: 1, 2: 0}
+	if !reflect.DeepEqual(stats.MaxDepth, want) {
+		t.Errorf("max depth mismatch: have %v, want %v", stats.MaxDepth, want)
+	}
+}
+
+func TestProcessWithRoots(t *testing.T) {
+	var (
+		gspec  = newProcessTestGenesis(nil)
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	chain, blocks := newProcessTestChain(t, gspec, engine, 2, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{0x42}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, processTestKey)
+		b.AddTx(tx)
+	})
+	block := blocks[1]
+
+	_, _, _, _, preRoot, postRoot, err := NewStateProcessor(gspec.Config, chain, engine).ProcessWithRoots(block, processTestState(t, chain, block), ProcessConfig{})
+	if err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if preRoot != blocks[0].Root() {
+		t.Errorf("pre-state root mismatch: have %v, want parent root %v", preRoot, blocks[0].Root())
+	}
+	if postRoot != block.Root() {
+		t.Errorf("post-state root mismatch: have %v, want %v", postRoot, block.Root())
+	}
+}
+
+func BenchmarkApplyTransaction(b *testing.B) {
+	var (
+		config = params.AllEthashProtocolChanges
+		signer = types.LatestSigner(config)
+		header = &types.Header{
+			Number:     big.NewInt(1),
+			GasLimit:   math.MaxUint64,
+			BaseFee:    big.NewInt(params.InitialBaseFee),
+			Difficulty: big.NewInt(1),
+		}
+		txs = make([]*types.Transaction, 10_000)
+	)
+	for i := range txs {
+		txs[i], _ = types.SignTx(types.NewTransaction(uint64(i), common.Address{0x42}, big.NewInt(1), params.TxGas, header.BaseFee, nil), signer, processTestKey)
+	}
+	base, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	base.AddBalance(processTestAddr, uint256.NewInt(params.Ether))
+	base.Finalise(true)
+
+	b.Run("ApplyTransaction", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var (
+				statedb = base.Copy()
+				gp      = new(GasPool).AddGas(header.GasLimit)
+				usedGas uint64
+			)
+			for j, tx := range txs {
+				statedb.SetTxContext(tx.Hash(), j)
+				if _, err := ApplyTransaction(config, nil, &common.Address{}, gp, statedb, header, tx, &usedGas, vm.Config{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("ApplyTransactionWithEVM", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var (
+				statedb = base.Copy()
+				gp      = new(GasPool).AddGas(header.GasLimit)
+				usedGas uint64
+				evm     = vm.NewEVM(NewEVMBlockContext(header, nil, &common.Address{}), vm.TxContext{}, statedb, config, vm.Config{})
+			)
+			for j, tx := range txs {
+				statedb.SetTxContext(tx.Hash(), j)
+				if _, err := ApplyTransactionWithEVM(config, evm, gp, statedb, header, tx, &usedGas); err != nil {
+					b.Fatal(err)
+				}
+			}
+			vm.EVMInterpreterPool.Put(evm.Interpreter())
+			vm.EvmPool.Put(evm)
+		}
+	})
+}
+
+func TestApplyTransactionWithResult(t *testing.T) {
+	var (
+		config   = params.AllEthashProtocolChanges
+		signer   = types.LatestSigner(config)
+		reverter = common.HexToAddress("0x000000000000000000000000000000000000dead")
+		header   = &types.Header{
+			Number:     big.NewInt(1),
+			GasLimit:   params.GenesisGasLimit,
+			BaseFee:    big.NewInt(params.InitialBaseFee),
+			Difficulty: big.NewInt(1),
+		}
+	)
+	// The ABI encoded Error(string) revert data, returned by CODECOPY(0, 12, len), REVERT(0, len)
+	reason := append(crypto.Keccak256([]byte("Error(string)"))[:4], common.LeftPadBytes([]byte{32}, 32)...)
+	reason = append(reason, common.LeftPadBytes([]byte{13}, 32)...)
+	reason = append(reason, common.RightPadBytes([]byte("insufficient!"), 32)...)
+	code := append([]byte{
+		byte(vm.PUSH1), byte(len(reason)), byte(vm.PUSH1), 12, byte(vm.PUSH1), 0, byte(vm.CODECOPY),
+		byte(vm.PUSH1), byte(len(reason)), byte(vm.PUSH1), 0, byte(vm.REVERT),
+	}, reason...)
+
+	statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statedb.AddBalance(processTestAddr, uint256.NewInt(params.Ether))
+	statedb.SetCode(reverter, code)
+	statedb.Finalise(true)
+
+	tx, _ := types.SignTx(types.NewTransaction(0, reverter, new(big.Int), 100000, header.BaseFee, nil), signer, processTestKey)
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit)
+		usedGas uint64
+	)
+	receipt, result, err := ApplyTransactionWithResult(config, nil, &common.Address{}, gp, statedb, header, tx, &usedGas, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to apply transaction: %v", err)
+	}
+	if receipt.Status != types.ReceiptStatusFailed {
+		t.Errorf("receipt status mismatch: have %d, want %d", receipt.Status, types.ReceiptStatusFailed)
+	}
+	if !errors.Is(result.Err, vm.ErrExecutionReverted) {
+		t.Errorf("execution error mismatch: have %v, want %v", result.Err, vm.ErrExecutionReverted)
+	}
+	if result.UsedGas != receipt.GasUsed {
+		t.Errorf("used gas mismatch: have %d, receipt %d", result.UsedGas, receipt.GasUsed)
+	}
+	have, err := abi.UnpackRevert(result.Revert())
+	if err != nil {
+		t.Fatalf("failed to decode revert reason %x: %v", result.ReturnData, err)
+	}
+	if have != "insufficient!" {
+		t.Errorf("revert reason mismatch: have %q, want %q", have, "insufficient!")
+	}
+}
+
+func TestProcessBeaconBlockRootWithGas(t *testing.T) {
+	var (
+		config = newProcessTestCancunGenesis(nil, 0).Config
+		header = &types.Header{
+			Number:     big.NewInt(1),
+			Time:       12,
+			GasLimit:   params.GenesisGasLimit,
+			BaseFee:    big.NewInt(params.InitialBaseFee),
+			Difficulty: new(big.Int),
+		}
+		// The EIP-4788 contract, storing the timestamp and root in slots
+		// timestamp % 8191 and timestamp % 8191 + 8191 respectively
+		code = common.Hex2Bytes("3373fffffffffffffffffffffffffffffffffffffffe14604d57602036146024575f5ffd5b5f35801560495762001fff810690815414603c575f5ffd5b62001fff01545f5260205ff35b5f5ffd5b62001fff42064281555f359062001fff015500")
+		root = common.Hash{0x4, 0x7, 0x8, 0x8}
+		slot = common.BigToHash(new(big.Int).SetUint64(header.Time%8191 + 8191))
+	)
+	for _, tt := range []struct {
+		gas    uint64
+		stored bool
+	}{
+		{gas: 100_000, stored: true},
+		{gas: 1_000, stored: false},
+	} {
+		statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statedb.SetCode(params.BeaconRootsAddress, code)
+		statedb.Finalise(true)
+
+		vmenv := vm.NewEVM(NewEVMBlockContext(header, nil, &common.Address{}), vm.TxContext{}, statedb, config, vm.Config{})
+		ProcessBeaconBlockRootWithGas(root, tt.gas, vmenv, statedb)
+
+		want := common.Hash{}
+		if tt.stored {
+			want = root
+		}
+		if have := statedb.GetState(params.BeaconRootsAddress, slot); have != want {
+			t.Errorf("gas %d: stored root mismatch: have %v, want %v", tt.gas, have, want)
+		}
+	}
+}
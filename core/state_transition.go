@@ -127,6 +127,27 @@ func toWordSize(size uint64) uint64 {
 	return (size + 31) / 32
 }
 
+// SumIntrinsicGas computes the total intrinsic gas of all the transactions in the
+// block under the rules active at its height, which is a lower bound of the gas
+// the block uses.
+func SumIntrinsicGas(block *types.Block, config *params.ChainConfig) (uint64, error) {
+	var (
+		rules = config.Rules(block.Number(), block.Difficulty().Sign() == 0, block.Time())
+		total uint64
+	)
+	for i, tx := range block.Transactions() {
+		gas, err := IntrinsicGas(tx.Data(), tx.AccessList(), tx.To() == nil, rules.IsHomestead, rules.IsIstanbul, rules.IsShanghai)
+		if err != nil {
+			return 0, fmt.Errorf("tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+		}
+		if total+gas < total {
+			return 0, ErrGasUintOverflow
+		}
+		total += gas
+	}
+	return total, nil
+}
+
 // A Message contains the data derived from a single transaction that is relevant to state
 // processing.
 type Message struct {
@@ -147,6 +168,11 @@ type Message struct {
 	// account nonce in state. It also disables checking that the sender is an EOA.
 	// This field will be set to true for operations like RPC eth_call.
 	SkipAccountChecks bool
+
+	// MaxRefund, if set, caps the gas refunded to the sender after execution on
+	// top of the protocol's refund quotient. This is not part of the protocol and
+	// only used for research purposes.
+	MaxRefund *uint64
 }
 
 // TransactionToMessage converts a transaction into a Message.
@@ -490,6 +516,9 @@ func (st *StateTransition) refundGas(refundQuotient uint64) uint64 {
 	if refund > st.state.GetRefund() {
 		refund = st.state.GetRefund()
 	}
+	if st.msg.MaxRefund != nil && refund > *st.msg.MaxRefund {
+		refund = *st.msg.MaxRefund
+	}
 	st.gasRemaining += refund
 
 	// Return ETH for remaining gas, exchanged at the original rate.
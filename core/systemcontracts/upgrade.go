@@ -738,6 +738,13 @@ func init() {
 	}
 }
 
+// UpgradeBuildInSystemContract replaces the code of the built-in system contracts
+// scheduled for an upgrade at the given block. If several forks activate in the
+// same block, their upgrades are applied in fork activation order, so the code
+// of a contract upgraded by more than one of them ends up as of the latest fork.
+// Within a single fork, contracts are upgraded in the order their configs are
+// declared in. As the upgrade hooks may depend on it, this order is part of
+// consensus and must be kept when adding to or editing the upgrades.
 func UpgradeBuildInSystemContract(config *params.ChainConfig, blockNumber *big.Int, lastBlockTime uint64, blockTime uint64, statedb *state.StateDB) {
 	if config == nil || blockNumber == nil || statedb == nil {
 		return
@@ -756,69 +763,111 @@ func UpgradeBuildInSystemContract(config *params.ChainConfig, blockNumber *big.I
 	}
 
 	logger := log.New("system-contract-upgrade", network)
-	if config.IsOnRamanujan(blockNumber) {
-		applySystemContractUpgrade(ramanujanUpgrade[network], blockNumber, statedb, logger)
-	}
-
-	if config.IsOnNiels(blockNumber) {
-		applySystemContractUpgrade(nielsUpgrade[network], blockNumber, statedb, logger)
-	}
-
-	if config.IsOnMirrorSync(blockNumber) {
-		applySystemContractUpgrade(mirrorUpgrade[network], blockNumber, statedb, logger)
-	}
-
-	if config.IsOnBruno(blockNumber) {
-		applySystemContractUpgrade(brunoUpgrade[network], blockNumber, statedb, logger)
-	}
-
-	if config.IsOnEuler(blockNumber) {
-		applySystemContractUpgrade(eulerUpgrade[network], blockNumber, statedb, logger)
+	for _, fork := range upgradeForks {
+		if !fork.activates(config, blockNumber, lastBlockTime, blockTime) {
+			continue
+		}
+		if fork.upgrades == nil {
+			logger.Info(fmt.Sprintf("Empty upgrade config for %s", fork.name), "height", blockNumber.String())
+			continue
+		}
+		applySystemContractUpgrade(fork.upgrades[network], blockNumber, statedb, logger)
 	}
+}
 
-	if config.IsOnGibbs(blockNumber) {
-		applySystemContractUpgrade(gibbsUpgrade[network], blockNumber, statedb, logger)
-	}
+// upgradeFork is a fork upgrading the built-in system contracts, activated either
+// at a block number or, after London, at a timestamp.
+type upgradeFork struct {
+	name     string
+	upgrades map[string]*Upgrade                       // Upgrades per network, nil if the fork has none
+	block    func(config *params.ChainConfig) *big.Int // Activation block of a number based fork
+	time     func(config *params.ChainConfig) *uint64  // Activation time of a time based fork
+}
 
-	if config.IsOnMoran(blockNumber) {
-		applySystemContractUpgrade(moranUpgrade[network], blockNumber, statedb, logger)
-	}
+// upgradeForks lists the forks upgrading the built-in system contracts in the
+// order they are applied if activating in the same block. It is the single
+// source of both UpgradeBuildInSystemContract and UpgradeSchedule, new forks are
+// to be appended.
+var upgradeForks = []upgradeFork{
+	{name: "ramanujan", upgrades: ramanujanUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.RamanujanBlock }},
+	{name: "niels", upgrades: nielsUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.NielsBlock }},
+	{name: "mirrorSync", upgrades: mirrorUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.MirrorSyncBlock }},
+	{name: "bruno", upgrades: brunoUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.BrunoBlock }},
+	{name: "euler", upgrades: eulerUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.EulerBlock }},
+	{name: "gibbs", upgrades: gibbsUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.GibbsBlock }},
+	{name: "moran", upgrades: moranUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.MoranBlock }},
+	{name: "planck", upgrades: planckUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.PlanckBlock }},
+	{name: "luban", upgrades: lubanUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.LubanBlock }},
+	{name: "plato", upgrades: platoUpgrade, block: func(c *params.ChainConfig) *big.Int { return c.PlatoBlock }},
+	{name: "shanghai", time: func(c *params.ChainConfig) *uint64 { return c.ShanghaiTime }},
+	{name: "kepler", upgrades: keplerUpgrade, time: func(c *params.ChainConfig) *uint64 { return c.KeplerTime }},
+	{name: "feynman", upgrades: feynmanUpgrade, time: func(c *params.ChainConfig) *uint64 { return c.FeynmanTime }},
+	{name: "feynmanFix", upgrades: feynmanFixUpgrade, time: func(c *params.ChainConfig) *uint64 { return c.FeynmanFixTime }},
+	{name: "haberFix", upgrades: haberFixUpgrade, time: func(c *params.ChainConfig) *uint64 { return c.HaberFixTime }},
+}
 
-	if config.IsOnPlanck(blockNumber) {
-		applySystemContractUpgrade(planckUpgrade[network], blockNumber, statedb, logger)
+// activates reports whether the fork activates in the block with the given
+// number and timestamp, whose parent has lastBlockTime.
+func (f *upgradeFork) activates(config *params.ChainConfig, blockNumber *big.Int, lastBlockTime uint64, blockTime uint64) bool {
+	if f.block != nil {
+		number := f.block(config)
+		return number != nil && number.Cmp(blockNumber) == 0
 	}
-
-	if config.IsOnLuban(blockNumber) {
-		applySystemContractUpgrade(lubanUpgrade[network], blockNumber, statedb, logger)
+	time := f.time(config)
+	if time == nil {
+		return false
 	}
-
-	if config.IsOnPlato(blockNumber) {
-		applySystemContractUpgrade(platoUpgrade[network], blockNumber, statedb, logger)
+	lastBlockNumber := new(big.Int)
+	if blockNumber.Sign() > 0 {
+		lastBlockNumber.Sub(blockNumber, big.NewInt(1))
 	}
+	forked := func(number *big.Int, t uint64) bool { return config.IsLondon(number) && *time <= t }
+	return !forked(lastBlockNumber, lastBlockTime) && forked(blockNumber, blockTime)
+}
 
-	if config.IsOnShanghai(blockNumber, lastBlockTime, blockTime) {
-		logger.Info("Empty upgrade config for shanghai", "height", blockNumber.String())
-	}
+// UpgradeSchedule holds the block numbers and timestamps at which the forks of a
+// chain config may upgrade the built-in system contracts, allowing to skip
+// UpgradeBuildInSystemContract for the vast majority of blocks.
+type UpgradeSchedule struct {
+	blocks map[uint64]struct{} // Blocks at which a number based fork may upgrade system contracts
+	times  []uint64            // Timestamps at which a time based fork may upgrade system contracts
+}
 
-	if config.IsOnKepler(blockNumber, lastBlockTime, blockTime) {
-		applySystemContractUpgrade(keplerUpgrade[network], blockNumber, statedb, logger)
+// NewUpgradeSchedule collects the upgrade schedule of the forks of config. Time
+// based forks are also gated on London, so its block is included if any of them
+// is configured.
+func NewUpgradeSchedule(config *params.ChainConfig) *UpgradeSchedule {
+	schedule := &UpgradeSchedule{blocks: make(map[uint64]struct{})}
+	for _, fork := range upgradeForks {
+		if fork.block != nil {
+			if number := fork.block(config); number != nil && number.IsUint64() {
+				schedule.blocks[number.Uint64()] = struct{}{}
+			}
+		} else if time := fork.time(config); time != nil {
+			schedule.times = append(schedule.times, *time)
+		}
 	}
-
-	if config.IsOnFeynman(blockNumber, lastBlockTime, blockTime) {
-		applySystemContractUpgrade(feynmanUpgrade[network], blockNumber, statedb, logger)
+	if len(schedule.times) > 0 && config.LondonBlock != nil && config.LondonBlock.IsUint64() {
+		schedule.blocks[config.LondonBlock.Uint64()] = struct{}{}
 	}
+	return schedule
+}
 
-	if config.IsOnFeynmanFix(blockNumber, lastBlockTime, blockTime) {
-		applySystemContractUpgrade(feynmanFixUpgrade[network], blockNumber, statedb, logger)
+// HasUpgrade reports whether built-in system contracts may be upgraded in the
+// block with the given number and timestamp, whose parent has parentTime. It is
+// conservative, leaving the exact fork checks to UpgradeBuildInSystemContract.
+func (s *UpgradeSchedule) HasUpgrade(number *big.Int, parentTime, time uint64) bool {
+	if number.IsUint64() {
+		if _, ok := s.blocks[number.Uint64()]; ok {
+			return true
+		}
 	}
-
-	if config.IsOnHaberFix(blockNumber, lastBlockTime, blockTime) {
-		applySystemContractUpgrade(haberFixUpgrade[network], blockNumber, statedb, logger)
+	for _, t := range s.times {
+		if parentTime < t && t <= time {
+			return true
+		}
 	}
-
-	/*
-		apply other upgrades
-	*/
+	return false
 }
 
 func applySystemContractUpgrade(upgrade *Upgrade, blockNumber *big.Int, statedb *state.StateDB, logger log.Logger) {
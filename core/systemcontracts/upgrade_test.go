@@ -2,9 +2,19 @@ package systemcontracts
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/systemcontracts/feynman"
+	"github.com/ethereum/go-ethereum/core/systemcontracts/kepler"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,3 +49,122 @@ func TestAllCodesHash(t *testing.T) {
 	allCodeHash := sha256.Sum256(allCodes)
 	require.Equal(t, allCodeHash[:], common.Hex2Bytes("833cc0fc87c46ad8a223e44ccfdc16a51a7e7383525136441bd0c730f06023df"))
 }
+
+func TestUpgradeOrderWithinFork(t *testing.T) {
+	statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	require.NoError(t, err)
+
+	var order []common.Address
+	record := func(blockNumber *big.Int, contractAddr common.Address, statedb *state.StateDB) error {
+		order = append(order, contractAddr)
+		return nil
+	}
+	upgrade := &Upgrade{UpgradeName: "test"}
+	for _, addr := range []string{SystemRewardContract, ValidatorContract, SlashContract} {
+		upgrade.Configs = append(upgrade.Configs, &UpgradeConfig{ContractAddr: common.HexToAddress(addr), Code: "6000", AfterUpgrade: record})
+	}
+	applySystemContractUpgrade(upgrade, big.NewInt(1), statedb, log.Root())
+
+	// Contracts are upgraded in declaration order, not sorted by address
+	want := []common.Address{common.HexToAddress(SystemRewardContract), common.HexToAddress(ValidatorContract), common.HexToAddress(SlashContract)}
+	require.Equal(t, want, order)
+}
+
+func TestFeynmanUpgradeOrder(t *testing.T) {
+	// The order of the upgrades applied on mainnet is part of consensus
+	want := []string{
+		ValidatorContract, SlashContract, TokenHubContract, GovHubContract, CrossChainContract, StakingContract,
+		StakeHubContract, StakeCreditContract, GovernorContract, GovTokenContract, TimelockContract, TokenRecoverPortalContract,
+	}
+	configs := feynmanUpgrade[mainNet].Configs
+	require.Len(t, configs, len(want))
+	for i, addr := range want {
+		require.Equal(t, common.HexToAddress(addr), configs[i].ContractAddr, "upgrade %d", i)
+	}
+}
+
+func TestSimultaneousUpgrades(t *testing.T) {
+	defer func(hash common.Hash) { GenesisHash = hash }(GenesisHash)
+	GenesisHash = params.ChapelGenesisHash
+
+	// Kepler and Feynman both activate at the first block
+	forkTime := uint64(10)
+	config := &params.ChainConfig{LondonBlock: big.NewInt(0), KeplerTime: &forkTime, FeynmanTime: &forkTime}
+
+	var roots []common.Hash
+	for i := 0; i < 2; i++ {
+		statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		require.NoError(t, err)
+		UpgradeBuildInSystemContract(config, big.NewInt(1), 0, forkTime, statedb)
+
+		// Contracts upgraded by both forks end up with the code of the later one
+		for addr, code := range map[string]string{
+			ValidatorContract:    feynman.ChapelValidatorContract,
+			SlashContract:        feynman.ChapelSlashContract,
+			SystemRewardContract: kepler.ChapelSystemRewardContract,
+		} {
+			want, err := hex.DecodeString(strings.TrimSpace(code))
+			require.NoError(t, err)
+			require.Equal(t, want, statedb.GetCode(common.HexToAddress(addr)), "code mismatch at %s", addr)
+		}
+		roots = append(roots, statedb.IntermediateRoot(true))
+	}
+	require.Equal(t, roots[0], roots[1])
+}
+
+func TestUpgradeScheduleHasUpgrade(t *testing.T) {
+	var (
+		config   = params.BSCChainConfig
+		schedule = NewUpgradeSchedule(config)
+	)
+	for _, number := range []*big.Int{config.RamanujanBlock, config.PlanckBlock, config.PlatoBlock, config.LondonBlock} {
+		require.True(t, schedule.HasUpgrade(number, 0, 0), "block %v: upgrade not scheduled", number)
+	}
+	kepler := *config.KeplerTime
+	require.True(t, schedule.HasUpgrade(big.NewInt(40_000_000), kepler-3, kepler), "first block past the Kepler time: upgrade not scheduled")
+	require.False(t, schedule.HasUpgrade(big.NewInt(40_000_000), kepler, kepler+3), "block after the Kepler transition: unexpected upgrade")
+}
+
+func TestUpgradeScheduleCoversForks(t *testing.T) {
+	// Every fork activation applying upgrades must be part of the schedule
+	config := params.BSCChainConfig
+	schedule := NewUpgradeSchedule(config)
+	for _, fork := range upgradeForks {
+		if fork.block != nil {
+			number := fork.block(config)
+			require.True(t, fork.activates(config, number, 0, 0), "fork %s not activating at its block", fork.name)
+			require.True(t, schedule.HasUpgrade(number, 0, 0), "fork %s not scheduled", fork.name)
+			continue
+		}
+		if fork.time(config) == nil {
+			continue // not scheduled on mainnet yet
+		}
+		time, number := *fork.time(config), big.NewInt(40_000_000)
+		require.True(t, fork.activates(config, number, time-3, time), "fork %s not activating at its time", fork.name)
+		require.True(t, schedule.HasUpgrade(number, time-3, time), "fork %s not scheduled", fork.name)
+	}
+}
+
+func BenchmarkUpgradeCheck(b *testing.B) {
+	var (
+		config   = params.BSCChainConfig
+		schedule = NewUpgradeSchedule(config)
+		number   = big.NewInt(30_000_000) // Between Planck and Plato, before any time based fork
+		time     = *config.ShanghaiTime - 1_000_000
+	)
+	statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	require.NoError(b, err)
+
+	b.Run("config", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			UpgradeBuildInSystemContract(config, number, time-3, time, statedb)
+		}
+	})
+	b.Run("precomputed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if schedule.HasUpgrade(number, time-3, time) {
+				UpgradeBuildInSystemContract(config, number, time-3, time, statedb)
+			}
+		}
+	})
+}
@@ -60,3 +60,9 @@ type Processor interface {
 	// the processor (coinbase) and any included uncles.
 	Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (*state.StateDB, types.Receipts, []*types.Log, uint64, error)
 }
+
+// ReceiptWriter is an interface for persisting the receipts of processed blocks.
+type ReceiptWriter interface {
+	// WriteReceipts stores the final receipts of the given block.
+	WriteReceipts(block *types.Block, receipts types.Receipts) error
+}
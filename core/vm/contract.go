@@ -69,6 +69,8 @@ type Contract struct {
 
 	Gas   uint64
 	value *uint256.Int
+
+	authorized *common.Address // Account authorized via AUTH in this call frame (EIP-3074)
 }
 
 // NewContract returns a new contract environment for the execution of EVM.
@@ -17,10 +17,13 @@
 package vm
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/big"
 	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/holiman/uint256"
 )
@@ -37,6 +40,7 @@ var activators = map[int]func(*JumpTable){
 	1884: enable1884,
 	1344: enable1344,
 	1153: enable1153,
+	3074: enable3074,
 }
 
 // EnableEIP enables the given EIP on the config.
@@ -199,6 +203,11 @@ func opTload(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]by
 	hash := common.Hash(loc.Bytes32())
 	val := interpreter.evm.StateDB.GetTransientState(scope.Contract.Address(), hash)
 	loc.SetBytes(val.Bytes())
+	if usage := interpreter.evm.transientUsage; usage != nil {
+		u := usage[scope.Contract.Address()]
+		u.Loads++
+		usage[scope.Contract.Address()] = u
+	}
 	return nil, nil
 }
 
@@ -210,6 +219,11 @@ func opTstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 	loc := scope.Stack.pop()
 	val := scope.Stack.pop()
 	interpreter.evm.StateDB.SetTransientState(scope.Contract.Address(), loc.Bytes32(), val.Bytes32())
+	if usage := interpreter.evm.transientUsage; usage != nil {
+		u := usage[scope.Contract.Address()]
+		u.Stores++
+		usage[scope.Contract.Address()] = u
+	}
 	return nil, nil
 }
 
@@ -319,3 +333,117 @@ func enable6780(jt *JumpTable) {
 		maxStack:    maxStack(1, 0),
 	}
 }
+
+// enable3074 applies EIP-3074 (AUTH and AUTHCALL opcodes).
+//
+// The EIP is experimental: it is not scheduled for any fork and can only be
+// switched on through Config.ExtraEips. As the gas metering relies on access
+// lists, it should not be enabled on chains before Berlin.
+func enable3074(jt *JumpTable) {
+	jt[AUTH] = &operation{
+		execute:     opAuth,
+		constantGas: params.AuthGasEIP3074,
+		dynamicGas:  gasAuth,
+		minStack:    minStack(3, 1),
+		maxStack:    maxStack(3, 1),
+		memorySize:  memoryAuth,
+	}
+	jt[AUTHCALL] = &operation{
+		execute:     opAuthCall,
+		constantGas: params.WarmStorageReadCostEIP2929,
+		dynamicGas:  gasCallEIP2929,
+		minStack:    minStack(7, 1),
+		maxStack:    maxStack(7, 1),
+		memorySize:  memoryCall,
+	}
+}
+
+// authMagic is the domain separator of the commitments signed for AUTH.
+const authMagic = 0x04
+
+// opAuth implements the AUTH opcode. The memory region holds the authority's
+// signature (yParity || r || s) followed by the commit, zero padded to 97 bytes.
+// If the signature over keccak256(MAGIC || chainId || nonce || invoker || commit)
+// recovers to the authority, it becomes the authorized account of the frame.
+func opAuth(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	var (
+		authority = scope.Stack.pop()
+		offset    = scope.Stack.pop()
+		size      = scope.Stack.peek()
+		addr      = common.Address(authority.Bytes20())
+		input     [97]byte
+	)
+	// Any failure leaves the frame without an authorized account.
+	scope.Contract.authorized = nil
+
+	copy(input[:], scope.Memory.GetPtr(int64(offset.Uint64()), int64(size.Uint64())))
+	yParity, r, s, commit := input[0], input[1:33], input[33:65], input[65:97]
+
+	if interpreter.evm.StateDB.GetCodeSize(addr) != 0 || !crypto.ValidateSignatureValues(yParity, new(big.Int).SetBytes(r), new(big.Int).SetBytes(s), true) {
+		size.Clear()
+		return nil, nil
+	}
+	var (
+		msg     = make([]byte, 129)
+		chainID = uint256.MustFromBig(interpreter.evm.chainConfig.ChainID).Bytes32()
+		invoker = scope.Contract.Address()
+	)
+	msg[0] = authMagic
+	copy(msg[1:33], chainID[:])
+	binary.BigEndian.PutUint64(msg[57:65], interpreter.evm.StateDB.GetNonce(addr))
+	copy(msg[77:97], invoker[:])
+	copy(msg[97:129], commit)
+
+	sig := make([]byte, crypto.SignatureLength)
+	copy(sig, input[1:65])
+	sig[crypto.RecoveryIDOffset] = yParity
+
+	pub, err := crypto.SigToPub(crypto.Keccak256(msg), sig)
+	if err != nil || crypto.PubkeyToAddress(*pub) != addr {
+		size.Clear()
+		return nil, nil
+	}
+	scope.Contract.authorized = &addr
+	size.SetOne()
+	return nil, nil
+}
+
+// opAuthCall implements the AUTHCALL opcode. It behaves like CALL, except that
+// the callee observes the authorized account as caller and any value is taken
+// from the balance of that account. Without a prior successful AUTH in the same
+// frame, execution halts exceptionally.
+func opAuthCall(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	if scope.Contract.authorized == nil {
+		return nil, ErrAuthorizedNotSet
+	}
+	stack := scope.Stack
+	// Pop gas. The actual gas in interpreter.evm.callGasTemp.
+	temp := stack.pop()
+	gas := interpreter.evm.callGasTemp
+	// Pop other call parameters.
+	addr, value, inOffset, inSize, retOffset, retSize := stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop()
+	toAddr := common.Address(addr.Bytes20())
+	// Get the arguments from the memory.
+	args := scope.Memory.GetPtr(int64(inOffset.Uint64()), int64(inSize.Uint64()))
+
+	if interpreter.readOnly && !value.IsZero() {
+		return nil, ErrWriteProtection
+	}
+	ret, returnGas, err := interpreter.evm.Call(AccountRef(*scope.Contract.authorized), toAddr, args, gas, &value)
+	if err == ErrInternalCallLimit {
+		return nil, err
+	}
+	if err != nil {
+		temp.Clear()
+	} else {
+		temp.SetOne()
+	}
+	stack.push(&temp)
+	if err == nil || err == ErrExecutionReverted {
+		scope.Memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
+	}
+	scope.Contract.Gas += returnGas
+
+	interpreter.returnData = ret
+	return ret, nil
+}
@@ -37,6 +37,9 @@ var (
 	ErrGasUintOverflow          = errors.New("gas uint64 overflow")
 	ErrInvalidCode              = errors.New("invalid code: must not begin with 0xef")
 	ErrNonceUintOverflow        = errors.New("nonce uint64 overflow")
+	ErrAuthorizedNotSet         = errors.New("authorized account not set")
+	ErrInternalCallLimit        = errors.New("internal call limit exceeded")
+	ErrUnknownOpcodeFork        = errors.New("unknown opcode behavior fork")
 
 	// errStopToken is an internal token indicating interpreter loop termination,
 	// never returned to outside callers.
@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/holiman/uint256"
 
@@ -79,6 +80,13 @@ func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
 	return p, ok
 }
 
+// IsPrecompile reports whether addr is a precompiled contract under the rules of
+// the current block.
+func (evm *EVM) IsPrecompile(addr common.Address) bool {
+	_, ok := evm.precompile(addr)
+	return ok
+}
+
 // BlockContext provides the EVM with auxiliary information. Once provided
 // it shouldn't be modified.
 type BlockContext struct {
@@ -109,6 +117,8 @@ type TxContext struct {
 	GasPrice   *big.Int       // Provides information for GASPRICE (and is used to zero the basefee if NoBaseFee is set)
 	BlobHashes []common.Hash  // Provides information for BLOBHASH
 	BlobFeeCap *big.Int       // Is used to zero the blobbasefee if NoBaseFee is set
+
+	TxIndex int // Index of the transaction in the block, as reported to Config.OnColdAccess (only set by block processing, 0 otherwise)
 }
 
 // EVM is the Ethereum Virtual Machine base object and provides
@@ -145,6 +155,63 @@ type EVM struct {
 	// available gas is calculated in gasCall* according to the 63/64 rule and later
 	// applied in opCall*.
 	callGasTemp uint64
+	// transientUsage counts the transient storage operations per contract if
+	// Config.TrackTransientStorage is enabled.
+	transientUsage map[common.Address]TransientStorageUsage
+	// slotAccesses counts the SLOAD and SSTORE operations per storage slot if
+	// Config.ExportSlotHeatmap is enabled.
+	slotAccesses map[StorageSlot]int
+	// redundantWrites holds the storage slots written with the value they already
+	// held if Config.FlagRedundantStorageWrites is enabled.
+	redundantWrites []StorageSlot
+	// precompileGas accumulates the gas consumed by precompiled contracts if
+	// Config.TrackPrecompileGas is enabled.
+	precompileGas uint64
+	// internalCalls counts the sub-calls of the current transaction if
+	// Config.MaxInternalCalls is set.
+	internalCalls int
+	// maxDepth is the deepest call depth reached by the current transaction if
+	// Config.TrackMaxDepth is enabled.
+	maxDepth int
+	// transfers and revertedTransfers hold the value transfers of the current
+	// transaction which are pending and rolled back respectively, if
+	// Config.TrackRevertedTransfers is enabled.
+	transfers         []ValueTransfer
+	revertedTransfers []ValueTransfer
+	// opcodeProfile accumulates the execution time per call stack and opcode if
+	// Config.ProfileOpcodes is set. profileFrames holds the code addresses of the
+	// running call frames, profileCallee the duration of the last returned one.
+	opcodeProfile map[string]*OpcodeSample
+	profileFrames []common.Address
+	profileCallee time.Duration
+}
+
+// OpcodeSample is the time spent executing an opcode in a call stack.
+type OpcodeSample struct {
+	Stack []common.Address // Code addresses of the call frames, outermost first
+	Op    OpCode
+	Count int           // Number of executions
+	Time  time.Duration // Execution time, excluding the one spent in sub-calls
+}
+
+// ValueTransfer is a transfer of value by a call or contract creation.
+type ValueTransfer struct {
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+}
+
+// StorageSlot identifies a storage slot of a contract.
+type StorageSlot struct {
+	Address common.Address
+	Slot    common.Hash
+}
+
+// TransientStorageUsage is the number of EIP-1153 transient storage operations
+// executed in the context of a contract.
+type TransientStorageUsage struct {
+	Loads  int // Number of TLOAD operations
+	Stores int // Number of TSTORE operations
 }
 
 // NewEVM returns a new EVM. The returned EVM is not thread safe and should
@@ -172,6 +239,20 @@ func NewEVM(blockCtx BlockContext, txCtx TxContext, statedb StateDB, chainConfig
 	evm.abort.Store(false)
 	evm.callGasTemp = 0
 	evm.depth = 0
+	evm.internalCalls = 0
+	evm.maxDepth = 0
+	evm.transfers, evm.revertedTransfers = nil, nil
+	evm.transientUsage = nil
+	if config.TrackTransientStorage {
+		evm.transientUsage = make(map[common.Address]TransientStorageUsage)
+	}
+	evm.slotAccesses = nil
+	if config.ExportSlotHeatmap {
+		evm.slotAccesses = make(map[StorageSlot]int)
+	}
+	evm.precompileGas = 0
+	evm.redundantWrites = nil
+	evm.opcodeProfile, evm.profileFrames, evm.profileCallee = nil, nil, 0
 
 	evm.interpreter = NewEVMInterpreter(evm)
 
@@ -183,6 +264,163 @@ func NewEVM(blockCtx BlockContext, txCtx TxContext, statedb StateDB, chainConfig
 func (evm *EVM) Reset(txCtx TxContext, statedb StateDB) {
 	evm.TxContext = txCtx
 	evm.StateDB = statedb
+	evm.internalCalls = 0
+	evm.maxDepth = 0
+	evm.transfers, evm.revertedTransfers = nil, nil
+}
+
+// trackTransfer records a value transfer if Config.TrackRevertedTransfers is
+// enabled, so it can be reported if rolled back later on.
+func (evm *EVM) trackTransfer(from, to common.Address, value *uint256.Int) {
+	if evm.Config.TrackRevertedTransfers && !value.IsZero() {
+		evm.transfers = append(evm.transfers, ValueTransfer{From: from, To: to, Value: value.ToBig()})
+	}
+}
+
+// revertTransfers marks all transfers tracked since mark as rolled back.
+func (evm *EVM) revertTransfers(mark int) {
+	if len(evm.transfers) > mark {
+		evm.revertedTransfers = append(evm.revertedTransfers, evm.transfers[mark:]...)
+		evm.transfers = evm.transfers[:mark]
+	}
+}
+
+// TakeRevertedTransfers returns the value transfers of the current transaction
+// which were rolled back due to a failing call, and clears the tracked transfers.
+// It returns nil unless Config.TrackRevertedTransfers is enabled.
+func (evm *EVM) TakeRevertedTransfers() []ValueTransfer {
+	reverted := evm.revertedTransfers
+	evm.transfers, evm.revertedTransfers = nil, nil
+	return reverted
+}
+
+// countInternalCall accounts a new sub-call against Config.MaxInternalCalls and
+// returns ErrInternalCallLimit if the limit is exceeded. Top level calls are not
+// counted. Unlike other call failures, the error is not handed to the calling
+// contract, but unwinds every call frame, failing the transaction as a whole.
+func (evm *EVM) countInternalCall() error {
+	if evm.Config.MaxInternalCalls <= 0 || evm.depth == 0 {
+		return nil
+	}
+	evm.internalCalls++
+	if evm.internalCalls > evm.Config.MaxInternalCalls {
+		return ErrInternalCallLimit
+	}
+	return nil
+}
+
+// MaxDepth returns the deepest call depth at which code was executed by the
+// current transaction, 1 being its top-level call, or 0 if Config.TrackMaxDepth
+// is disabled or no code was executed.
+func (evm *EVM) MaxDepth() int {
+	return evm.maxDepth
+}
+
+// TakeTransientStorageUsage returns the transient storage operations counted
+// since the last call, or nil if Config.TrackTransientStorage is disabled or no
+// such operations were executed.
+func (evm *EVM) TakeTransientStorageUsage() map[common.Address]TransientStorageUsage {
+	if len(evm.transientUsage) == 0 {
+		return nil
+	}
+	usage := evm.transientUsage
+	evm.transientUsage = make(map[common.Address]TransientStorageUsage)
+	return usage
+}
+
+// TakeSlotAccesses returns the number of SLOAD and SSTORE operations per storage
+// slot counted since the last call, or nil if Config.ExportSlotHeatmap is
+// disabled or no storage was accessed.
+func (evm *EVM) TakeSlotAccesses() map[StorageSlot]int {
+	if len(evm.slotAccesses) == 0 {
+		return nil
+	}
+	accesses := evm.slotAccesses
+	evm.slotAccesses = make(map[StorageSlot]int)
+	return accesses
+}
+
+// TakeRedundantStorageWrites returns the storage slots written with the value
+// they already held since the last call, in execution order and including the
+// writes of reverted calls, or nil if Config.FlagRedundantStorageWrites is
+// disabled or there were none.
+func (evm *EVM) TakeRedundantStorageWrites() []StorageSlot {
+	writes := evm.redundantWrites
+	evm.redundantWrites = nil
+	return writes
+}
+
+// runPrecompile runs the precompiled contract p, accounting the gas it consumes
+// for Config.TrackPrecompileGas. On error the caller burns all supplied gas.
+func (evm *EVM) runPrecompile(p PrecompiledContract, input []byte, gas uint64) ([]byte, uint64, error) {
+	ret, remaining, err := RunPrecompiledContract(p, input, gas)
+	if evm.Config.TrackPrecompileGas {
+		if err != nil {
+			evm.precompileGas += gas
+		} else {
+			evm.precompileGas += gas - remaining
+		}
+	}
+	return ret, remaining, err
+}
+
+// TakePrecompileGas returns the gas consumed by precompiled contracts since the
+// last call, or 0 if Config.TrackPrecompileGas is disabled.
+func (evm *EVM) TakePrecompileGas() uint64 {
+	gas := evm.precompileGas
+	evm.precompileGas = 0
+	return gas
+}
+
+// enterProfileFrame records the start of a call frame executing the code of
+// contract for Config.ProfileOpcodes.
+func (evm *EVM) enterProfileFrame(contract *Contract) {
+	addr := contract.Address()
+	if contract.CodeAddr != nil {
+		addr = *contract.CodeAddr
+	}
+	evm.profileFrames = append(evm.profileFrames, addr)
+}
+
+// exitProfileFrame records the end of the innermost call frame, started at start.
+func (evm *EVM) exitProfileFrame(start time.Time) {
+	evm.profileFrames = evm.profileFrames[:len(evm.profileFrames)-1]
+	evm.profileCallee = time.Since(start)
+}
+
+// profileOpcode accounts an execution of op in the innermost call frame which
+// took elapsed, including the time of any sub-call it made.
+func (evm *EVM) profileOpcode(op OpCode, elapsed time.Duration) {
+	key := make([]byte, 0, len(evm.profileFrames)*common.AddressLength+1)
+	for _, addr := range evm.profileFrames {
+		key = append(key, addr.Bytes()...)
+	}
+	key = append(key, byte(op))
+
+	if evm.opcodeProfile == nil {
+		evm.opcodeProfile = make(map[string]*OpcodeSample)
+	}
+	sample := evm.opcodeProfile[string(key)]
+	if sample == nil {
+		sample = &OpcodeSample{Stack: append([]common.Address(nil), evm.profileFrames...), Op: op}
+		evm.opcodeProfile[string(key)] = sample
+	}
+	sample.Count++
+	sample.Time += elapsed - evm.profileCallee
+}
+
+// TakeOpcodeProfile returns the opcode samples collected since the last call,
+// or nil if Config.ProfileOpcodes is not set.
+func (evm *EVM) TakeOpcodeProfile() []OpcodeSample {
+	if len(evm.opcodeProfile) == 0 {
+		return nil
+	}
+	samples := make([]OpcodeSample, 0, len(evm.opcodeProfile))
+	for _, sample := range evm.opcodeProfile {
+		samples = append(samples, *sample)
+	}
+	evm.opcodeProfile = nil
+	return samples
 }
 
 // Cancel cancels any running EVM operation. This may be called concurrently and
@@ -210,11 +448,15 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	if evm.depth > int(params.CallCreateDepth) {
 		return nil, gas, ErrDepth
 	}
+	if err := evm.countInternalCall(); err != nil {
+		return nil, gas, err
+	}
 	// Fail if we're trying to transfer more than the available balance
 	if !value.IsZero() && !evm.Context.CanTransfer(evm.StateDB, caller.Address(), value) {
 		return nil, gas, ErrInsufficientBalance
 	}
 	snapshot := evm.StateDB.Snapshot()
+	mark := len(evm.transfers)
 	p, isPrecompile := evm.precompile(addr)
 	debug := evm.Config.Tracer != nil
 
@@ -235,6 +477,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 		evm.StateDB.CreateAccount(addr)
 	}
 	evm.Context.Transfer(evm.StateDB, caller.Address(), addr, value)
+	evm.trackTransfer(caller.Address(), addr, value)
 
 	// Capture the tracer start/end events in debug mode
 	if debug {
@@ -253,7 +496,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	}
 
 	if isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+		ret, gas, err = evm.runPrecompile(p, input, gas)
 	} else {
 		// Initialise a new contract and set the code that is to be used by the EVM.
 		// The contract is a scoped environment for this execution context only.
@@ -275,6 +518,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	// when we're in homestead this also counts for code storage gas errors.
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
+		evm.revertTransfers(mark)
 		if err != ErrExecutionReverted {
 			gas = 0
 		}
@@ -297,6 +541,9 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 	if evm.depth > int(params.CallCreateDepth) {
 		return nil, gas, ErrDepth
 	}
+	if err := evm.countInternalCall(); err != nil {
+		return nil, gas, err
+	}
 	// Fail if we're trying to transfer more than the available balance
 	// Note although it's noop to transfer X ether to caller itself. But
 	// if caller doesn't have enough balance, it would be an error to allow
@@ -305,6 +552,7 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 		return nil, gas, ErrInsufficientBalance
 	}
 	var snapshot = evm.StateDB.Snapshot()
+	mark := len(evm.transfers)
 
 	// Invoke tracer hooks that signal entering/exiting a call frame
 	if evm.Config.Tracer != nil {
@@ -316,7 +564,7 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 
 	// It is allowed to call precompiles, even via delegatecall
 	if p, isPrecompile := evm.precompile(addr); isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+		ret, gas, err = evm.runPrecompile(p, input, gas)
 	} else {
 		addrCopy := addr
 		// Initialise a new contract and set the code that is to be used by the EVM.
@@ -328,6 +576,7 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
+		evm.revertTransfers(mark)
 		if err != ErrExecutionReverted {
 			gas = 0
 		}
@@ -345,7 +594,11 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 	if evm.depth > int(params.CallCreateDepth) {
 		return nil, gas, ErrDepth
 	}
+	if err := evm.countInternalCall(); err != nil {
+		return nil, gas, err
+	}
 	var snapshot = evm.StateDB.Snapshot()
+	mark := len(evm.transfers)
 
 	// Invoke tracer hooks that signal entering/exiting a call frame
 	if evm.Config.Tracer != nil {
@@ -361,7 +614,7 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 
 	// It is allowed to call precompiles, even via delegatecall
 	if p, isPrecompile := evm.precompile(addr); isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+		ret, gas, err = evm.runPrecompile(p, input, gas)
 	} else {
 		addrCopy := addr
 		// Initialise a new contract and make initialise the delegate values
@@ -372,6 +625,7 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
+		evm.revertTransfers(mark)
 		if err != ErrExecutionReverted {
 			gas = 0
 		}
@@ -388,6 +642,9 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 	if evm.depth > int(params.CallCreateDepth) {
 		return nil, gas, ErrDepth
 	}
+	if err := evm.countInternalCall(); err != nil {
+		return nil, gas, err
+	}
 	// We take a snapshot here. This is a bit counter-intuitive, and could probably be skipped.
 	// However, even a staticcall is considered a 'touch'. On mainnet, static calls were introduced
 	// after all empty accounts were deleted, so this is not required. However, if we omit this,
@@ -410,7 +667,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 	}
 
 	if p, isPrecompile := evm.precompile(addr); isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+		ret, gas, err = evm.runPrecompile(p, input, gas)
 	} else {
 		// At this point, we use a copy of address. If we don't, the go compiler will
 		// leak the 'contract' to the outer scope, and make allocation for 'contract'
@@ -454,6 +711,9 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 	if evm.depth > int(params.CallCreateDepth) {
 		return nil, common.Address{}, gas, ErrDepth
 	}
+	if err := evm.countInternalCall(); err != nil {
+		return nil, common.Address{}, gas, err
+	}
 	if !evm.Context.CanTransfer(evm.StateDB, caller.Address(), value) {
 		return nil, common.Address{}, gas, ErrInsufficientBalance
 	}
@@ -474,11 +734,13 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 	}
 	// Create a new account on the state
 	snapshot := evm.StateDB.Snapshot()
+	mark := len(evm.transfers)
 	evm.StateDB.CreateAccount(address)
 	if evm.chainRules.IsEIP158 {
 		evm.StateDB.SetNonce(address, 1)
 	}
 	evm.Context.Transfer(evm.StateDB, caller.Address(), address, value)
+	evm.trackTransfer(caller.Address(), address, value)
 
 	// Initialise a new contract and set the code that is to be used by the EVM.
 	// The contract is a scoped environment for this execution context only.
@@ -523,6 +785,7 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 	// when we're in homestead this also counts for code storage gas errors.
 	if err != nil && (evm.chainRules.IsHomestead || err != ErrCodeStoreOutOfGas) {
 		evm.StateDB.RevertToSnapshot(snapshot)
+		evm.revertTransfers(mark)
 		if err != ErrExecutionReverted {
 			contract.UseGas(contract.Gas)
 		}
@@ -540,10 +803,19 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 
 // Create creates a new contract using code as deployment code.
 func (evm *EVM) Create(caller ContractRef, code []byte, gas uint64, value *uint256.Int) (ret []byte, contractAddr common.Address, leftOverGas uint64, err error) {
-	contractAddr = crypto.CreateAddress(caller.Address(), evm.StateDB.GetNonce(caller.Address()))
+	contractAddr = evm.CreateAddress(caller.Address(), evm.StateDB.GetNonce(caller.Address()))
 	return evm.create(caller, &codeAndHash{code: code}, gas, value, contractAddr, CREATE)
 }
 
+// CreateAddress returns the address of the contract deployed by creator with the
+// given nonce using CREATE, honouring Config.ContractAddressFunc if set.
+func (evm *EVM) CreateAddress(creator common.Address, nonce uint64) common.Address {
+	if evm.Config.ContractAddressFunc != nil {
+		return evm.Config.ContractAddressFunc(creator, nonce)
+	}
+	return crypto.CreateAddress(creator, nonce)
+}
+
 // Create2 creates a new contract using code as deployment code.
 //
 // The different between Create2 with Create is Create2 uses keccak256(0xff ++ msg.sender ++ salt ++ keccak256(init_code))[12:]
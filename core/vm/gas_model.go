@@ -0,0 +1,70 @@
+package vm
+
+import "math"
+
+// OpcodeCategory groups opcodes with similar resource usage for gas modeling.
+type OpcodeCategory uint8
+
+const (
+	ComputeCategory OpcodeCategory = iota // Arithmetic, stack and control flow operations
+	MemoryCategory                        // Memory and calldata/returndata/code copy operations
+	HashCategory                          // KECCAK256
+	StorageCategory                       // Persistent and transient storage operations
+	AccountCategory                       // Operations accessing other accounts
+	LogCategory                           // LOG0 to LOG4
+	CallCategory                          // Message calls, contract creation and self-destruction
+)
+
+// Category returns the gas modeling category of the opcode.
+func (op OpCode) Category() OpcodeCategory {
+	switch op {
+	case MLOAD, MSTORE, MSTORE8, MCOPY, CALLDATACOPY, CODECOPY, RETURNDATACOPY, MSIZE:
+		return MemoryCategory
+	case KECCAK256:
+		return HashCategory
+	case SLOAD, SSTORE, TLOAD, TSTORE:
+		return StorageCategory
+	case BALANCE, EXTCODESIZE, EXTCODECOPY, EXTCODEHASH, SELFBALANCE:
+		return AccountCategory
+	case LOG0, LOG1, LOG2, LOG3, LOG4:
+		return LogCategory
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL, AUTHCALL, CREATE, CREATE2, SELFDESTRUCT:
+		return CallCategory
+	default:
+		return ComputeCategory
+	}
+}
+
+// OpcodeGasModel reweights the gas cost of opcode categories, which allows to
+// estimate the impact of a gas repricing on historical blocks. Categories not in
+// the model keep their cost. Executing with anything but the identity model
+// breaks consensus and must only be used for research.
+//
+// For message calls only the constant portion of the cost is reweighted, as the
+// dynamic portion contains the gas forwarded to the callee.
+type OpcodeGasModel map[OpcodeCategory]float64
+
+// IdentityGasModel is the gas model leaving the cost of all opcodes unchanged.
+var IdentityGasModel = OpcodeGasModel{}
+
+// cost returns the reweighted gas cost of op.
+func (m OpcodeGasModel) cost(op OpCode, cost uint64) uint64 {
+	weight, ok := m[op.Category()]
+	if !ok {
+		return cost
+	}
+	scaled := float64(cost) * weight
+	if scaled >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(scaled)
+}
+
+// isCall returns whether the dynamic gas of op includes gas forwarded to a callee.
+func (op OpCode) isCall() bool {
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL, AUTHCALL:
+		return true
+	}
+	return false
+}
@@ -476,7 +476,11 @@ func opDifficulty(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext)
 }
 
 func opRandom(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	v := new(uint256.Int).SetBytes(interpreter.evm.Context.Random.Bytes())
+	v := new(uint256.Int)
+	// Random is only missing if merge semantics are forced onto a pre-merge block
+	if random := interpreter.evm.Context.Random; random != nil {
+		v.SetBytes(random.Bytes())
+	}
 	scope.Stack.push(v)
 	return nil, nil
 }
@@ -516,6 +520,9 @@ func opSload(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]by
 	hash := common.Hash(loc.Bytes32())
 	val := interpreter.evm.StateDB.GetState(scope.Contract.Address(), hash)
 	loc.SetBytes(val.Bytes())
+	if accesses := interpreter.evm.slotAccesses; accesses != nil {
+		accesses[StorageSlot{scope.Contract.Address(), hash}]++
+	}
 	return nil, nil
 }
 
@@ -525,7 +532,13 @@ func opSstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 	}
 	loc := scope.Stack.pop()
 	val := scope.Stack.pop()
+	if interpreter.evm.Config.FlagRedundantStorageWrites && interpreter.evm.StateDB.GetState(scope.Contract.Address(), loc.Bytes32()) == val.Bytes32() {
+		interpreter.evm.redundantWrites = append(interpreter.evm.redundantWrites, StorageSlot{scope.Contract.Address(), loc.Bytes32()})
+	}
 	interpreter.evm.StateDB.SetState(scope.Contract.Address(), loc.Bytes32(), val.Bytes32())
+	if accesses := interpreter.evm.slotAccesses; accesses != nil {
+		accesses[StorageSlot{scope.Contract.Address(), loc.Bytes32()}]++
+	}
 	return nil, nil
 }
 
@@ -593,6 +606,11 @@ func opCreate(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 	scope.Contract.UseGas(gas)
 
 	res, addr, returnGas, suberr := interpreter.evm.Create(scope.Contract, input, gas, &value)
+	// Exceeding Config.MaxInternalCalls aborts the transaction instead of only
+	// failing the sub-call.
+	if suberr == ErrInternalCallLimit {
+		return nil, suberr
+	}
 	// Push item on the stack based on the returned error. If the ruleset is
 	// homestead we must check for CodeStoreOutOfGasError (homestead only
 	// rule) and treat as an error, if the ruleset is frontier we must
@@ -633,6 +651,9 @@ func opCreate2(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]
 	stackvalue := size
 	res, addr, returnGas, suberr := interpreter.evm.Create2(scope.Contract, input, gas,
 		&endowment, &salt)
+	if suberr == ErrInternalCallLimit {
+		return nil, suberr
+	}
 	// Push item on the stack based on the returned error.
 	if suberr != nil {
 		stackvalue.Clear()
@@ -669,7 +690,9 @@ func opCall(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byt
 		gas += params.CallStipend
 	}
 	ret, returnGas, err := interpreter.evm.Call(scope.Contract, toAddr, args, gas, &value)
-
+	if err == ErrInternalCallLimit {
+		return nil, err
+	}
 	if err != nil {
 		temp.Clear()
 	} else {
@@ -702,6 +725,9 @@ func opCallCode(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([
 	}
 
 	ret, returnGas, err := interpreter.evm.CallCode(scope.Contract, toAddr, args, gas, &value)
+	if err == ErrInternalCallLimit {
+		return nil, err
+	}
 	if err != nil {
 		temp.Clear()
 	} else {
@@ -730,6 +756,9 @@ func opDelegateCall(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext
 	args := scope.Memory.GetPtr(int64(inOffset.Uint64()), int64(inSize.Uint64()))
 
 	ret, returnGas, err := interpreter.evm.DelegateCall(scope.Contract, toAddr, args, gas)
+	if err == ErrInternalCallLimit {
+		return nil, err
+	}
 	if err != nil {
 		temp.Clear()
 	} else {
@@ -758,6 +787,9 @@ func opStaticCall(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext)
 	args := scope.Memory.GetPtr(int64(inOffset.Uint64()), int64(inSize.Uint64()))
 
 	ret, returnGas, err := interpreter.evm.StaticCall(scope.Contract, toAddr, args, gas)
+	if err == ErrInternalCallLimit {
+		return nil, err
+	}
 	if err != nil {
 		temp.Clear()
 	} else {
@@ -804,6 +836,9 @@ func opSelfdestruct(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext
 	balance := interpreter.evm.StateDB.GetBalance(scope.Contract.Address())
 	interpreter.evm.StateDB.AddBalance(beneficiary.Bytes20(), balance)
 	interpreter.evm.StateDB.SelfDestruct(scope.Contract.Address())
+	if interpreter.evm.Config.TrackSelfdestructValue && beneficiary.Bytes20() != scope.Contract.Address() && !balance.IsZero() {
+		interpreter.evm.StateDB.AddSelfdestructTransfer(beneficiary.Bytes20(), balance)
+	}
 	if tracer := interpreter.evm.Config.Tracer; tracer != nil {
 		tracer.CaptureEnter(SELFDESTRUCT, scope.Contract.Address(), beneficiary.Bytes20(), []byte{}, 0, balance.ToBig())
 		tracer.CaptureExit([]byte{}, 0, nil)
@@ -820,6 +855,9 @@ func opSelfdestruct6780(pc *uint64, interpreter *EVMInterpreter, scope *ScopeCon
 	interpreter.evm.StateDB.SubBalance(scope.Contract.Address(), balance)
 	interpreter.evm.StateDB.AddBalance(beneficiary.Bytes20(), balance)
 	interpreter.evm.StateDB.Selfdestruct6780(scope.Contract.Address())
+	if interpreter.evm.Config.TrackSelfdestructValue && beneficiary.Bytes20() != scope.Contract.Address() && !balance.IsZero() {
+		interpreter.evm.StateDB.AddSelfdestructTransfer(beneficiary.Bytes20(), balance)
+	}
 	if tracer := interpreter.evm.Config.Tracer; tracer != nil {
 		tracer.CaptureEnter(SELFDESTRUCT, scope.Contract.Address(), beneficiary.Bytes20(), []byte{}, 0, balance.ToBig())
 		tracer.CaptureExit([]byte{}, 0, nil)
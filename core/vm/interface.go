@@ -57,6 +57,10 @@ type StateDB interface {
 
 	Selfdestruct6780(common.Address)
 
+	// AddSelfdestructTransfer records the value sent to the beneficiary of a
+	// self-destruct, subject to reverts.
+	AddSelfdestructTransfer(beneficiary common.Address, value *uint256.Int)
+
 	// Exist reports whether the given account exists in state.
 	// Notably this should also return true for self-destructed accounts.
 	Exist(common.Address) bool
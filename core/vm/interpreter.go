@@ -17,7 +17,9 @@
 package vm
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
@@ -38,6 +40,35 @@ type Config struct {
 	NoRecursion             bool      // Disables call, callcode, delegate call and create
 	EnablePreimageRecording bool      // Enables recording of SHA3/keccak preimages
 	ExtraEips               []int     // Additional EIPS that are to be enabled
+
+	OpcodeGasModel     OpcodeGasModel // Reweights opcode gas costs for research, breaking consensus (nil = canonical costs)
+	OpcodeBehaviorFork *string        // Forces the opcode semantics of the named fork (e.g. "london", "merge"), breaking consensus (nil = block's fork)
+
+	TrackTransientStorage  bool // Counts the TLOAD and TSTORE operations of every normal transaction per contract
+	TrackSelfdestructValue bool // Aggregates the value sent to every beneficiary of a self-destruct in the block
+	TrackRevertedTransfers bool // Records the value transfers of normal transactions rolled back by failing calls
+	ExportSlotHeatmap      bool // Counts the SLOAD and SSTORE accesses of every storage slot by the normal transactions of a block
+	TrackPrecompileGas     bool // Accounts the gas consumed by precompiled contracts in normal transactions separately
+	TrackMaxDepth          bool // Records the deepest call depth reached by every normal transaction
+	ProfileOpcodes         bool // Measures the time spent per call stack and opcode, see EVM.TakeOpcodeProfile
+
+	MaxInternalCalls int // Maximum number of sub-calls and creations per transaction, failing the ones exceeding it, breaking consensus (0 = unlimited)
+
+	OnColdAccess        func(txIndex int, addr common.Address, slot *common.Hash) // Invoked on every EIP-2929 cold access of an account (nil slot) or storage slot, see EVM.coldAccess
+	ContractAddressFunc func(origin common.Address, nonce uint64) common.Address  // Derives the address of contracts deployed by CREATE and creation transactions, breaking consensus (nil = keccak)
+
+	FlagRedundantStorageWrites bool // Flags the SSTOREs of normal transactions writing the value a slot already holds
+}
+
+// Validate reports the options of the config that can not be honoured, so that
+// they are rejected upfront instead of executing with different semantics.
+func (c *Config) Validate() error {
+	if fork := c.OpcodeBehaviorFork; fork != nil {
+		if _, ok := forkInstructionSets[*fork]; !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownOpcodeFork, *fork)
+		}
+	}
+	return nil
 }
 
 // ScopeContext contains the things that are per-call, such as stack and memory,
@@ -58,6 +89,8 @@ type EVMInterpreter struct {
 
 	readOnly   bool   // Whether to throw on stateful modifications
 	returnData []byte // Last CALL's return data for subsequent reuse
+
+	err error // Invalid configuration failing every execution, see Config.Validate
 }
 
 // NewEVMInterpreter returns a new instance of the Interpreter.
@@ -90,6 +123,12 @@ func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 	default:
 		table = &frontierInstructionSet
 	}
+	// Refuse to execute anything with an unknown forced fork rather than falling
+	// back to the semantics of the block's one
+	err := evm.Config.Validate()
+	if fork := evm.Config.OpcodeBehaviorFork; fork != nil && err == nil {
+		table = forkInstructionSets[*fork]
+	}
 
 	var extraEips []int
 	if len(evm.Config.ExtraEips) > 0 {
@@ -110,6 +149,7 @@ func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 	evmInterpreter.table = table
 	evmInterpreter.readOnly = false
 	evmInterpreter.returnData = nil
+	evmInterpreter.err = err
 
 	return evmInterpreter
 }
@@ -121,9 +161,15 @@ func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 // considered a revert-and-consume-all-gas operation except for
 // ErrExecutionReverted which means revert-and-keep-gas-left.
 func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (ret []byte, err error) {
+	if in.err != nil {
+		return nil, in.err
+	}
 	// Increment the call depth which is restricted to 1024
 	in.evm.depth++
 	defer func() { in.evm.depth-- }()
+	if in.evm.Config.TrackMaxDepth && in.evm.depth > in.evm.maxDepth {
+		in.evm.maxDepth = in.evm.depth
+	}
 
 	// Make sure the readOnly is only set if we aren't in readOnly yet.
 	// This also makes sure that the readOnly flag isn't removed for child calls.
@@ -161,6 +207,8 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		logged  bool   // deferred EVMLogger should ignore already logged steps
 		res     []byte // result of the opcode execution function
 		debug   = in.evm.Config.Tracer != nil
+		profile = in.evm.Config.ProfileOpcodes
+		opStart time.Time // start of the opcode execution, if profiling
 	)
 	// Don't move this deferred function, it's placed before the capturestate-deferred method,
 	// so that it gets executed _after_: the capturestate needs the stacks before
@@ -170,6 +218,10 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 	}()
 	contract.Input = input
 
+	if profile {
+		in.evm.enterProfileFrame(contract)
+		defer in.evm.exitProfileFrame(time.Now())
+	}
 	if debug {
 		defer func() {
 			if err != nil {
@@ -195,6 +247,9 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		op = contract.GetOp(pc)
 		operation := in.table[op]
 		cost = operation.constantGas // For tracing
+		if in.evm.Config.OpcodeGasModel != nil {
+			cost = in.evm.Config.OpcodeGasModel.cost(op, cost)
+		}
 		// Validate stack
 		if sLen := stack.len(); sLen < operation.minStack {
 			return nil, &ErrStackUnderflow{stackLen: sLen, required: operation.minStack}
@@ -227,6 +282,9 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			// cost is explicitly set so that the capture state defer method can get the proper cost
 			var dynamicCost uint64
 			dynamicCost, err = operation.dynamicGas(in.evm, contract, stack, mem, memorySize)
+			if in.evm.Config.OpcodeGasModel != nil && !op.isCall() {
+				dynamicCost = in.evm.Config.OpcodeGasModel.cost(op, dynamicCost)
+			}
 			cost += dynamicCost // for tracing
 			if err != nil || !contract.UseGas(dynamicCost) {
 				return nil, ErrOutOfGas
@@ -244,7 +302,13 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			logged = true
 		}
 		// execute the operation
+		if profile {
+			in.evm.profileCallee, opStart = 0, time.Now()
+		}
 		res, err = operation.execute(&pc, in, callContext)
+		if profile {
+			in.evm.profileOpcode(op, time.Since(opStart))
+		}
 		if err != nil {
 			break
 		}
@@ -59,6 +59,23 @@ var (
 	cancunInstructionSet           = newCancunInstructionSet()
 )
 
+// forkInstructionSets maps fork names to their instruction sets, as selectable
+// through Config.OpcodeBehaviorFork.
+var forkInstructionSets = map[string]*JumpTable{
+	"frontier":         &frontierInstructionSet,
+	"homestead":        &homesteadInstructionSet,
+	"tangerineWhistle": &tangerineWhistleInstructionSet,
+	"spuriousDragon":   &spuriousDragonInstructionSet,
+	"byzantium":        &byzantiumInstructionSet,
+	"constantinople":   &constantinopleInstructionSet,
+	"istanbul":         &istanbulInstructionSet,
+	"berlin":           &berlinInstructionSet,
+	"london":           &londonInstructionSet,
+	"merge":            &mergeInstructionSet,
+	"shanghai":         &shanghaiInstructionSet,
+	"cancun":           &cancunInstructionSet,
+}
+
 // JumpTable contains the EVM opcodes supported at a given fork.
 type JumpTable [256]*operation
 
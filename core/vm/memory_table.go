@@ -78,6 +78,11 @@ func memoryCall(stack *Stack) (uint64, bool) {
 	}
 	return y, false
 }
+
+func memoryAuth(stack *Stack) (uint64, bool) {
+	return calcMemSize64(stack.Back(1), stack.Back(2))
+}
+
 func memoryDelegateCall(stack *Stack) (uint64, bool) {
 	x, overflow := calcMemSize64(stack.Back(4), stack.Back(5))
 	if overflow {
@@ -42,6 +42,7 @@ func makeGasSStoreFunc(clearingRefund uint64) gasFunc {
 			cost = params.ColdSloadCostEIP2929
 			// If the caller cannot afford the cost, this change will be rolled back
 			evm.StateDB.AddSlotToAccessList(contract.Address(), slot)
+			evm.coldAccess(contract.Address(), &slot)
 			if !addrPresent {
 				// Once we're done with YOLOv2 and schedule this for mainnet, might
 				// be good to remove this panic here, which is just really a
@@ -108,6 +109,7 @@ func gasSLoadEIP2929(evm *EVM, contract *Contract, stack *Stack, mem *Memory, me
 		// If the caller cannot afford the cost, this change will be rolled back
 		// If he does afford it, we can skip checking the same thing later on, during execution
 		evm.StateDB.AddSlotToAccessList(contract.Address(), slot)
+		evm.coldAccess(contract.Address(), &slot)
 		return params.ColdSloadCostEIP2929, nil
 	}
 	return params.WarmStorageReadCostEIP2929, nil
@@ -128,6 +130,7 @@ func gasExtCodeCopyEIP2929(evm *EVM, contract *Contract, stack *Stack, mem *Memo
 	// Check slot presence in the access list
 	if !evm.StateDB.AddressInAccessList(addr) {
 		evm.StateDB.AddAddressToAccessList(addr)
+		evm.coldAccess(addr, nil)
 		var overflow bool
 		// We charge (cold-warm), since 'warm' is already charged as constantGas
 		if gas, overflow = math.SafeAdd(gas, params.ColdAccountAccessCostEIP2929-params.WarmStorageReadCostEIP2929); overflow {
@@ -151,6 +154,7 @@ func gasEip2929AccountCheck(evm *EVM, contract *Contract, stack *Stack, mem *Mem
 	if !evm.StateDB.AddressInAccessList(addr) {
 		// If the caller cannot afford the cost, this change will be rolled back
 		evm.StateDB.AddAddressToAccessList(addr)
+		evm.coldAccess(addr, nil)
 		// The warm storage read cost is already charged as constantGas
 		return params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929, nil
 	}
@@ -167,6 +171,7 @@ func makeCallVariantGasCallEIP2929(oldCalculator gasFunc) gasFunc {
 		coldCost := params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929
 		if !warmAccess {
 			evm.StateDB.AddAddressToAccessList(addr)
+			evm.coldAccess(addr, nil)
 			// Charge the remaining difference here already, to correctly calculate available
 			// gas for call
 			if !contract.UseGas(coldCost) {
@@ -196,6 +201,41 @@ func makeCallVariantGasCallEIP2929(oldCalculator gasFunc) gasFunc {
 	}
 }
 
+// gasAuth charges the memory expansion of AUTH together with the EIP-2929 access
+// cost of the authority, warming it up if needed.
+func gasAuth(evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
+	gas, err := memoryGasCost(mem, memorySize)
+	if err != nil {
+		return 0, err
+	}
+	addr := common.Address(stack.peek().Bytes20())
+	cost := params.WarmStorageReadCostEIP2929
+	if !evm.StateDB.AddressInAccessList(addr) {
+		evm.StateDB.AddAddressToAccessList(addr)
+		evm.coldAccess(addr, nil)
+		cost = params.ColdAccountAccessCostEIP2929
+	}
+	var overflow bool
+	if gas, overflow = math.SafeAdd(gas, cost); overflow {
+		return 0, ErrGasUintOverflow
+	}
+	return gas, nil
+}
+
+// coldAccess notifies Config.OnColdAccess, if set, of the first access of an
+// account or, if slot is non-nil, of a storage slot in the current transaction.
+//
+// The accesses are reported as they are charged, including the ones of call
+// frames which later revert. As a revert also rolls back the warming, the next
+// access of the same account or slot is reported again. The reported index is
+// TxContext.TxIndex, which only block processing sets: messages applied directly,
+// e.g. by eth_call or tracing, report 0.
+func (evm *EVM) coldAccess(addr common.Address, slot *common.Hash) {
+	if evm.Config.OnColdAccess != nil {
+		evm.Config.OnColdAccess(evm.TxIndex, addr, slot)
+	}
+}
+
 var (
 	gasCallEIP2929         = makeCallVariantGasCallEIP2929(gasCall)
 	gasDelegateCallEIP2929 = makeCallVariantGasCallEIP2929(gasDelegateCall)
@@ -234,6 +274,7 @@ func makeSelfdestructGasFn(refundsEnabled bool) gasFunc {
 		if !evm.StateDB.AddressInAccessList(address) {
 			// If the caller cannot afford the cost, this change will be rolled back
 			evm.StateDB.AddAddressToAccessList(address)
+			evm.coldAccess(address, nil)
 			gas = params.ColdAccountAccessCostEIP2929
 		}
 		// if empty and transfers value
@@ -17,6 +17,7 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
@@ -32,6 +33,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth/tracers"
 	"github.com/ethereum/go-ethereum/eth/tracers/logger"
 	"github.com/ethereum/go-ethereum/params"
@@ -677,6 +679,193 @@ func TestColdAccountAccessCost(t *testing.T) {
 	}
 }
 
+// TestEip3074AuthCall checks that an invoker can AUTH with a signature of an
+// EOA and AUTHCALL on its behalf, with the callee observing the EOA as caller.
+func TestEip3074AuthCall(t *testing.T) {
+	var (
+		key, _    = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		authority = crypto.PubkeyToAddress(key.PublicKey)
+		invoker   = common.HexToAddress("0xaa")
+		target    = common.HexToAddress("0xbb")
+		commit    = common.HexToHash("0xc0ffee")
+	)
+	// The invoker copies the signature and commit from calldata, authorizes the
+	// authority (storing the AUTH result in slot 0) and calls the target.
+	code := []byte{
+		byte(vm.PUSH1), 97, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+		byte(vm.PUSH1), 97, byte(vm.PUSH1), 0, byte(vm.PUSH20),
+	}
+	code = append(code, authority.Bytes()...)
+	code = append(code, byte(vm.AUTH), byte(vm.PUSH1), 0, byte(vm.SSTORE))
+	code = append(code,
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH20),
+	)
+	code = append(code, target.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.AUTHCALL), byte(vm.POP), byte(vm.STOP))
+
+	// sign creates the AUTH input for a commitment bound to the given invoker.
+	sign := func(invoker common.Address) []byte {
+		msg := make([]byte, 129)
+		msg[0] = 0x04
+		msg[32] = 1 // chain id
+		copy(msg[77:97], invoker.Bytes())
+		copy(msg[97:], commit.Bytes())
+		sig, err := crypto.Sign(crypto.Keccak256(msg), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(append([]byte{sig[64]}, sig[:64]...), commit.Bytes()...)
+	}
+	for i, tc := range []struct {
+		eips  []int
+		input []byte
+		err   string
+	}{
+		{eips: []int{3074}, input: sign(invoker)},
+		{eips: []int{3074}, input: sign(target), err: vm.ErrAuthorizedNotSet.Error()},
+		{input: sign(invoker), err: "invalid opcode: AUTH"},
+	} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(invoker, code)
+		statedb.SetCode(target, []byte{byte(vm.CALLER), byte(vm.PUSH1), 0, byte(vm.SSTORE)})
+
+		_, _, err := Call(invoker, tc.input, &Config{State: statedb, EVMConfig: vm.Config{ExtraEips: tc.eips}})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("testcase %d: error mismatch: have %v, want %v", i, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("testcase %d: unexpected error: %v", i, err)
+		}
+		if have := statedb.GetState(invoker, common.Hash{}); have != common.BigToHash(big.NewInt(1)) {
+			t.Errorf("testcase %d: wrong AUTH result: have %x, want 1", i, have)
+		}
+		if have, want := statedb.GetState(target, common.Hash{}), common.BytesToHash(authority.Bytes()); have != want {
+			t.Errorf("testcase %d: wrong caller observed by target: have %x, want %x", i, have, want)
+		}
+	}
+}
+
+// TestEip3074AuthCallInternalCallLimit checks that AUTHCALLs exceeding the
+// internal call limit abort the whole execution, like the other calls.
+func TestEip3074AuthCallInternalCallLimit(t *testing.T) {
+	var (
+		key, _    = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		authority = crypto.PubkeyToAddress(key.PublicKey)
+		invoker   = common.HexToAddress("0xaa")
+		target    = common.HexToAddress("0xbb")
+		commit    = common.HexToHash("0xc0ffee")
+	)
+	// The invoker authorizes the authority, storing the AUTH result in slot 0, and
+	// calls the target three times.
+	code := []byte{
+		byte(vm.PUSH1), 97, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+		byte(vm.PUSH1), 97, byte(vm.PUSH1), 0, byte(vm.PUSH20),
+	}
+	code = append(code, authority.Bytes()...)
+	code = append(code, byte(vm.AUTH), byte(vm.PUSH1), 0, byte(vm.SSTORE))
+	for i := 0; i < 3; i++ {
+		code = append(code,
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+			byte(vm.PUSH20),
+		)
+		code = append(code, target.Bytes()...)
+		code = append(code, byte(vm.PUSH2), 0xff, 0xff, byte(vm.AUTHCALL), byte(vm.POP))
+	}
+	code = append(code, byte(vm.STOP))
+
+	msg := make([]byte, 129)
+	msg[0] = 0x04
+	msg[32] = 1 // chain id
+	copy(msg[77:97], invoker.Bytes())
+	copy(msg[97:], commit.Bytes())
+	sig, err := crypto.Sign(crypto.Keccak256(msg), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := append(append([]byte{sig[64]}, sig[:64]...), commit.Bytes()...)
+
+	for i, tc := range []struct {
+		limit int
+		err   error
+	}{
+		{limit: 3},
+		{limit: 2, err: vm.ErrInternalCallLimit},
+	} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(invoker, code)
+		statedb.SetCode(target, []byte{byte(vm.CALLER), byte(vm.PUSH1), 0, byte(vm.SSTORE)})
+
+		cfg := &Config{State: statedb, EVMConfig: vm.Config{ExtraEips: []int{3074}, MaxInternalCalls: tc.limit}}
+		if _, _, err := Call(invoker, input, cfg); !errors.Is(err, tc.err) {
+			t.Fatalf("testcase %d: error mismatch: have %v, want %v", i, err, tc.err)
+		}
+		// An aborted execution reverts all writes, including the ones before the
+		// calls exceeding the limit
+		want := common.BigToHash(big.NewInt(1))
+		if tc.err != nil {
+			want = common.Hash{}
+		}
+		if have := statedb.GetState(invoker, common.Hash{}); have != want {
+			t.Errorf("testcase %d: AUTH result slot mismatch: have %x, want %x", i, have, want)
+		}
+	}
+}
+
+// TestOpcodeBehaviorFork checks that forcing the opcode semantics of a fork
+// toggles between the DIFFICULTY and PREVRANDAO meaning of opcode 0x44.
+func TestOpcodeBehaviorFork(t *testing.T) {
+	var (
+		code = []byte{
+			byte(vm.DIFFICULTY), byte(vm.PUSH1), 0, byte(vm.MSTORE),
+			byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN),
+		}
+		difficulty = big.NewInt(7)
+		random     = common.HexToHash("0x1234")
+		london     = "london"
+		merge      = "merge"
+	)
+	for i, tc := range []struct {
+		random *common.Hash
+		fork   *string
+		want   common.Hash
+	}{
+		{random: &random, want: random},
+		{random: &random, fork: &london, want: common.BigToHash(difficulty)},
+		{want: common.BigToHash(difficulty)},
+		{fork: &merge, want: common.Hash{}},
+	} {
+		ret, _, err := Execute(code, nil, &Config{
+			Difficulty: difficulty,
+			Random:     tc.random,
+			EVMConfig:  vm.Config{OpcodeBehaviorFork: tc.fork},
+		})
+		if err != nil {
+			t.Fatalf("testcase %d: failed to execute: %v", i, err)
+		}
+		if have := common.BytesToHash(ret); have != tc.want {
+			t.Errorf("testcase %d: result mismatch: have %x, want %x", i, have, tc.want)
+		}
+	}
+}
+
+// TestOpcodeBehaviorForkUnknown checks that an unknown forced fork fails the
+// execution instead of falling back to the semantics of the block's fork.
+func TestOpcodeBehaviorForkUnknown(t *testing.T) {
+	fork := "londn"
+	cfg := vm.Config{OpcodeBehaviorFork: &fork}
+	if err := cfg.Validate(); !errors.Is(err, vm.ErrUnknownOpcodeFork) {
+		t.Errorf("config validation error mismatch: have %v, want %v", err, vm.ErrUnknownOpcodeFork)
+	}
+	_, _, err := Execute([]byte{byte(vm.STOP)}, nil, &Config{EVMConfig: cfg})
+	if !errors.Is(err, vm.ErrUnknownOpcodeFork) {
+		t.Errorf("execution error mismatch: have %v, want %v", err, vm.ErrUnknownOpcodeFork)
+	}
+}
+
 func TestRuntimeJSTracer(t *testing.T) {
 	jsTracers := []string{
 		`{enters: 0, exits: 0, enterGas: 0, gasUsed: 0, steps:0,
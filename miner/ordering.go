@@ -17,6 +17,7 @@
 package miner
 
 import (
+	"bytes"
 	"container/heap"
 	"math/big"
 
@@ -56,14 +57,21 @@ func newTxWithMinerFee(tx *txpool.LazyTransaction, from common.Address, baseFee
 
 // txByPriceAndTime implements both the sort and the heap interface, making it useful
 // for all at once sorting as well as individually adding and removing elements.
+//
+// Transactions are ordered by descending miner fee. Ties are broken by the time
+// the transactions were first seen, earliest first, and then by ascending hash,
+// so that the assembled order never depends on the iteration order of the pool.
 type txByPriceAndTime []*txWithMinerFee
 
 func (s txByPriceAndTime) Len() int { return len(s) }
 func (s txByPriceAndTime) Less(i, j int) bool {
 	// If the prices are equal, use the time the transaction was first seen for
-	// deterministic sorting
+	// deterministic sorting, falling back to the hash if seen at the same time
 	cmp := s[i].fees.Cmp(s[j].fees)
 	if cmp == 0 {
+		if s[i].tx.Time.Equal(s[j].tx.Time) {
+			return bytes.Compare(s[i].tx.Hash[:], s[j].tx.Hash[:]) < 0
+		}
 		return s[i].tx.Time.Before(s[j].tx.Time)
 	}
 	return cmp > 0
@@ -17,6 +17,7 @@
 package miner
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"math/big"
 	"math/rand"
@@ -194,3 +195,57 @@ func TestTransactionTimeSort(t *testing.T) {
 		}
 	}
 }
+
+// Tests that transactions with the same price seen at the same time are ordered
+// by hash, so that repeatedly assembling the same set yields the same order.
+func TestTransactionHashSort(t *testing.T) {
+	t.Parallel()
+	// Generate a batch of accounts to start with
+	keys := make([]*ecdsa.PrivateKey, 8)
+	for i := 0; i < len(keys); i++ {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	signer := types.HomesteadSigner{}
+	seen := time.Unix(0, 1)
+
+	var first types.Transactions
+	for run := 0; run < 10; run++ {
+		// The set reowns the input map, so it needs to be recreated for every run
+		groups := map[common.Address][]*txpool.LazyTransaction{}
+		for _, key := range keys {
+			tx, _ := types.SignTx(types.NewTransaction(0, common.Address{}, big.NewInt(100), 100, big.NewInt(1), nil), signer, key)
+			groups[crypto.PubkeyToAddress(key.PublicKey)] = []*txpool.LazyTransaction{{
+				Hash:      tx.Hash(),
+				Tx:        tx,
+				Time:      seen,
+				GasFeeCap: uint256.MustFromBig(tx.GasFeeCap()),
+				GasTipCap: uint256.MustFromBig(tx.GasTipCap()),
+				Gas:       tx.Gas(),
+			}}
+		}
+		txset := newTransactionsByPriceAndNonce(signer, groups, nil)
+
+		txs := types.Transactions{}
+		for tx, _ := txset.Peek(); tx != nil; tx, _ = txset.Peek() {
+			txs = append(txs, tx.Tx)
+			txset.Shift()
+		}
+		if len(txs) != len(keys) {
+			t.Fatalf("run %d: expected %d transactions, found %d", run, len(keys), len(txs))
+		}
+		for i := 0; i+1 < len(txs); i++ {
+			if hi, hj := txs[i].Hash(), txs[i+1].Hash(); bytes.Compare(hi[:], hj[:]) >= 0 {
+				t.Errorf("run %d: invalid hash ordering: tx #%d (H=%x) >= tx #%d (H=%x)", run, i, hi[:4], i+1, hj[:4])
+			}
+		}
+		if first == nil {
+			first = txs
+			continue
+		}
+		for i := range txs {
+			if txs[i].Hash() != first[i].Hash() {
+				t.Errorf("run %d: unstable ordering at tx #%d: have %x, want %x", run, i, txs[i].Hash(), first[i].Hash())
+			}
+		}
+	}
+}